@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"runtime"
+	"strconv"
+
+	"github.com/currantlabs/gatt"
+)
+
+// XMLAdvService represents a service UUID expected in the advertisement from the xml file
+type XMLAdvService struct {
+	ServiceID string `xml:"uuid,attr" json:"uuid" yaml:"uuid"`
+}
+
+// XMLAdvMfgData represents the expected manufacturer data of the advertisement from the xml file
+type XMLAdvMfgData struct {
+	CompanyID string `xml:"companyID,attr,omitempty" json:"companyID,omitempty" yaml:"companyID,omitempty"`
+	Pattern   string `xml:"pattern,attr,omitempty" json:"pattern,omitempty" yaml:"pattern,omitempty"`
+}
+
+// XMLAdvertisement represents the expected advertisement of a device from the xml file.
+// Every expectation that is set must hold for the advertisement to match.
+type XMLAdvertisement struct {
+	LocalName         string          `xml:"localName,attr,omitempty" json:"localName,omitempty" yaml:"localName,omitempty"`
+	TxPower           *int            `xml:"txPower,attr,omitempty" json:"txPower,omitempty" yaml:"txPower,omitempty"`
+	Connectable       *bool           `xml:"connectable,attr,omitempty" json:"connectable,omitempty" yaml:"connectable,omitempty"`
+	Flags             string          `xml:"flags,attr,omitempty" json:"flags,omitempty" yaml:"flags,omitempty"`
+	ServiceList       []XMLAdvService `xml:"service" json:"services,omitempty" yaml:"services,omitempty"`
+	MfgData           *XMLAdvMfgData  `xml:"manufacturerData,omitempty" json:"manufacturerData,omitempty" yaml:"manufacturerData,omitempty"`
+	Interval          string          `xml:"interval,attr,omitempty" json:"interval,omitempty" yaml:"interval,omitempty"`
+	IntervalTolerance string          `xml:"intervalTolerance,attr,omitempty" json:"intervalTolerance,omitempty" yaml:"intervalTolerance,omitempty"`
+}
+
+// advHasService checks whether a service UUID is listed in the advertisement
+func advHasService(a *gatt.Advertisement, svcID string) bool {
+	svcID = xmlNormalizeUUID(svcID)
+	for _, list := range [][]gatt.UUID{a.Services, a.OverflowService} {
+		for _, u := range list {
+			if xmlNormalizeUUID(u.String()) == svcID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// advCheckMfgData checks the manufacturer data of an advertisement. The company ID
+// is the first two bytes of the data, in little endian order, and the pattern is a
+// regular expression matched against the hex string of the bytes following it.
+func advCheckMfgData(m *XMLAdvMfgData, data []byte) error {
+	if len(data) < 2 {
+		return fmt.Errorf("expected manufacturer data but found %x", data)
+	}
+
+	if len(m.CompanyID) != 0 {
+		companyID, err := strconv.ParseUint(m.CompanyID, 0, 16)
+		if err != nil {
+			return fmt.Errorf("invalid companyID %q", m.CompanyID)
+		}
+		found := uint64(data[0]) | uint64(data[1])<<8
+		if found != companyID {
+			return fmt.Errorf("expected company ID 0x%04x but found 0x%04x", companyID, found)
+		}
+	}
+
+	if len(m.Pattern) != 0 {
+		re, err := regexp.Compile(m.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid manufacturer data pattern %q", m.Pattern)
+		}
+		payload := hex.EncodeToString(data[2:])
+		if !re.MatchString(payload) {
+			return fmt.Errorf("expected manufacturer data matching %q but found %s", m.Pattern, payload)
+		}
+	}
+	return nil
+}
+
+// advCheck checks an advertisement against its expectations, returning every mismatch
+func advCheck(adv *XMLAdvertisement, a *gatt.Advertisement) []error {
+	var errs []error
+
+	if len(adv.LocalName) != 0 {
+		re, err := regexp.Compile(adv.LocalName)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid localName pattern %q", adv.LocalName))
+		} else if !re.MatchString(a.LocalName) {
+			errs = append(errs, fmt.Errorf("expected local name matching %q but found %q", adv.LocalName, a.LocalName))
+		}
+	}
+
+	for _, s := range adv.ServiceList {
+		if !advHasService(a, s.ServiceID) {
+			errs = append(errs, fmt.Errorf("expected service %s but found %v", s.ServiceID, a.Services))
+		}
+	}
+
+	if adv.MfgData != nil {
+		if err := advCheckMfgData(adv.MfgData, a.ManufacturerData); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// Linux reports the TX power level as an unsigned byte
+	if txPower := int(int8(a.TxPowerLevel)); adv.TxPower != nil && txPower != *adv.TxPower {
+		errs = append(errs, fmt.Errorf("expected TX power level %d but found %d", *adv.TxPower, txPower))
+	}
+
+	if adv.Connectable != nil && a.Connectable != *adv.Connectable {
+		errs = append(errs, fmt.Errorf("expected connectable %v but found %v", *adv.Connectable, a.Connectable))
+	}
+
+	if len(adv.Flags) != 0 {
+		if err := advCheckFlags(adv.Flags, a.Flags); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// advCheckFlags checks the Flags field of an advertisement against the expected value
+func advCheckFlags(expected string, flags []byte) error {
+	value, err := strconv.ParseUint(expected, 0, 8)
+	if err != nil {
+		return fmt.Errorf("invalid flags %q", expected)
+	}
+	if len(flags) == 0 {
+		if runtime.GOOS == "darwin" {
+			return fmt.Errorf("expected flags 0x%02x but macOS does not report them", value)
+		}
+		return fmt.Errorf("expected flags 0x%02x but found none", value)
+	}
+	if uint64(flags[0]) != value {
+		return fmt.Errorf("expected flags 0x%02x but found 0x%02x", value, flags[0])
+	}
+	return nil
+}
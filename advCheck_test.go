@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/currantlabs/gatt"
+)
+
+func TestAdvCheckFlags(t *testing.T) {
+	adv := &XMLAdvertisement{Flags: "0x06"}
+
+	if errs := advCheck(adv, &gatt.Advertisement{Flags: []byte{0x06}}); len(errs) != 0 {
+		t.Errorf("flags 06 do not match: %v", errs)
+	}
+	for _, flags := range [][]byte{{0x05}, nil} {
+		if errs := advCheck(adv, &gatt.Advertisement{Flags: flags}); len(errs) != 1 {
+			t.Errorf("flags %x match 0x06", flags)
+		}
+	}
+	if errs := advCheck(&XMLAdvertisement{Flags: "0x100"}, &gatt.Advertisement{}); len(errs) != 1 {
+		t.Error("flags 0x100 accepted")
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/currantlabs/gatt"
+	"github.com/currantlabs/gatt/examples/option"
+)
+
+// advEventGap is the time within which reports belong to the same advertising event,
+// such as an advertisement and its scan response. Advertising intervals are at least 20ms.
+const advEventGap = 10 * time.Millisecond
+
+// advDelayMax is the maximum random delay the link layer adds to every advertising event
+const advDelayMax = 10 * time.Millisecond
+
+// AdvIntervalStats represents the advertising interval measured for a device
+type AdvIntervalStats struct {
+	Received int
+	Missed   int
+	Mean     time.Duration
+	Min      time.Duration
+	Max      time.Duration
+	Jitter   time.Duration
+}
+
+// advExpectedInterval parses the expected advertising interval and its tolerance
+// from the spec. The tolerance defaults to the maximum random advertising delay.
+func advExpectedInterval(adv *XMLAdvertisement) (time.Duration, time.Duration, error) {
+	if adv == nil || len(adv.Interval) == 0 {
+		return 0, 0, nil
+	}
+	interval, err := time.ParseDuration(adv.Interval)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid interval %q", adv.Interval)
+	}
+	tolerance := advDelayMax
+	if len(adv.IntervalTolerance) != 0 {
+		if tolerance, err = time.ParseDuration(adv.IntervalTolerance); err != nil {
+			return 0, 0, fmt.Errorf("invalid intervalTolerance %q", adv.IntervalTolerance)
+		}
+	}
+	return interval, tolerance, nil
+}
+
+// advIntervalStats computes the interval statistics of the advertising events seen at
+// the given times. Gaps spanning several base intervals are counted as missed events,
+// and left out of the interval statistics. Without a base interval the median gap is used.
+// On Linux a scannable advertisement is only reported once its scan response arrives, so
+// an event whose scan response is lost is also counted as missed.
+func advIntervalStats(times []time.Time, base time.Duration) *AdvIntervalStats {
+	stats := &AdvIntervalStats{Received: len(times)}
+
+	var gaps []time.Duration
+	for idx := 1; idx < len(times); idx++ {
+		gaps = append(gaps, times[idx].Sub(times[idx-1]))
+	}
+	if len(gaps) == 0 {
+		return stats
+	}
+	if base == 0 {
+		sorted := append([]time.Duration(nil), gaps...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		base = sorted[len(sorted)/2]
+	}
+
+	var intervals []time.Duration
+	var sum time.Duration
+	for _, gap := range gaps {
+		events := int(math.Floor(float64(gap)/float64(base) + 0.5))
+		if events > 1 {
+			stats.Missed += events - 1
+			continue
+		}
+		intervals = append(intervals, gap)
+		sum += gap
+		if stats.Min == 0 || gap < stats.Min {
+			stats.Min = gap
+		}
+		if gap > stats.Max {
+			stats.Max = gap
+		}
+	}
+	if len(intervals) == 0 {
+		return stats
+	}
+
+	stats.Mean = sum / time.Duration(len(intervals))
+	var variance float64
+	for _, interval := range intervals {
+		d := float64(interval - stats.Mean)
+		variance += d * d
+	}
+	stats.Jitter = time.Duration(math.Sqrt(variance / float64(len(intervals))))
+	return stats
+}
+
+// advShowIntervalStats displays the measured advertising interval
+func advShowIntervalStats(stats *AdvIntervalStats) {
+	loss := 0.0
+	if stats.Received+stats.Missed != 0 {
+		loss = 100 * float64(stats.Missed) / float64(stats.Received+stats.Missed)
+	}
+	fmt.Println("  Advertisements received =", stats.Received)
+	fmt.Printf("  Estimated missed         = %d (%.1f%%)\n", stats.Missed, loss)
+	fmt.Println("  Interval mean            =", stats.Mean)
+	fmt.Println("  Interval min             =", stats.Min)
+	fmt.Println("  Interval max             =", stats.Max)
+	fmt.Println("  Interval jitter          =", stats.Jitter)
+}
+
+// advMeasureInterval scans for the specified device with duplicate reporting enabled,
+// and measures the interval between its advertisements for the scan duration. When a
+// spec file with an expected interval is given, the mean interval is checked against it.
+func advMeasureInterval(macIDArg string, targetName string, timeout time.Duration, specFile string) {
+	var expected, tolerance time.Duration
+
+	if len(specFile) != 0 {
+		dev, err := xmlLoadDevice(specFile)
+		if err != nil {
+			fmt.Println("Error reading file \n\t", err)
+			return
+		}
+		if expected, tolerance, err = advExpectedInterval(dev.Advertisement); err != nil {
+			fmt.Println("Error reading advertisement \n\t", err)
+			return
+		}
+		if expected == 0 {
+			fmt.Println("No advertising interval specified in", specFile)
+		}
+	}
+
+	deviceName = targetName
+	if bleSetMacID(macIDArg) == false {
+		return
+	}
+
+	d, err := gatt.NewDevice(option.DefaultClientOptions...)
+	if err != nil {
+		log.Fatalf("Failed to open device, err: %s\n", err)
+		return
+	}
+
+	var mu sync.Mutex
+	var times []time.Time
+	onAdvDiscovered := func(p gatt.Peripheral, a *gatt.Advertisement, rssi int) {
+		now := time.Now()
+		if bleMatchAdvertisement(a) == false {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if len(times) != 0 && now.Sub(times[len(times)-1]) < advEventGap {
+			return
+		}
+		times = append(times, now)
+	}
+
+	d.Handle(gatt.PeripheralDiscovered(onAdvDiscovered))
+	d.Init(func(d gatt.Device, s gatt.State) {
+		fmt.Println("State:", s)
+		if s == gatt.StatePoweredOn {
+			d.Scan([]gatt.UUID{}, true)
+		}
+	})
+
+	fmt.Println("Measuring the advertising interval of", targetName, "for the next", timeout)
+	time.Sleep(timeout)
+	d.StopScanning()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(times) < 2 {
+		fmt.Println("Not enough advertisements received from", targetName)
+		return
+	}
+
+	base := time.Duration(0)
+	if expected != 0 {
+		base = expected + advDelayMax/2
+	}
+	stats := advIntervalStats(times, base)
+	fmt.Println()
+	advShowIntervalStats(stats)
+
+	if expected != 0 {
+		fmt.Println()
+		if stats.Mean < expected || stats.Mean > expected+tolerance {
+			fmt.Println("Advertising interval did not match specified document")
+			fmt.Println("\t Expected between", expected, "and", expected+tolerance, "but found", stats.Mean)
+		} else {
+			fmt.Println("Advertising interval matches specified document")
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// BDSCharacteristic represents a characteristic in a Bluetooth Developer Studio .gatt file
+type BDSCharacteristic struct {
+	CharName    string `xml:"name,attr"`
+	CharType    string `xml:"type,attr"`
+	CharID      string `xml:"uuid,attr"`
+	Requirement string
+	Properties  XMLCharProperties
+	Fields      []XMLField `xml:"Value>Field"`
+}
+
+// BDSService represents a service in a Bluetooth Developer Studio .gatt file
+type BDSService struct {
+	ServiceName string              `xml:"name,attr"`
+	ServiceID   string              `xml:"uuid,attr"`
+	CharList    []BDSCharacteristic `xml:"Characteristics>Characteristic"`
+}
+
+// BDSFile represents a Bluetooth Developer Studio .gatt file, holding either a
+// single service or a profile of several services
+type BDSFile struct {
+	XMLName xml.Name
+	BDSService
+	ServiceList []BDSService `xml:"Services>Service"`
+}
+
+// bdsImportService converts a BDS service into the XML spec model. Characteristics
+// without a uuid are resolved through their SIG type from charDir.
+func bdsImportService(s *BDSService, charDir string) XMLService {
+	svc := XMLService{ServiceName: s.ServiceName, ServiceID: xmlNormalizeUUID(s.ServiceID)}
+
+	for _, c := range s.CharList {
+		char := XMLCharacteristic{
+			CharName:    c.CharName,
+			CharID:      xmlNormalizeUUID(c.CharID),
+			Requirement: c.Requirement,
+			Properties:  c.Properties,
+			Fields:      c.Fields,
+			Format:      sigFieldsFormat(c.Fields),
+		}
+		if len(char.CharID) == 0 && len(c.CharType) != 0 {
+			sigChar, err := sigReadCharacteristic(charDir, c.CharType)
+			if err != nil {
+				fmt.Println("Skipping characteristic", c.CharName, "of", s.ServiceName, "\n\t", err)
+				continue
+			}
+			char.CharID = xmlNormalizeUUID(sigChar.CharID)
+			if len(char.Fields) == 0 {
+				char.Fields = sigChar.Fields
+				char.Format = sigFieldsFormat(char.Fields)
+			}
+		}
+		svc.CharList = append(svc.CharList, char)
+	}
+	svc.numChars = len(svc.CharList)
+
+	return svc
+}
+
+// bdsImportServices converts Bluetooth Developer Studio .gatt files into the XML spec model
+func bdsImportServices(fileNames []string, charDir string) ([]XMLService, error) {
+	var svcList []XMLService
+
+	for _, fileName := range fileNames {
+		var file BDSFile
+
+		b, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		if err := xml.Unmarshal(b, &file); err != nil {
+			return nil, fmt.Errorf("%s: %v", fileName, err)
+		}
+
+		bdsSvcList := file.ServiceList
+		if file.XMLName.Local == "Service" {
+			bdsSvcList = []BDSService{file.BDSService}
+		}
+		if len(bdsSvcList) == 0 {
+			return nil, fmt.Errorf("%s: no services found", fileName)
+		}
+
+		dir := charDir
+		if len(dir) == 0 {
+			dir = filepath.Dir(fileName)
+		}
+		for idx := range bdsSvcList {
+			svc := bdsImportService(&bdsSvcList[idx], dir)
+			fmt.Println("Imported service", svc.ServiceID, "(", svc.ServiceName, ") with",
+				svc.numChars, "characteristic(s)")
+			svcList = append(svcList, svc)
+		}
+	}
+	return svcList, nil
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/currantlabs/gatt"
+)
+
+// benchThroughputModes are the ways the throughput benchmark moves data: writes without
+// response, writes with response, or notifications from the device
+var benchThroughputModes = []string{"write-nr", "write", "notify"}
+
+// BenchThroughput represents the counters of a throughput benchmark
+type BenchThroughput struct {
+	Packets int
+	Bytes   int
+	Errors  int
+	Dropped int
+	Elapsed time.Duration
+	seqMin  uint32
+	seqMax  uint32
+	seqSeen bool
+	seqs    int
+	mu      sync.Mutex
+}
+
+// benchPayload fills a value to write with a counting pattern, starting with a 32-bit little
+// endian sequence number when it fits, so the device can count dropped packets
+func benchPayload(b []byte, seq uint32) {
+	for idx := range b {
+		b[idx] = byte(idx)
+	}
+	if len(b) >= 4 {
+		binary.LittleEndian.PutUint32(b, seq)
+	}
+}
+
+// received counts a notification, counting the packets dropped from the sequence number it
+// starts with when seq is set. Notifications are handled as they are delivered, which need not
+// be in order, so the packets dropped are those missing from the range of sequence numbers seen.
+func (t *BenchThroughput) received(b []byte, err error, seq bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err != nil {
+		t.Errors++
+		return
+	}
+	t.Packets++
+	t.Bytes += len(b)
+	if !seq || len(b) < 4 {
+		return
+	}
+	n := binary.LittleEndian.Uint32(b)
+	if !t.seqSeen || n < t.seqMin {
+		t.seqMin = n
+	}
+	if !t.seqSeen || n > t.seqMax {
+		t.seqMax = n
+	}
+	t.seqSeen = true
+	t.seqs++
+	// Repeated sequence numbers are not counted against dropped ones
+	if missing := int(t.seqMax-t.seqMin) + 1 - t.seqs; missing > 0 {
+		t.Dropped = missing
+	} else {
+		t.Dropped = 0
+	}
+}
+
+// show displays the results of a throughput benchmark, with the MTU agreed with the device
+// and the one requested when they differ
+func (t *BenchThroughput) show(mode string, requested int, mtu int, size int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	seconds := t.Elapsed.Seconds()
+	if seconds == 0 {
+		seconds = 1
+	}
+	fmt.Printf("%-10s %s\n", "Mode", mode)
+	if requested > 23 && requested != mtu {
+		fmt.Printf("%-10s %d (requested %d)\n", "MTU", mtu, requested)
+	} else {
+		fmt.Printf("%-10s %d\n", "MTU", mtu)
+	}
+	if size != 0 {
+		fmt.Printf("%-10s %d bytes\n", "Payload", size)
+	}
+	fmt.Printf("%-10s %.3fs\n", "Duration", t.Elapsed.Seconds())
+	fmt.Printf("%-10s %d (%.1f/s)\n", "Packets", t.Packets, float64(t.Packets)/seconds)
+	fmt.Printf("%-10s %d (%.1f B/s, %.1f kbit/s)\n", "Bytes", t.Bytes, float64(t.Bytes)/seconds,
+		float64(8*t.Bytes)/seconds/1000)
+	fmt.Printf("%-10s %d\n", "Errors", t.Errors)
+	fmt.Printf("%-10s %d\n", "Dropped", t.Dropped)
+}
+
+// benchStopTimeout is how long a benchmark waits for the request in progress once stopped,
+// before dropping the connection to abort it
+const benchStopTimeout = time.Second
+
+// benchWatch returns a channel closed once cancel or the deadline is reached, for the loop of
+// a benchmark to stop. A request the loop is blocked in is aborted by dropping the connection
+// when it does not return within benchStopTimeout. done is called once the loop returned.
+func benchWatch(p gatt.Peripheral, cancel <-chan struct{}, deadline <-chan time.Time) (stop <-chan struct{},
+	done func()) {
+	stopped := make(chan struct{})
+	returned := make(chan struct{})
+	go func() {
+		select {
+		case <-cancel:
+		case <-deadline:
+		case <-returned:
+			return
+		}
+		close(stopped)
+		select {
+		case <-returned:
+		case <-time.After(benchStopTimeout):
+			p.Device().CancelConnection(p)
+		}
+	}()
+
+	var once sync.Once
+	return stopped, func() { once.Do(func() { close(returned) }) }
+}
+
+// benchThroughput connects to the specified device and measures the throughput of a
+// characteristic for the duration, or until interrupted. Values of size bytes, or of the
+// MTU less 3 bytes when size is 0, are written with or without response, or notifications
+// of the device are counted. An MTU is requested first when given. Dropped packets are
+// counted from the sequence numbers notifications start with when seq is set; written
+// values always start with one. It returns the exit status of the command.
+func benchThroughput(macIDArg string, name string, svcID string, charID string, mode string, size int,
+	duration time.Duration, mtu int, seq bool) int {
+	status := exitConnectFailed
+	stats := &BenchThroughput{}
+	agreed := 0
+
+	cancel, stopCancel := bleCancelOnInterrupt(0)
+	defer stopCancel()
+
+	err := bleConnectDeviceUntil(macIDArg, name, cancel, func(p gatt.Peripheral, lost <-chan struct{}) error {
+		maxSize := bleSetMTU(p, mtu)
+		agreed = p.MTU()
+
+		_, c, err := charFind(p, svcID, charID)
+		if err != nil {
+			status = exitNotFound
+			return err
+		}
+
+		var start time.Time
+		stop, done := benchWatch(p, cancel, time.After(duration))
+		defer done()
+		stopped := func() bool {
+			select {
+			case <-lost:
+				return true
+			case <-stop:
+				return true
+			default:
+				return false
+			}
+		}
+
+		if mode == "notify" {
+			status = exitSubscribeFailed
+			size = 0
+			if (c.Properties() & (gatt.CharNotify | gatt.CharIndicate)) == 0 {
+				return fmt.Errorf("characteristic %s does not support notifications or indications", c.UUID())
+			}
+			if _, err := p.DiscoverDescriptors(nil, c); err != nil {
+				return fmt.Errorf("failed to discover descriptors: %v", err)
+			}
+			start = time.Now()
+			err := subSetValue(p, c, func(c *gatt.Characteristic, b []byte, err error) {
+				stats.received(b, err, seq)
+			})
+			if err != nil {
+				return fmt.Errorf("failed to subscribe to %s: %v", c.UUID(), err)
+			}
+			select {
+			case <-lost:
+			case <-stop:
+			}
+			stats.Elapsed = time.Since(start)
+			subSetValue(p, c, nil)
+		} else {
+			status = exitWriteFailed
+			noRsp := mode == "write-nr"
+			if noRsp && (c.Properties()&gatt.CharWriteNR) == 0 {
+				return fmt.Errorf("characteristic %s does not support write without response", c.UUID())
+			}
+			if !noRsp && (c.Properties()&gatt.CharWrite) == 0 {
+				return fmt.Errorf("characteristic %s does not support write with response", c.UUID())
+			}
+			if size == 0 {
+				size = maxSize
+			} else if size > maxSize {
+				return fmt.Errorf("size of %d bytes exceeds the %d bytes of an MTU of %d", size, maxSize, agreed)
+			}
+
+			b := make([]byte, size)
+			start = time.Now()
+			for n := uint32(0); !stopped(); n++ {
+				benchPayload(b, n)
+				if err := p.WriteCharacteristic(c, b, noRsp); err == gatt.ErrDisconnected {
+					break
+				} else if err != nil {
+					stats.Errors++
+					continue
+				}
+				stats.Packets++
+				stats.Bytes += size
+			}
+			stats.Elapsed = time.Since(start)
+		}
+
+		select {
+		case <-lost:
+			select {
+			case <-stop:
+				// The connection was dropped to abort a write once stopped
+			default:
+				status = exitConnectFailed
+				return fmt.Errorf("connection lost after %.3fs", stats.Elapsed.Seconds())
+			}
+		default:
+		}
+		status = exitOK
+		return nil
+	})
+
+	if stats.Elapsed != 0 {
+		stats.show(mode, mtu, agreed, size)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error running benchmark \n\t", err)
+	}
+	return status
+}
+
+// benchLatencyModes are the round trips the latency benchmark times: reads, or writes with response
+var benchLatencyModes = []string{"read", "write"}
+
+// benchHistogramBins is the number of bins of the latency histogram
+const benchHistogramBins = 10
+
+// benchDurations sorts round trip times
+type benchDurations []time.Duration
+
+func (d benchDurations) Len() int           { return len(d) }
+func (d benchDurations) Less(i, j int) bool { return d[i] < d[j] }
+func (d benchDurations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// benchMillis formats a duration in milliseconds
+func benchMillis(d time.Duration) string {
+	return fmt.Sprintf("%.3fms", float64(d)/float64(time.Millisecond))
+}
+
+// benchPercentile returns the percentile of sorted round trip times, by the nearest rank
+func benchPercentile(sorted []time.Duration, percent int) time.Duration {
+	rank := (percent*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// benchShowLatency displays the statistics and histogram of the round trip times of a latency
+// benchmark
+func benchShowLatency(mode string, samples []time.Duration, errors int) {
+	fmt.Printf("%-10s %s\n", "Mode", mode)
+	fmt.Printf("%-10s %d\n", "Samples", len(samples))
+	fmt.Printf("%-10s %d\n", "Errors", errors)
+	if len(samples) == 0 {
+		return
+	}
+
+	sorted := append(benchDurations(nil), samples...)
+	sort.Sort(sorted)
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	min, max := sorted[0], sorted[len(sorted)-1]
+	fmt.Printf("%-10s %s\n", "Min", benchMillis(min))
+	fmt.Printf("%-10s %s\n", "Median", benchMillis(benchPercentile(sorted, 50)))
+	fmt.Printf("%-10s %s\n", "Mean", benchMillis(total/time.Duration(len(sorted))))
+	fmt.Printf("%-10s %s\n", "P95", benchMillis(benchPercentile(sorted, 95)))
+	fmt.Printf("%-10s %s\n", "P99", benchMillis(benchPercentile(sorted, 99)))
+	fmt.Printf("%-10s %s\n", "Max", benchMillis(max))
+
+	if max == min {
+		return
+	}
+
+	// Bins of equal width between the minimum and the maximum
+	var counts [benchHistogramBins]int
+	width := (max - min) / benchHistogramBins
+	if width == 0 {
+		width = 1
+	}
+	peak := 0
+	for _, d := range sorted {
+		bin := int((d - min) / width)
+		if bin >= benchHistogramBins {
+			bin = benchHistogramBins - 1
+		}
+		if counts[bin]++; counts[bin] > peak {
+			peak = counts[bin]
+		}
+	}
+
+	fmt.Println()
+	for bin, count := range counts {
+		from := min + time.Duration(bin)*width
+		fmt.Printf("%10s - %-10s %-40s %d\n", benchMillis(from), benchMillis(from+width),
+			strings.Repeat("#", 40*count/peak), count)
+	}
+}
+
+// benchLatency connects to the specified device and times n reads of a characteristic, or
+// n writes with response of the value. When no value is given, the value read from the
+// characteristic is written back. It returns the exit status of the command.
+func benchLatency(macIDArg string, name string, svcID string, charID string, mode string, n int,
+	value []byte) int {
+	status := exitConnectFailed
+	var samples []time.Duration
+	errors := 0
+
+	cancel, stopCancel := bleCancelOnInterrupt(0)
+	defer stopCancel()
+
+	err := bleConnectDeviceUntil(macIDArg, name, cancel, func(p gatt.Peripheral, lost <-chan struct{}) error {
+		_, c, err := charFind(p, svcID, charID)
+		if err != nil {
+			status = exitNotFound
+			return err
+		}
+
+		status = exitReadFailed
+		if mode == "write" {
+			status = exitWriteFailed
+			if (c.Properties() & gatt.CharWrite) == 0 {
+				return fmt.Errorf("characteristic %s does not support write with response", c.UUID())
+			}
+			if value == nil {
+				if (c.Properties() & gatt.CharRead) == 0 {
+					return fmt.Errorf("characteristic %s is not readable, please enter a value to write", c.UUID())
+				}
+				if value, err = bleReadValue(p, c); err != nil {
+					return fmt.Errorf("failed to read characteristic %s: %v", c.UUID(), err)
+				}
+			}
+		} else if (c.Properties() & gatt.CharRead) == 0 {
+			return fmt.Errorf("characteristic %s is not readable", c.UUID())
+		}
+
+		stop, done := benchWatch(p, cancel, nil)
+		defer done()
+		for idx := 0; idx < n; idx++ {
+			// Checked first, as the connection is dropped to abort a round trip once stopped
+			select {
+			case <-stop:
+				status = exitOK
+				return nil
+			default:
+			}
+			select {
+			case <-lost:
+				status = exitConnectFailed
+				return fmt.Errorf("connection lost after %d round trips", idx)
+			default:
+			}
+
+			start := time.Now()
+			if mode == "write" {
+				err = p.WriteCharacteristic(c, value, false)
+			} else {
+				_, err = p.ReadCharacteristic(c)
+			}
+			elapsed := time.Since(start)
+			if err == gatt.ErrDisconnected {
+				idx--
+				continue
+			} else if err != nil {
+				// An error response completes the round trip, but times a different one
+				errors++
+				continue
+			}
+			samples = append(samples, elapsed)
+		}
+		status = exitOK
+		return nil
+	})
+
+	if len(samples) != 0 || errors != 0 {
+		benchShowLatency(mode, samples, errors)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error running benchmark \n\t", err)
+	}
+	return status
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestBenchReceived(t *testing.T) {
+	tests := []struct {
+		seqs    []uint32
+		dropped int
+	}{
+		{[]uint32{0, 1, 2, 3}, 0},
+		{[]uint32{3, 1, 0, 2}, 0},
+		{[]uint32{10, 12, 11, 14}, 1},
+		{[]uint32{5, 9, 6}, 2},
+		{[]uint32{2, 2, 3}, 0},
+		{[]uint32{7}, 0},
+	}
+	for _, test := range tests {
+		stats := &BenchThroughput{}
+		for _, seq := range test.seqs {
+			b := make([]byte, 20)
+			binary.LittleEndian.PutUint32(b, seq)
+			stats.received(b, nil, true)
+		}
+		if stats.Packets != len(test.seqs) || stats.Dropped != test.dropped {
+			t.Errorf("%v: counted %d packets and %d dropped, expected %d and %d", test.seqs, stats.Packets,
+				stats.Dropped, len(test.seqs), test.dropped)
+		}
+	}
+}
@@ -3,9 +3,15 @@ package main
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/currantlabs/gatt"
@@ -18,7 +24,15 @@ var deviceName string
 var macID []byte
 var isCmpMode = false
 var isXMLMode = false
+var isReadValuesMode = false
+var advHasErr = false
 var device *XMLDevice
+var cmpReport *Report
+var isConnected = false
+
+// bleOut is where reading and comparing a device writes its output, given by the command as
+// the gatt handlers that write it take no arguments
+var bleOut io.Writer = os.Stdout
 
 const maxScanResult uint32 = 100000
 const maxTimeoutTime time.Duration = 15 * time.Second
@@ -42,11 +56,11 @@ var scanMap map[string]ScanMapResult
 var scanList []ScanListResult
 
 func onStateChanged(d gatt.Device, s gatt.State) {
-	fmt.Println()
-	fmt.Println("State:", s)
+	fmt.Fprintln(bleOut)
+	fmt.Fprintln(bleOut, "State:", s)
 	switch s {
 	case gatt.StatePoweredOn:
-		fmt.Println("Scanning...")
+		fmt.Fprintln(bleOut, "Scanning...")
 		d.Scan([]gatt.UUID{}, false)
 		return
 	default:
@@ -54,15 +68,15 @@ func onStateChanged(d gatt.Device, s gatt.State) {
 	}
 }
 
-// onPeriphDiscovered Checks the peripheral that is discovered and connects to the correct peripheral
-func onPeriphDiscovered(p gatt.Peripheral, a *gatt.Advertisement, rssi int) {
+// bleMatchAdvertisement checks whether an advertisement comes from the device being looked for
+func bleMatchAdvertisement(a *gatt.Advertisement) bool {
 	if strings.ToUpper(a.LocalName) != strings.ToUpper(deviceName) {
-		return
+		return false
 	}
 	lenMfgData := len(a.ManufacturerData)
 
 	if len(macID) != 0 && len(a.ManufacturerData) == 0 {
-		return
+		return false
 	}
 
 	if (len(a.ManufacturerData) != 0) && (len(macID) != 0) {
@@ -70,20 +84,51 @@ func onPeriphDiscovered(p gatt.Peripheral, a *gatt.Advertisement, rssi int) {
 
 		// Compare tail of macIdAdv with tail of macId
 		if bytes.Equal(macIDAdv, (macID)) == false {
-			return
+			return false
 		}
 	}
+	return true
+}
+
+// onPeriphDiscovered Checks the peripheral that is discovered and connects to the correct peripheral
+func onPeriphDiscovered(p gatt.Peripheral, a *gatt.Advertisement, rssi int) {
+	if bleMatchAdvertisement(a) == false {
+		return
+	}
 	// Stop scanning once we've got the peripheral we're looking for.
 	p.Device().StopScanning()
 
-	fmt.Printf("\nPeripheral ID:%s, NAME:(%s)\n", p.ID(), p.Name())
-	fmt.Println("  Local Name        =", a.LocalName)
-	fmt.Println("  TX Power Level    =", a.TxPowerLevel)
-	fmt.Println("  Manufacturer Data =", a.ManufacturerData)
-	fmt.Println("  Service Data      =", a.ServiceData)
-	fmt.Println("")
+	fmt.Fprintf(bleOut, "\nPeripheral ID:%s, NAME:(%s)\n", p.ID(), p.Name())
+	fmt.Fprintln(bleOut, "  Local Name        =", a.LocalName)
+	fmt.Fprintln(bleOut, "  TX Power Level    =", a.TxPowerLevel)
+	fmt.Fprintln(bleOut, "  Manufacturer Data =", a.ManufacturerData)
+	fmt.Fprintln(bleOut, "  Service Data      =", a.ServiceData)
+	fmt.Fprintln(bleOut, "")
+
+	if isCmpMode == true {
+		cmpReport.Device = &ReportDevice{
+			ID:        p.ID(),
+			LocalName: a.LocalName,
+			TxPower:   int(int8(a.TxPowerLevel)),
+			MfgData:   fmt.Sprintf("%x", a.ManufacturerData),
+		}
+	}
+
+	if isCmpMode == true && device.Advertisement != nil {
+		var failures []string
+		if errs := advCheck(device.Advertisement, a); len(errs) != 0 {
+			fmt.Fprintln(bleOut, "Advertisement does not match. ")
+			for _, err := range errs {
+				fmt.Fprintln(bleOut, "\t", err)
+				failures = append(failures, err.Error())
+			}
+			fmt.Fprintln(bleOut, "")
+			advHasErr = true
+		}
+		cmpReport.Add(deviceName, "advertisement", 0, failures...)
+	}
 
-	fmt.Println("connecting.... ")
+	fmt.Fprintln(bleOut, "connecting.... ")
 	p.Device().Connect(p)
 }
 
@@ -146,46 +191,70 @@ func onScanPeriphDiscovered(p gatt.Peripheral, a *gatt.Advertisement, rssi int)
 	}
 }
 
-func testCharWrite(p gatt.Peripheral, ch *gatt.Characteristic) {
-	fmt.Println("testing char " + ch.UUID().String())
-	if (ch.Properties() & gatt.CharWrite) == 0 {
-		fmt.Println("Char is not writeable. Abort")
-		return
+// bleReadValue reads the value of a characteristic, using long reads where supported
+func bleReadValue(p gatt.Peripheral, c *gatt.Characteristic) ([]byte, error) {
+	b, err := p.ReadLongCharacteristic(c)
+	if err != nil {
+		return p.ReadCharacteristic(c)
 	}
-	var b = []byte{0x00, 0x00, 0x03, 0x01}
+	return b, nil
+}
 
-	charToWrite := ch
-	for b[3] < 0x8 {
-		fmt.Printf("Current value of characteristic : %x\n", b)
-		if p.WriteCharacteristic(charToWrite, b, true) != nil {
-			fmt.Println("error writing char")
-		}
+// bleCheckValue reads a characteristic and checks it against the expected value,
+// returning why it does not match
+func bleCheckValue(p gatt.Peripheral, c *gatt.Characteristic, v *XMLValueConstraint) error {
+	if (c.Properties() & gatt.CharRead) == 0 {
+		fmt.Fprintln(bleOut, "Char Value can not be checked, char is not readable")
+		return errors.New("value can not be checked, characteristic is not readable")
+	}
+	b, err := bleReadValue(p, c)
+	if err != nil {
+		fmt.Fprintln(bleOut, "Failed to read char value, err:", err)
+		return fmt.Errorf("failed to read value: %v", err)
+	}
+	if err := valueCheck(v, b); err != nil {
+		fmt.Fprintln(bleOut, "Char Value does not match. ")
+		fmt.Fprintln(bleOut, "\t", err)
+		return err
+	}
+	return nil
+}
 
-		time.Sleep(5 * time.Second)
-		b[3] += 2
+// bleShowValue reads a characteristic and prints its value, decoded with the format
+// from the spec when there is one, or with the SIG decoder of standard characteristics
+func bleShowValue(p gatt.Peripheral, c *gatt.Characteristic) {
+	b, err := bleReadValue(p, c)
+	if err != nil {
+		fmt.Fprintln(bleOut, "\t   Failed to read value, err:", err)
+		return
 	}
-	return
+	fmt.Fprintln(bleOut, "\t   Value:", formatDescribeChar(device, c.UUID().String(), b))
 }
 
 // onPeriphConnected Callback when a connection to a peripheral is established
 func onPeriphConnected(p gatt.Peripheral, err error) {
-	fmt.Println("Connected")
+	fmt.Fprintln(bleOut, "Connected")
 	connected <- true
+	isConnected = true
+	if isCmpMode == true {
+		cmpReport.Add(deviceName, "connect", time.Since(cmpReport.Start))
+	}
 	defer p.Device().CancelConnection(p)
 	var numServices int
-	var hasErr = false
+	var hasErr = advHasErr
 
 	// Discover services
 	ss, err := p.DiscoverServices(nil)
 	if err != nil {
-		fmt.Printf("Failed to discover services, err: %s\n", err)
+		fmt.Fprintf(bleOut, "Failed to discover services, err: %s\n", err)
 		return
 	}
 
-	svcUUIDNames, _ := csvReadFile("CustomServices.csv")
-	charUUIDNames, _ := csvReadFile("CustomCharacteristics.csv")
+	svcUUIDNames, _ := csvReadFile(bleOut, "CustomServices.csv")
+	charUUIDNames, _ := csvReadFile(bleOut, "CustomCharacteristics.csv")
 
 	xmlDev := &XMLDevice{DeviceName: deviceName}
+	foundSvcs := make(map[string]bool)
 
 	for _, s := range ss {
 		var svc *XMLService
@@ -199,12 +268,15 @@ func onPeriphConnected(p gatt.Peripheral, err error) {
 		}
 		msg += " (" + svcName + ")"
 		numServices++
-		fmt.Println(msg)
+		fmt.Fprintln(bleOut, msg)
+		svcCase := "service " + s.UUID().String()
+		foundSvcs[s.UUID().String()] = true
 		if isCmpMode == true {
 			isFoundService, svc = xmlFindService(device, s.UUID().String())
 			if isFoundService == false {
-				fmt.Println("Unable to find service ", s.UUID().String(), "in XML Definition")
+				fmt.Fprintln(bleOut, "Unable to find service ", s.UUID().String(), "in XML Definition")
 				hasErr = true
+				cmpReport.Check(deviceName, svcCase, "absent", "present", 0, "service not found in XML definition")
 				continue
 			}
 		}
@@ -212,14 +284,17 @@ func onPeriphConnected(p gatt.Peripheral, err error) {
 		// Discover characteristics
 		cs, err := p.DiscoverCharacteristics(nil, s)
 		if err != nil {
-			fmt.Printf("Failed to discover characteristics, err: %s\n", err)
+			fmt.Fprintf(bleOut, "Failed to discover characteristics, err: %s\n", err)
 			continue
 		}
 
 		var numChars int
 		var xmlCharList []XMLCharacteristic
+		foundChars := make(map[string]bool)
 		for _, c := range cs {
 			var charName string
+			var failures []string
+			start := time.Now()
 			numChars++
 			msg := "\tCharacteristic: " + c.UUID().String()
 			if len(c.Name()) > 0 {
@@ -228,61 +303,141 @@ func onPeriphConnected(p gatt.Peripheral, err error) {
 				charName = charUUIDNames[c.UUID().String()]
 			}
 			msg += " (" + charName + ")"
-			fmt.Println(msg)
-			fmt.Println("\t  ", c.Properties().String())
+			fmt.Fprintln(bleOut, msg)
+			fmt.Fprintln(bleOut, "\t  ", c.Properties().String())
+			if isReadValuesMode == true && (c.Properties()&gatt.CharRead) != 0 {
+				bleShowValue(p, c)
+			}
 
 			ds, err := p.DiscoverDescriptors(nil, c)
 			if err != nil {
-				fmt.Printf("Failed to discover descriptors, err: %s\n", err)
+				fmt.Fprintf(bleOut, "Failed to discover descriptors, err: %s\n", err)
 				continue
 			}
 
 			for _, d := range ds {
 				msg := "\t\tDescriptor: " + d.UUID().String() + " (" + d.Name() + ") "
-				fmt.Println(msg)
+				fmt.Fprintln(bleOut, msg)
 			}
 
+			foundChars[c.UUID().String()] = true
 			if isCmpMode == true && svc != nil {
 				isFoundChar, char := xmlFindChar(svc, c.UUID().String())
+				charCase := "characteristic " + c.UUID().String()
 				if isFoundChar == false {
-					fmt.Println("Unable to find char ", c.UUID().String(), "in XML Definition")
+					fmt.Fprintln(bleOut, "Unable to find char ", c.UUID().String(), "in XML Definition")
 					hasErr = true
+					cmpReport.Check(svcCase, charCase, "absent", c.Properties().String(), time.Since(start),
+						"characteristic not found in XML definition")
 					continue
 				} else {
 					if char.Properties.bitMask != c.Properties() {
-						fmt.Println("Char Properties do not match. ")
-						fmt.Println("\t Expected '", char.Properties.bitMask,
+						fmt.Fprintln(bleOut, "Char Properties do not match. ")
+						fmt.Fprintln(bleOut, "\t Expected '", char.Properties.bitMask,
 							"' but found '", c.Properties(), "'")
 						hasErr = true
+						failures = append(failures, fmt.Sprintf("expected properties %s but found %s",
+							char.Properties.bitMask, c.Properties()))
+					}
+					if char.Value != nil {
+						if err := bleCheckValue(p, c, char.Value); err != nil {
+							hasErr = true
+							failures = append(failures, err.Error())
+						}
 					}
 				}
+				cmpReport.Check(svcCase, charCase, char.Properties.bitMask.String(), c.Properties().String(),
+					time.Since(start), failures...)
 			}
 			xmlChar := xmlAppendCharInfo(charName, c.UUID().String(), c.Properties())
 			xmlCharList = append(xmlCharList, *xmlChar)
 		}
-		fmt.Println()
-		if (isCmpMode == true) && (numChars != svc.numChars) {
-			fmt.Println("Expected", svc.numChars, "characteristics but found", numChars)
-			hasErr = true
+		fmt.Fprintln(bleOut)
+		if isCmpMode == true {
+			// Characteristics that are not mandatory may be absent, and are not expected then
+			numExpected := svc.numChars
+			for _, char := range svc.CharList {
+				if foundChars[char.CharID] == false && !xmlIsMandatory(&char) {
+					fmt.Fprintln(bleOut, "Optional char", char.CharID, "of XML Definition not on device")
+					numExpected--
+					cmpReport.Check(svcCase, "characteristic "+char.CharID, char.Requirement, "absent", 0)
+				} else if foundChars[char.CharID] == false {
+					fmt.Fprintln(bleOut, "Unable to find char ", char.CharID, "of XML Definition on device")
+					hasErr = true
+					cmpReport.Check(svcCase, "characteristic "+char.CharID, char.Properties.bitMask.String(), "absent",
+						0, "characteristic of XML definition not found on device")
+				}
+			}
+			var failures []string
+			if numChars != numExpected {
+				fmt.Fprintln(bleOut, "Expected", numExpected, "characteristics but found", numChars)
+				hasErr = true
+				failures = append(failures, fmt.Sprintf("expected %d characteristics but found %d", numExpected, numChars))
+			}
+			cmpReport.Check(deviceName, svcCase, fmt.Sprintf("%d characteristics", numExpected),
+				fmt.Sprintf("%d characteristics", numChars), 0, failures...)
 		}
 		xmlSvc := xmlAppendSvcInfo(xmlDev, svcName, s.UUID().String(), xmlCharList)
 		xmlDev.ServiceList = append(xmlDev.ServiceList, *xmlSvc)
 	}
-	if (isCmpMode == true) && (numServices != device.numServices) {
-		fmt.Println("Expected", device.numServices, "services but found", numServices)
-		hasErr = true
+	identity, err := disRead(p, ss)
+	if err != nil {
+		fmt.Fprintln(bleOut, "Failed to read device information, err:", err)
+	}
+	if identity != nil {
+		disShow(bleOut, identity)
+		xmlDev.Identity = identity
+	}
+	if isCmpMode == true && device.Identity != nil {
+		var failures []string
+		if errs := disCheck(device.Identity, identity); len(errs) != 0 {
+			fmt.Fprintln(bleOut, "Device information does not match. ")
+			for _, err := range errs {
+				fmt.Fprintln(bleOut, "\t", err)
+				failures = append(failures, err.Error())
+			}
+			fmt.Fprintln(bleOut, "")
+			hasErr = true
+		}
+		cmpReport.Check(deviceName, "device information", disDescribe(device.Identity), disDescribe(identity), 0,
+			failures...)
+	}
+
+	if isCmpMode == true {
+		for _, svc := range device.ServiceList {
+			if foundSvcs[svc.ServiceID] == false {
+				fmt.Fprintln(bleOut, "Unable to find service ", svc.ServiceID, "of XML Definition on device")
+				hasErr = true
+				cmpReport.Check(deviceName, "service "+svc.ServiceID, fmt.Sprintf("%d characteristics", svc.numChars),
+					"absent", 0, "service of XML definition not found on device")
+			}
+		}
+		var failures []string
+		if numServices != device.numServices {
+			fmt.Fprintln(bleOut, "Expected", device.numServices, "services but found", numServices)
+			hasErr = true
+			failures = append(failures, fmt.Sprintf("expected %d services but found %d", device.numServices, numServices))
+		}
+		cmpReport.Check(deviceName, "services", strconv.Itoa(device.numServices), strconv.Itoa(numServices), 0,
+			failures...)
+		cmpReport.Tree = xmlDev
 	}
 
 	if isCmpMode == true {
 		if hasErr == true {
-			fmt.Println("Device did not match specified document")
+			fmt.Fprintln(bleOut, "Device did not match specified document")
 		} else {
-			fmt.Println("Device matches specified document")
+			fmt.Fprintln(bleOut, "Device matches specified document")
 		}
 	}
 
 	if isXMLMode == true {
-		xmlOutDeviceInfo(xmlDev)
+		// The report keeps the values read, the capture the patterns a compare requires
+		capture := *xmlDev
+		if capture.Identity != nil {
+			capture.Identity = disPattern(capture.Identity)
+		}
+		xmlOutDeviceInfo(&capture)
 	}
 
 	p.Device().CancelConnection(p)
@@ -290,16 +445,33 @@ func onPeriphConnected(p gatt.Peripheral, err error) {
 
 // onPeriphDisconnected Callback when a peripheral is disconnected from
 func onPeriphDisconnected(p gatt.Peripheral, err error) {
-	fmt.Println("Disconnected")
+	fmt.Fprintln(bleOut, "Disconnected")
 	close(done)
 }
 
-// bleCompareDevice sets up device comparison mode
-func bleCompareDevice(macIDArg string, deviceName string, fileName string) {
+// bleCompareDevice sets up device comparison mode, writing its output to out and a report of
+// the checks when a report format is given
+func bleCompareDevice(out io.Writer, macIDArg string, deviceName string, fileName string, reportFormat string,
+	reportFile string) {
+	bleOut = out
 	isCmpMode = true
-	device = xmlGetServices(fileName)
+	device = xmlGetServices(out, fileName)
+	cmpReport = reportNew("compare " + deviceName)
+	cmpReport.DeviceName = deviceName
+	cmpReport.Spec = fileName
+	cmpReport.SpecHash = reportHashFile(fileName)
 
 	bleReadDevice(macIDArg, deviceName)
+
+	if len(reportFormat) == 0 {
+		return
+	}
+	if isConnected == false {
+		cmpReport.Add(deviceName, "connect", time.Since(cmpReport.Start), "timed out connecting to device")
+	}
+	if err := reportWrite(cmpReport, reportFormat, reportFile); err != nil {
+		fmt.Fprintln(bleOut, "Error writing report \n\t", err)
+	}
 }
 
 // bleReadDeviceXml connects to the specified device and outputs an XML file
@@ -308,34 +480,60 @@ func bleReadDeviceXML(macIDArg string, deviceName string) {
 	bleReadDevice(macIDArg, deviceName)
 }
 
-// bleReadDevice connects to the specified device
-func bleReadDevice(macIDArg string, deviceName string) {
+// bleReadDeviceValues connects to the specified device and reads the value of every
+// readable characteristic, decoding values with the formats of the spec file if given
+func bleReadDeviceValues(macIDArg string, deviceName string, specFile string, xmlOut bool) {
+	if len(specFile) != 0 {
+		var err error
+		if device, err = xmlLoadDevice(specFile); err != nil {
+			fmt.Fprintln(bleOut, "Error reading file \n\t", err)
+			return
+		}
+	}
+	isReadValuesMode = true
+	isXMLMode = xmlOut
+	bleReadDevice(macIDArg, deviceName)
+}
+
+// bleSetMacID sets the mfg data ID of the device being looked for, returning false
+// if it is invalid
+func bleSetMacID(macIDArg string) bool {
 	var err error
 	var maxMacLen = 3
 
-	if len(deviceName) == 0 {
-		fmt.Println(" Please specify a device to connect to")
-		return
-	}
-
 	if len(macIDArg) != 0 {
 		if len(macIDArg)%2 != 0 {
-			fmt.Println("  Invalid len of MAC ID ", macIDArg)
-			return
+			fmt.Fprintln(bleOut, "  Invalid len of MAC ID ", macIDArg)
+			return false
 		}
 		macID, err = hex.DecodeString(macIDArg)
 		if nil != err {
-			fmt.Println("  Invalid MAC ID ", macIDArg)
+			fmt.Fprintln(bleOut, "  Invalid MAC ID ", macIDArg)
 			panic(err)
 		}
 
 		if len(macID) != maxMacLen {
-			fmt.Println("  Invalid MAC:", macID)
-			return
+			fmt.Fprintln(bleOut, "  Invalid MAC:", macID)
+			return false
 		}
+	} else {
+		macID = nil
+	}
+	return true
+}
+
+// bleReadDevice connects to the specified device
+func bleReadDevice(macIDArg string, deviceName string) {
+	if len(deviceName) == 0 {
+		fmt.Fprintln(bleOut, " Please specify a device to connect to")
+		return
 	}
 
-	fmt.Println("\nName: ", deviceName, "\t Identifier: ", macID)
+	if bleSetMacID(macIDArg) == false {
+		return
+	}
+
+	fmt.Fprintln(bleOut, "\nName: ", deviceName, "\t Identifier: ", macID)
 
 	d, err := gatt.NewDevice(option.DefaultClientOptions...)
 	if err != nil {
@@ -355,7 +553,217 @@ func bleReadDevice(macIDArg string, deviceName string) {
 	bleHandleConnectTimeout()
 
 	<-done
-	fmt.Println("Done")
+	fmt.Fprintln(bleOut, "Done")
+}
+
+// errConnectionLost is returned by connection handlers when the peripheral disconnected,
+// to have the connection re-established
+var errConnectionLost = errors.New("connection lost")
+
+// bleConnection represents an established connection, with a channel closed on disconnection
+type bleConnection struct {
+	p    gatt.Peripheral
+	lost chan struct{}
+}
+
+// bleClient is the device bleConnectDevice connects with. It is shared by consecutive
+// connections, as the HCI device can only be opened once.
+var bleClient struct {
+	d           gatt.Device
+	mu          sync.Mutex
+	scanning    bool
+	lost        chan struct{}
+	connections chan bleConnection
+	failures    chan error
+}
+
+// bleClientInit opens the device bleConnectDevice connects with, if not open yet
+func bleClientInit() error {
+	if bleClient.d != nil {
+		return nil
+	}
+
+	d, err := gatt.NewDevice(option.DefaultClientOptions...)
+	if err != nil {
+		return err
+	}
+	bleClient.connections = make(chan bleConnection, 1)
+	bleClient.failures = make(chan error, 1)
+
+	d.Handle(
+		gatt.PeripheralDiscovered(func(p gatt.Peripheral, a *gatt.Advertisement, rssi int) {
+			bleClient.mu.Lock()
+			if bleClient.scanning == false || bleMatchAdvertisement(a) == false {
+				bleClient.mu.Unlock()
+				return
+			}
+			bleClient.scanning = false
+			bleClient.mu.Unlock()
+
+			p.Device().StopScanning()
+			fmt.Fprintln(os.Stderr, "Connecting to", p.ID())
+			p.Device().Connect(p)
+		}),
+		gatt.PeripheralConnected(func(p gatt.Peripheral, err error) {
+			if err != nil {
+				bleClient.failures <- err
+				return
+			}
+			bleClient.mu.Lock()
+			bleClient.lost = make(chan struct{})
+			bleClient.connections <- bleConnection{p: p, lost: bleClient.lost}
+			bleClient.mu.Unlock()
+		}),
+		gatt.PeripheralDisconnected(func(p gatt.Peripheral, err error) {
+			bleClient.mu.Lock()
+			if bleClient.lost != nil {
+				close(bleClient.lost)
+				bleClient.lost = nil
+			}
+			bleClient.mu.Unlock()
+		}),
+	)
+
+	poweredOn := make(chan struct{})
+	var once sync.Once
+	d.Init(func(d gatt.Device, s gatt.State) {
+		if s == gatt.StatePoweredOn {
+			once.Do(func() { close(poweredOn) })
+		}
+	})
+
+	select {
+	case <-poweredOn:
+	case <-time.After(maxTimeoutTime):
+		return errors.New("timed out waiting for the BLE adapter to power on")
+	}
+	bleClient.d = d
+	return nil
+}
+
+// bleSetMTU requests an ATT MTU above the default of 23, returning the size of the values
+// written in a single packet: the MTU agreed with the peripheral, which may be lower than
+// the one requested, less the 3 bytes of the ATT header.
+func bleSetMTU(p gatt.Peripheral, mtu int) int {
+	if mtu > 23 {
+		if err := p.SetMTU(uint16(mtu)); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to set MTU, using", p.MTU(), "err:", err)
+		}
+	}
+	return p.MTU() - 3
+}
+
+// bleClientScan starts scanning for the device being looked for
+func bleClientScan() {
+	bleClient.mu.Lock()
+	bleClient.scanning = true
+	bleClient.mu.Unlock()
+	bleClient.d.Scan([]gatt.UUID{}, false)
+}
+
+// bleConnectFunc connects to the specified device and runs the handler once connected, as
+// bleConnectDevice does over the radio
+type bleConnectFunc func(macIDArg string, name string, handler func(p gatt.Peripheral, lost <-chan struct{}) error) error
+
+// errConnectCanceled is returned by bleConnectDeviceUntil when canceled before the handler runs
+var errConnectCanceled = errors.New("canceled")
+
+// bleConnectDevice connects to the specified device without dumping its services, and runs
+// the handler once connected, disconnecting when it returns. If the handler returns
+// errConnectionLost, the device is connected to again and the handler run once more.
+// Progress is reported on stderr, leaving stdout to the handler. It returns the error of
+// the handler, or of the connection.
+func bleConnectDevice(macIDArg string, name string, handler func(p gatt.Peripheral, lost <-chan struct{}) error) error {
+	return bleConnectDeviceUntil(macIDArg, name, nil, handler)
+}
+
+// bleConnectDeviceUntil connects to the device as bleConnectDevice does, giving up on
+// connecting or reconnecting with errConnectCanceled once cancel is closed. A handler
+// running when cancel is closed is left to return, which it should do promptly.
+func bleConnectDeviceUntil(macIDArg string, name string, cancel <-chan struct{},
+	handler func(p gatt.Peripheral, lost <-chan struct{}) error) error {
+	deviceName = name
+	if bleSetMacID(macIDArg) == false {
+		return fmt.Errorf("invalid id %q", macIDArg)
+	}
+	if err := bleClientInit(); err != nil {
+		return err
+	}
+	d := bleClient.d
+
+	stopScanning := func() {
+		bleClient.mu.Lock()
+		bleClient.scanning = false
+		bleClient.mu.Unlock()
+		d.StopScanning()
+	}
+
+	for {
+		bleClientScan()
+
+		var conn bleConnection
+		select {
+		case conn = <-bleClient.connections:
+		case err := <-bleClient.failures:
+			return err
+		case <-cancel:
+			stopScanning()
+			return errConnectCanceled
+		case <-time.After(maxTimeoutTime):
+			stopScanning()
+			return fmt.Errorf("timed out connecting to %s", name)
+		}
+
+		err := handler(conn.p, conn.lost)
+		if err != errConnectionLost {
+			d.CancelConnection(conn.p)
+			select {
+			case <-conn.lost:
+			case <-time.After(maxTimeoutTime):
+			}
+			return err
+		}
+
+		select {
+		case <-cancel:
+			return errConnectCanceled
+		default:
+		}
+		fmt.Fprintln(os.Stderr, "Connection lost, reconnecting")
+	}
+}
+
+// bleCancelOnInterrupt returns a channel closed on Ctrl-C, or once the duration elapses
+// when it is not 0, for bleConnectDeviceUntil. stop releases the signal once done.
+func bleCancelOnInterrupt(duration time.Duration) (cancel <-chan struct{}, stop func()) {
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+
+	canceled := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		var deadline <-chan time.Time
+		if duration > 0 {
+			timer := time.NewTimer(duration)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		select {
+		case <-interrupted:
+		case <-deadline:
+		case <-done:
+			return
+		}
+		close(canceled)
+	}()
+
+	var once sync.Once
+	return canceled, func() {
+		once.Do(func() {
+			signal.Stop(interrupted)
+			close(done)
+		})
+	}
 }
 
 // bleScanDevices Scans the radio neighborhood for BLE devices
@@ -398,7 +806,7 @@ func bleHandleConnectTimeout() {
 	case <-connected:
 
 	case <-time.After(maxTimeoutTime):
-		fmt.Println("Timed out connecting to device")
+		fmt.Fprintln(bleOut, "Timed out connecting to device")
 		close(done)
 	}
 }
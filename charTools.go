@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/currantlabs/gatt"
+)
+
+// Exit statuses of the single characteristic commands
+const (
+	exitOK            = 0
+	exitConnectFailed = 1
+	exitNotFound      = 3
+	exitReadFailed    = 4
+	exitFormatFailed  = 5
+	exitWriteFailed   = 6
+	exitVerifyFailed  = 7
+)
+
+// charReadFormats are the formats a characteristic value can be printed in
+var charReadFormats = []string{"hex", "utf8", "uint", "int", "float", "decoded", "json"}
+
+// charWriteEncodings are the encodings a value to write can be given in
+var charWriteEncodings = []string{"hex", "string", "uint8", "uint16", "uint32", "uint64",
+	"int8", "int16", "int32", "int64", "file", "format"}
+
+// CharValue represents a characteristic value printed in json format
+type CharValue struct {
+	Device         string `json:"device"`
+	Service        string `json:"service"`
+	Characteristic string `json:"characteristic"`
+	Hex            string `json:"hex"`
+	UTF8           string `json:"utf8,omitempty"`
+	Decoded        string `json:"decoded,omitempty"`
+	Length         int    `json:"length"`
+}
+
+// charParseUUID parses a UUID given on the command line
+func charParseUUID(uuid string) (gatt.UUID, error) {
+	return gatt.ParseUUID(xmlNormalizeUUID(uuid))
+}
+
+// charFind discovers the characteristic of the given service, or of any service when
+// no service is given
+func charFind(p gatt.Peripheral, svcID string, charID string) (*gatt.Service, *gatt.Characteristic, error) {
+	charUUID, err := charParseUUID(charID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid characteristic %q: %v", charID, err)
+	}
+
+	var filter []gatt.UUID
+	if len(svcID) != 0 {
+		svcUUID, err := charParseUUID(svcID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid service %q: %v", svcID, err)
+		}
+		filter = []gatt.UUID{svcUUID}
+	}
+
+	ss, err := p.DiscoverServices(filter)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to discover services: %v", err)
+	}
+
+	for _, s := range ss {
+		if len(filter) != 0 && !s.UUID().Equal(filter[0]) {
+			continue
+		}
+		cs, err := p.DiscoverCharacteristics([]gatt.UUID{charUUID}, s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to discover characteristics: %v", err)
+		}
+		for _, c := range cs {
+			if c.UUID().Equal(charUUID) {
+				return s, c, nil
+			}
+		}
+	}
+
+	if len(filter) != 0 {
+		return nil, nil, fmt.Errorf("characteristic %s not found in service %s", charID, svcID)
+	}
+	return nil, nil, fmt.Errorf("characteristic %s not found", charID)
+}
+
+// charFormatValue renders a characteristic value in the given format. Numbers are read
+// in little endian order, as in the Bluetooth specification.
+func charFormatValue(b []byte, format string) (string, error) {
+	switch format {
+	case "hex":
+		return fmt.Sprintf("%x", b), nil
+
+	case "utf8":
+		if !utf8.Valid(b) {
+			return "", fmt.Errorf("value %x is not a UTF-8 string", b)
+		}
+		return string(b), nil
+
+	case "uint", "int":
+		if len(b) == 0 || len(b) > 8 {
+			return "", fmt.Errorf("%d byte value is not an integer", len(b))
+		}
+		u := formatGetUint(b, false)
+		if format == "int" {
+			return strconv.FormatInt(formatSignExtend(u, len(b)), 10), nil
+		}
+		return strconv.FormatUint(u, 10), nil
+
+	case "float":
+		switch len(b) {
+		case 4:
+			return strconv.FormatFloat(float64(math.Float32frombits(uint32(formatGetUint(b, false)))), 'g', -1, 32), nil
+		case 8:
+			return strconv.FormatFloat(math.Float64frombits(formatGetUint(b, false)), 'g', -1, 64), nil
+		}
+		return "", fmt.Errorf("%d byte value is not a float", len(b))
+	}
+	return "", fmt.Errorf("unknown format %q", format)
+}
+
+// charReadChar connects to the specified device, reads a single characteristic and
+// prints its value in the given format. It returns the exit status of the command.
+func charReadChar(macIDArg string, name string, svcID string, charID string, format string) int {
+	status := exitConnectFailed
+
+	err := bleConnectDevice(macIDArg, name, func(p gatt.Peripheral, lost <-chan struct{}) error {
+		s, c, err := charFind(p, svcID, charID)
+		if err != nil {
+			status = exitNotFound
+			return err
+		}
+		if (c.Properties() & gatt.CharRead) == 0 {
+			status = exitReadFailed
+			return fmt.Errorf("characteristic %s is not readable", c.UUID())
+		}
+
+		b, err := bleReadValue(p, c)
+		if err != nil {
+			status = exitReadFailed
+			return fmt.Errorf("failed to read characteristic %s: %v", c.UUID(), err)
+		}
+
+		var output string
+		if format == "json" {
+			value := CharValue{
+				Device:         name,
+				Service:        s.UUID().String(),
+				Characteristic: c.UUID().String(),
+				Hex:            fmt.Sprintf("%x", b),
+				Length:         len(b),
+			}
+			if utf8.Valid(b) {
+				value.UTF8 = string(b)
+			}
+			if fields, err := formatDecodeChar(nil, value.Characteristic, b); err == nil {
+				value.Decoded = strings.Join(fields, ", ")
+			}
+			j, err := json.Marshal(value)
+			if err != nil {
+				status = exitFormatFailed
+				return err
+			}
+			output = string(j)
+		} else if format == "decoded" {
+			output = formatDescribeChar(nil, c.UUID().String(), b)
+		} else if output, err = charFormatValue(b, format); err != nil {
+			status = exitFormatFailed
+			return err
+		}
+
+		fmt.Println(output)
+		status = exitOK
+		return nil
+	})
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading characteristic \n\t", err)
+	}
+	return status
+}
+
+// charEncodeValue encodes a value given on the command line into the bytes to write.
+// Integers are written in little endian order unless bigEndian is set, files are
+// written as they are, and the format encoding uses the value format of the spec.
+func charEncodeValue(value string, encoding string, bigEndian bool, format *XMLFormat) ([]byte, error) {
+	switch encoding {
+	case "hex":
+		value = strings.TrimPrefix(strings.ToLower(value), "0x")
+		return hex.DecodeString(strings.NewReplacer(" ", "", ":", "").Replace(value))
+
+	case "string":
+		return []byte(value), nil
+
+	case "file":
+		return ioutil.ReadFile(value)
+
+	case "format":
+		if format == nil {
+			return nil, fmt.Errorf("no value format for the characteristic in the spec")
+		}
+		return formatEncode(format, value)
+
+	case "uint8", "uint16", "uint32", "uint64", "int8", "int16", "int32", "int64":
+		bits, _ := strconv.Atoi(strings.TrimPrefix(strings.TrimPrefix(encoding, "u"), "int"))
+		var u uint64
+		if strings.HasPrefix(encoding, "uint") {
+			n, err := strconv.ParseUint(value, 0, bits)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s value %q", encoding, value)
+			}
+			u = n
+		} else {
+			n, err := strconv.ParseInt(value, 0, bits)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s value %q", encoding, value)
+			}
+			u = uint64(n)
+		}
+		b := make([]byte, bits/8)
+		formatPutUint(b, u, bigEndian)
+		return b, nil
+	}
+	return nil, fmt.Errorf("unknown encoding %q", encoding)
+}
+
+// charWriteChar connects to the specified device and writes a single characteristic,
+// with or without response, optionally reading the value back to verify it. It returns
+// the exit status of the command.
+func charWriteChar(macIDArg string, name string, svcID string, charID string, value []byte, noRsp bool,
+	verify bool) int {
+	status := exitConnectFailed
+
+	err := bleConnectDevice(macIDArg, name, func(p gatt.Peripheral, lost <-chan struct{}) error {
+		_, c, err := charFind(p, svcID, charID)
+		if err != nil {
+			status = exitNotFound
+			return err
+		}
+
+		status = exitWriteFailed
+		if noRsp && (c.Properties()&gatt.CharWriteNR) == 0 {
+			return fmt.Errorf("characteristic %s does not support write without response", c.UUID())
+		}
+		if !noRsp && (c.Properties()&gatt.CharWrite) == 0 {
+			return fmt.Errorf("characteristic %s does not support write with response", c.UUID())
+		}
+
+		if err := p.WriteCharacteristic(c, value, noRsp); err != nil {
+			return fmt.Errorf("failed to write characteristic %s, ATT error: %v", c.UUID(), err)
+		}
+		fmt.Printf("Wrote %d bytes to %s: %x\n", len(value), c.UUID(), value)
+
+		if verify {
+			status = exitVerifyFailed
+			if (c.Properties() & gatt.CharRead) == 0 {
+				return fmt.Errorf("characteristic %s is not readable, can not verify", c.UUID())
+			}
+			b, err := bleReadValue(p, c)
+			if err != nil {
+				return fmt.Errorf("failed to read back characteristic %s: %v", c.UUID(), err)
+			}
+			if !bytes.Equal(b, value) {
+				return fmt.Errorf("read back %x after writing %x", b, value)
+			}
+			fmt.Println("Verified value of", c.UUID())
+		}
+
+		status = exitOK
+		return nil
+	})
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing characteristic \n\t", err)
+	}
+	return status
+}
@@ -12,11 +12,57 @@ import (
 func main() {
 	scanCommand := flag.NewFlagSet("scan", flag.ExitOnError)
 	scanTimeoutFlag := scanCommand.Duration("timeout", 12*time.Second, "scan `timeout` duration in seconds")
+	scanMeasureIntervalFlag := scanCommand.Bool("measure-interval", false, "measure the advertising interval of the target device")
+	scanTargetFlag := scanCommand.String("target", "", "BLE `Device Name` of the device to measure")
+	scanIDFlag := scanCommand.String("id", "", "Last 3 hex bytes of `mfg data` to uniquely identify the target device")
+	scanSpecFlag := scanCommand.String("spec", "", "spec `xml file` with the expected advertising interval")
 
 	connectCommand := flag.NewFlagSet("connect", flag.ExitOnError)
 	connectDeviceFlag := connectCommand.String("device", "", "BLE `Device Name`")
 	connectIDFlag := connectCommand.String("id", "", "Last 3 hex bytes of `mfg data` to uniquely identify device")
 	connectXMLOutFlag := connectCommand.Bool("xmlOut", false, "generate an xml output")
+	connectReadValuesFlag := connectCommand.Bool("read-values", false, "read and display the value of readable characteristics")
+	connectSpecFlag := connectCommand.String("spec", "", "spec `xml file` with the value formats used to decode values")
+
+	readCharCommand := flag.NewFlagSet("read-char", flag.ExitOnError)
+	readCharDeviceFlag := readCharCommand.String("device", "", "BLE `Device Name`")
+	readCharIDFlag := readCharCommand.String("id", "", "Last 3 hex bytes of `mfg data` to uniquely identify device")
+	readCharServiceFlag := readCharCommand.String("service", "", "`UUID` of the service of the characteristic (default: any service)")
+	readCharCharFlag := readCharCommand.String("char", "", "`UUID` of the characteristic to read")
+	readCharFormatFlag := readCharCommand.String("format", "hex", "output `format`: hex, utf8, uint, int, float, decoded or json")
+
+	writeCharCommand := flag.NewFlagSet("write-char", flag.ExitOnError)
+	writeCharDeviceFlag := writeCharCommand.String("device", "", "BLE `Device Name`")
+	writeCharIDFlag := writeCharCommand.String("id", "", "Last 3 hex bytes of `mfg data` to uniquely identify device")
+	writeCharServiceFlag := writeCharCommand.String("service", "", "`UUID` of the service of the characteristic (default: any service)")
+	writeCharCharFlag := writeCharCommand.String("char", "", "`UUID` of the characteristic to write")
+	writeCharValueFlag := writeCharCommand.String("value", "", "`value` to write")
+	writeCharEncodingFlag := writeCharCommand.String("encoding", "hex", "`encoding` of the value: hex, string, uint8-64, int8-64, file or format")
+	writeCharBigEndianFlag := writeCharCommand.Bool("big-endian", false, "write integers in big endian order")
+	writeCharSpecFlag := writeCharCommand.String("spec", "", "spec `xml file` with the value format of the characteristic")
+	writeCharNoRspFlag := writeCharCommand.Bool("no-response", false, "write without response")
+	writeCharVerifyFlag := writeCharCommand.Bool("verify", false, "read the value back after writing it")
+
+	subscribeCommand := flag.NewFlagSet("subscribe", flag.ExitOnError)
+	subscribeDeviceFlag := subscribeCommand.String("device", "", "BLE `Device Name`")
+	subscribeIDFlag := subscribeCommand.String("id", "", "Last 3 hex bytes of `mfg data` to uniquely identify device")
+	subscribeCharFlag := subscribeCommand.String("char", "", "comma separated `UUIDs` of the characteristics to subscribe to")
+	subscribeDurationFlag := subscribeCommand.Duration("duration", 0, "`duration` of the subscription (default: until interrupted)")
+	subscribeSpecFlag := subscribeCommand.String("spec", "", "spec `xml file` with the value formats used to decode values")
+	subscribeOutFlag := subscribeCommand.String("out", "", "`file` to write values to (default: stdout)")
+	subscribeFormatFlag := subscribeCommand.String("format", "text", "output `format`: text, json or csv")
+
+	shellCommand := flag.NewFlagSet("shell", flag.ExitOnError)
+	shellDeviceFlag := shellCommand.String("device", "", "BLE `Device Name`")
+	shellIDFlag := shellCommand.String("id", "", "Last 3 hex bytes of `mfg data` to uniquely identify device")
+	shellSpecFlag := shellCommand.String("spec", "", "spec `xml file` with the names and value formats of characteristics")
+
+	runTestCommand := flag.NewFlagSet("run-test", flag.ExitOnError)
+	runTestDeviceFlag := runTestCommand.String("device", "", "BLE `Device Name` (default: device of the script)")
+	runTestIDFlag := runTestCommand.String("id", "", "Last 3 hex bytes of `mfg data` to uniquely identify device")
+	runTestSpecFlag := runTestCommand.String("spec", "", "spec `xml file` resolving characteristic names (default: spec of the script)")
+	runTestReportFlag := runTestCommand.String("report", "", "`format` of a report of the steps: junit, tap or html")
+	runTestReportOutFlag := runTestCommand.String("report-out", "", "`file` to write the report to (default: stdout)")
 
 	readFileCommand := flag.NewFlagSet("read", flag.ExitOnError)
 	readXMLFileFlag := readFileCommand.String("file", "", "`xml file` to be parsed")
@@ -25,6 +71,76 @@ func main() {
 	compareDeviceFlag := compareFileCommand.String("device", "", "BLE `Device Name`")
 	compareIDFlag := compareFileCommand.String("id", "", "Last 3 hex bytes of `mfg data` to uniquely identify device")
 	compareFileFlag := compareFileCommand.String("file", "", "`XML file` to compare against")
+	compareReportFlag := compareFileCommand.String("report", "", "`format` of a report of the checks: junit, tap or html")
+	compareReportOutFlag := compareFileCommand.String("report-out", "", "`file` to write the report to (default: stdout)")
+
+	importCommand := flag.NewFlagSet("import", flag.ExitOnError)
+	importFormatFlag := importCommand.String("format", "sig", "`format` of the files to import: sig, nrf or bds")
+	importFileFlag := importCommand.String("file", "", "comma separated `files` to import")
+	importCharDirFlag := importCommand.String("chardir", "", "`directory` of SIG characteristic definitions (default: next to each file)")
+	importBaseFlag := importCommand.String("base", "", "`XML file` of custom services to merge the import into")
+	importDeviceFlag := importCommand.String("device", "", "BLE `Device Name` of the generated spec")
+	importOutFlag := importCommand.String("out", "", "`xml file` to write (default: XmlOutputs/<device>.xml)")
+
+	exportCommand := flag.NewFlagSet("export", flag.ExitOnError)
+	exportFileFlag := exportCommand.String("file", "", "spec or captured `xml file` to export")
+	exportFormatFlag := exportCommand.String("format", "markdown", "output `format`: json, yaml, markdown or html")
+	exportOutFlag := exportCommand.String("out", "", "`file` to write (default: stdout)")
+
+	codegenCommand := flag.NewFlagSet("codegen", flag.ExitOnError)
+	codegenFileFlag := codegenCommand.String("file", "", "spec `xml file` to generate code from")
+	codegenLangFlag := codegenCommand.String("lang", "c", "output `language`: c, go, swift, kotlin or peripheral")
+	codegenTemplateFlag := codegenCommand.String("template", "", "`template file` to use instead of the built-in one")
+	codegenPackageFlag := codegenCommand.String("package", "", "`package` or prefix of the generated code (default: device name)")
+	codegenOutFlag := codegenCommand.String("out", "", "`file` to write (default: stdout)")
+
+	emulateCommand := flag.NewFlagSet("emulate", flag.ExitOnError)
+	emulateFileFlag := emulateCommand.String("file", "", "spec `xml file` of the device to emulate")
+	emulateValuesFlag := emulateCommand.String("values", "", "`csv file` of initial hex values and characteristic UUIDs")
+	emulateNotifyFlag := emulateCommand.Duration("notify-interval", time.Second, "`interval` between notifications")
+	emulateDFUFlag := emulateCommand.Bool("dfu", false, "add a Nordic Secure DFU bootloader to the emulated device")
+	emulateOTAUFlag := emulateCommand.Bool("otau", false, "emulate the BCD Upgrade service, adding it when the spec has none")
+
+	dfuCommand := flag.NewFlagSet("dfu", flag.ExitOnError)
+	dfuDeviceFlag := dfuCommand.String("device", "", "BLE `Device Name`")
+	dfuIDFlag := dfuCommand.String("id", "", "Last 3 hex bytes of `mfg data` to uniquely identify device")
+	dfuProtocolFlag := dfuCommand.String("protocol", "csr", "upgrade `protocol`: csr or nordic")
+	dfuImageFlag := dfuCommand.String("image", "", "firmware `image file` to upload, or DFU zip package for nordic")
+	dfuVersionFlag := dfuCommand.String("version", "", "firmware `revision` of the image, the upgrade is skipped when the device runs it (csr)")
+	dfuForceFlag := dfuCommand.Bool("force", false, "upgrade even when the device runs the version of the image (csr)")
+	dfuResumeFlag := dfuCommand.Bool("resume", true, "reconnect and resume the transfer after a disconnect")
+	dfuMTUFlag := dfuCommand.Int("mtu", 23, "ATT `MTU` to request, the data is sent in chunks of MTU-3 bytes")
+	dfuPRNFlag := dfuCommand.Int("prn", 12, "`packets` between checksum notifications, 0 to disable (nordic)")
+	dfuAppFlag := dfuCommand.Int("app", 1, "`index` of the application the image is for (csr)")
+
+	benchThroughputCommand := flag.NewFlagSet("bench throughput", flag.ExitOnError)
+	benchThroughputDeviceFlag := benchThroughputCommand.String("device", "", "BLE `Device Name`")
+	benchThroughputIDFlag := benchThroughputCommand.String("id", "", "Last 3 hex bytes of `mfg data` to uniquely identify device")
+	benchThroughputServiceFlag := benchThroughputCommand.String("service", "", "`UUID` of the service of the characteristic (default: any service)")
+	benchThroughputCharFlag := benchThroughputCommand.String("char", "", "`UUID` of the characteristic to benchmark")
+	benchThroughputModeFlag := benchThroughputCommand.String("mode", "write-nr", "benchmark `mode`: write-nr, write or notify")
+	benchThroughputSizeFlag := benchThroughputCommand.Int("size", 0, "`bytes` per write (default: MTU-3)")
+	benchThroughputDurationFlag := benchThroughputCommand.Duration("duration", 10*time.Second, "`duration` of the benchmark")
+	benchThroughputMTUFlag := benchThroughputCommand.Int("mtu", 0, "ATT `MTU` to request before the benchmark (default: no request)")
+	benchThroughputSeqFlag := benchThroughputCommand.Bool("seq", false, "count dropped notifications from the 32-bit sequence number they start with")
+
+	benchLatencyCommand := flag.NewFlagSet("bench latency", flag.ExitOnError)
+	benchLatencyDeviceFlag := benchLatencyCommand.String("device", "", "BLE `Device Name`")
+	benchLatencyIDFlag := benchLatencyCommand.String("id", "", "Last 3 hex bytes of `mfg data` to uniquely identify device")
+	benchLatencyServiceFlag := benchLatencyCommand.String("service", "", "`UUID` of the service of the characteristic (default: any service)")
+	benchLatencyCharFlag := benchLatencyCommand.String("char", "", "`UUID` of the characteristic to benchmark")
+	benchLatencyModeFlag := benchLatencyCommand.String("mode", "read", "round trip `mode`: read or write")
+	benchLatencyNFlag := benchLatencyCommand.Int("n", 1000, "`number` of round trips")
+	benchLatencyValueFlag := benchLatencyCommand.String("value", "", "hex `value` to write (default: the value read)")
+
+	soakCommand := flag.NewFlagSet("soak", flag.ExitOnError)
+	soakDeviceFlag := soakCommand.String("device", "", "BLE `Device Name`")
+	soakIDFlag := soakCommand.String("id", "", "Last 3 hex bytes of `mfg data` to uniquely identify device")
+	soakCyclesFlag := soakCommand.Int("cycles", 100, "`number` of connect and disconnect cycles")
+	soakDiscoverFlag := soakCommand.Bool("discover", false, "discover services and characteristics in each cycle")
+	soakSpecFlag := soakCommand.String("spec", "", "spec `xml file` to compare the device against in each cycle")
+	soakIntervalFlag := soakCommand.Duration("interval", time.Second, "`interval` between cycles")
+	soakOutFlag := soakCommand.String("out", "", "csv `file` to log cycles to (default: stdout)")
 
 	flag.Usage = func() {
 		fmt.Printf("Usage: %s [COMMAND] [<options>]\n", os.Args[0])
@@ -32,10 +148,36 @@ func main() {
 		scanCommand.PrintDefaults()
 		fmt.Println("connect")
 		connectCommand.PrintDefaults()
+		fmt.Println("read-char")
+		readCharCommand.PrintDefaults()
+		fmt.Println("write-char")
+		writeCharCommand.PrintDefaults()
+		fmt.Println("subscribe")
+		subscribeCommand.PrintDefaults()
+		fmt.Println("shell")
+		shellCommand.PrintDefaults()
+		fmt.Println("run-test [<options>] SCRIPT")
+		runTestCommand.PrintDefaults()
 		fmt.Println("read")
 		readFileCommand.PrintDefaults()
 		fmt.Println("compare")
 		compareFileCommand.PrintDefaults()
+		fmt.Println("import")
+		importCommand.PrintDefaults()
+		fmt.Println("export")
+		exportCommand.PrintDefaults()
+		fmt.Println("codegen")
+		codegenCommand.PrintDefaults()
+		fmt.Println("emulate")
+		emulateCommand.PrintDefaults()
+		fmt.Println("dfu")
+		dfuCommand.PrintDefaults()
+		fmt.Println("bench throughput")
+		benchThroughputCommand.PrintDefaults()
+		fmt.Println("bench latency")
+		benchLatencyCommand.PrintDefaults()
+		fmt.Println("soak")
+		soakCommand.PrintDefaults()
 	}
 	flag.Parse()
 
@@ -51,11 +193,59 @@ func main() {
 	case "connect":
 		connectCommand.Parse(os.Args[2:])
 
+	case "read-char":
+		readCharCommand.Parse(os.Args[2:])
+
+	case "write-char":
+		writeCharCommand.Parse(os.Args[2:])
+
+	case "subscribe":
+		subscribeCommand.Parse(os.Args[2:])
+
+	case "shell":
+		shellCommand.Parse(os.Args[2:])
+
+	case "run-test":
+		runTestCommand.Parse(os.Args[2:])
+
 	case "read":
 		readFileCommand.Parse(os.Args[2:])
 
 	case "compare":
 		compareFileCommand.Parse(os.Args[2:])
+
+	case "import":
+		importCommand.Parse(os.Args[2:])
+
+	case "export":
+		exportCommand.Parse(os.Args[2:])
+
+	case "codegen":
+		codegenCommand.Parse(os.Args[2:])
+
+	case "emulate":
+		emulateCommand.Parse(os.Args[2:])
+
+	case "dfu":
+		dfuCommand.Parse(os.Args[2:])
+
+	case "bench":
+		if len(os.Args) < 3 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		switch os.Args[2] {
+		case "throughput":
+			benchThroughputCommand.Parse(os.Args[3:])
+		case "latency":
+			benchLatencyCommand.Parse(os.Args[3:])
+		default:
+			fmt.Println("Please enter one of the benchmarks: throughput or latency")
+			os.Exit(2)
+		}
+
+	case "soak":
+		soakCommand.Parse(os.Args[2:])
 	}
 
 	if scanCommand.Parsed() {
@@ -63,6 +253,15 @@ func main() {
 			fmt.Println("Please enter a scan value of atleast 1s")
 			return
 		}
+		if *scanMeasureIntervalFlag == true {
+			if *scanTargetFlag == "" {
+				fmt.Println("Please enter the name of the device to measure")
+				scanCommand.PrintDefaults()
+				return
+			}
+			advMeasureInterval(*scanIDFlag, *scanTargetFlag, *scanTimeoutFlag, *scanSpecFlag)
+			return
+		}
 		bleScanDevices(*scanTimeoutFlag)
 	}
 
@@ -72,7 +271,7 @@ func main() {
 			readFileCommand.PrintDefaults()
 			return
 		}
-		xmlGetServices(*readXMLFileFlag)
+		xmlGetServices(os.Stdout, *readXMLFileFlag)
 	}
 
 	if connectCommand.Parsed() {
@@ -83,13 +282,94 @@ func main() {
 		}
 		fmt.Println("Device :", *connectDeviceFlag, "\tID : ", *connectIDFlag)
 		deviceName = *connectDeviceFlag
-		if *connectXMLOutFlag == true {
+		if *connectReadValuesFlag == true {
+			bleReadDeviceValues(*connectIDFlag, deviceName, *connectSpecFlag, *connectXMLOutFlag)
+		} else if *connectXMLOutFlag == true {
 			bleReadDeviceXML(*connectIDFlag, deviceName)
 		} else {
 			bleReadDevice(*connectIDFlag, deviceName)
 		}
 	}
 
+	if readCharCommand.Parsed() {
+		if *readCharDeviceFlag == "" || *readCharCharFlag == "" {
+			fmt.Println("Please enter the device and the characteristic to read")
+			readCharCommand.PrintDefaults()
+			os.Exit(2)
+		}
+		if cmdIsOneOf(*readCharFormatFlag, charReadFormats) == false {
+			fmt.Println("Please enter one of the formats", charReadFormats)
+			os.Exit(2)
+		}
+		os.Exit(charReadChar(*readCharIDFlag, *readCharDeviceFlag, *readCharServiceFlag, *readCharCharFlag,
+			*readCharFormatFlag))
+	}
+
+	if writeCharCommand.Parsed() {
+		if *writeCharDeviceFlag == "" || *writeCharCharFlag == "" {
+			fmt.Println("Please enter the device and the characteristic to write")
+			writeCharCommand.PrintDefaults()
+			os.Exit(2)
+		}
+		if cmdIsOneOf(*writeCharEncodingFlag, charWriteEncodings) == false {
+			fmt.Println("Please enter one of the encodings", charWriteEncodings)
+			os.Exit(2)
+		}
+		var format *XMLFormat
+		if *writeCharSpecFlag != "" {
+			spec, err := xmlLoadDevice(*writeCharSpecFlag)
+			if err != nil {
+				fmt.Println("Error reading file \n\t", err)
+				os.Exit(2)
+			}
+			format = xmlFindCharFormat(spec, *writeCharCharFlag)
+		}
+		value, err := charEncodeValue(*writeCharValueFlag, *writeCharEncodingFlag, *writeCharBigEndianFlag, format)
+		if err != nil {
+			fmt.Println("Error encoding value \n\t", err)
+			os.Exit(2)
+		}
+		os.Exit(charWriteChar(*writeCharIDFlag, *writeCharDeviceFlag, *writeCharServiceFlag, *writeCharCharFlag,
+			value, *writeCharNoRspFlag, *writeCharVerifyFlag))
+	}
+
+	if subscribeCommand.Parsed() {
+		if *subscribeDeviceFlag == "" || *subscribeCharFlag == "" {
+			fmt.Println("Please enter the device and the characteristics to subscribe to")
+			subscribeCommand.PrintDefaults()
+			os.Exit(2)
+		}
+		if cmdIsOneOf(*subscribeFormatFlag, subOutputFormats) == false {
+			fmt.Println("Please enter one of the formats", subOutputFormats)
+			os.Exit(2)
+		}
+		os.Exit(subSubscribeDevice(*subscribeIDFlag, *subscribeDeviceFlag, *subscribeCharFlag, *subscribeDurationFlag,
+			*subscribeSpecFlag, *subscribeOutFlag, *subscribeFormatFlag))
+	}
+
+	if shellCommand.Parsed() {
+		if *shellDeviceFlag == "" {
+			fmt.Println("Please enter the name of a device to connect to")
+			shellCommand.PrintDefaults()
+			return
+		}
+		shellRunDevice(*shellIDFlag, *shellDeviceFlag, *shellSpecFlag)
+	}
+
+	if runTestCommand.Parsed() {
+		if runTestCommand.NArg() != 1 {
+			fmt.Println("Please enter the test script to run")
+			runTestCommand.PrintDefaults()
+			os.Exit(2)
+		}
+		if *runTestReportFlag != "" && cmdIsOneOf(*runTestReportFlag, reportFormats) == false {
+			fmt.Println("Please enter one of the report formats", reportFormats)
+			os.Exit(2)
+		}
+		os.Exit(scriptRunFile(reportOutput(*runTestReportFlag, *runTestReportOutFlag), runTestCommand.Arg(0),
+			*runTestIDFlag, *runTestDeviceFlag, *runTestSpecFlag, *runTestReportFlag, *runTestReportOutFlag))
+	}
+
 	if compareFileCommand.Parsed() {
 		if *compareDeviceFlag == "" {
 			fmt.Println("Please enter the name of a device to connect to")
@@ -101,8 +381,150 @@ func main() {
 			compareFileCommand.PrintDefaults()
 			return
 		}
+		if *compareReportFlag != "" && cmdIsOneOf(*compareReportFlag, reportFormats) == false {
+			fmt.Println("Please enter one of the report formats", reportFormats)
+			compareFileCommand.PrintDefaults()
+			return
+		}
 		deviceName = *compareDeviceFlag
-		bleCompareDevice(*compareIDFlag, deviceName, *compareFileFlag)
+		bleCompareDevice(reportOutput(*compareReportFlag, *compareReportOutFlag), *compareIDFlag, deviceName,
+			*compareFileFlag, *compareReportFlag, *compareReportOutFlag)
+	}
+
+	if importCommand.Parsed() {
+		if *importFileFlag == "" {
+			fmt.Println("Please enter the files to import")
+			importCommand.PrintDefaults()
+			return
+		}
+		importDevice(*importFormatFlag, *importFileFlag, *importCharDirFlag, *importBaseFlag,
+			*importDeviceFlag, *importOutFlag)
+	}
+
+	if exportCommand.Parsed() {
+		if *exportFileFlag == "" {
+			fmt.Println("Please enter the file to export")
+			exportCommand.PrintDefaults()
+			return
+		}
+		exportDevice(*exportFileFlag, *exportFormatFlag, *exportOutFlag)
+	}
+
+	if codegenCommand.Parsed() {
+		if *codegenFileFlag == "" {
+			fmt.Println("Please enter the spec file to generate code from")
+			codegenCommand.PrintDefaults()
+			return
+		}
+		codegenDevice(*codegenFileFlag, *codegenLangFlag, *codegenTemplateFlag, *codegenPackageFlag,
+			*codegenOutFlag)
+	}
+
+	if emulateCommand.Parsed() {
+		if *emulateFileFlag == "" {
+			fmt.Println("Please enter the spec file of the device to emulate")
+			emulateCommand.PrintDefaults()
+			return
+		}
+		if *emulateNotifyFlag <= 0 {
+			fmt.Println("Please enter a positive notification interval")
+			return
+		}
+		emuEmulateDevice(*emulateFileFlag, *emulateValuesFlag, *emulateNotifyFlag, *emulateDFUFlag,
+			*emulateOTAUFlag)
+	}
+
+	if dfuCommand.Parsed() {
+		if *dfuDeviceFlag == "" || *dfuImageFlag == "" {
+			fmt.Println("Please enter the device and the image to upload")
+			dfuCommand.PrintDefaults()
+			os.Exit(2)
+		}
+		if *dfuMTUFlag < 23 || *dfuMTUFlag > 517 {
+			fmt.Println("Please enter an MTU between 23 and 517")
+			os.Exit(2)
+		}
+		if cmdIsOneOf(*dfuProtocolFlag, dfuProtocols) == false {
+			fmt.Println("Please enter one of the protocols", dfuProtocols)
+			os.Exit(2)
+		}
+		if *dfuPRNFlag < 0 || *dfuPRNFlag > 0xffff {
+			fmt.Println("Please enter a packet receipt notification interval between 0 and 65535")
+			os.Exit(2)
+		}
+		if *dfuProtocolFlag == "nordic" {
+			os.Exit(sdfuUpgrade(*dfuIDFlag, *dfuDeviceFlag, *dfuImageFlag, *dfuResumeFlag, *dfuMTUFlag,
+				*dfuPRNFlag))
+		}
+		if *dfuAppFlag < 1 || *dfuAppFlag > 0xff {
+			fmt.Println("Please enter an application index between 1 and 255")
+			os.Exit(2)
+		}
+		os.Exit(otauUpgrade(*dfuIDFlag, *dfuDeviceFlag, *dfuImageFlag, *dfuVersionFlag, *dfuForceFlag,
+			*dfuResumeFlag, *dfuMTUFlag, *dfuAppFlag))
+	}
+
+	if benchThroughputCommand.Parsed() {
+		if *benchThroughputDeviceFlag == "" || *benchThroughputCharFlag == "" {
+			fmt.Println("Please enter the device and the characteristic to benchmark")
+			benchThroughputCommand.PrintDefaults()
+			os.Exit(2)
+		}
+		if cmdIsOneOf(*benchThroughputModeFlag, benchThroughputModes) == false {
+			fmt.Println("Please enter one of the modes", benchThroughputModes)
+			os.Exit(2)
+		}
+		if *benchThroughputSizeFlag < 0 || *benchThroughputDurationFlag <= 0 {
+			fmt.Println("Please enter a positive size and duration")
+			os.Exit(2)
+		}
+		if *benchThroughputMTUFlag != 0 && (*benchThroughputMTUFlag < 23 || *benchThroughputMTUFlag > 517) {
+			fmt.Println("Please enter an MTU between 23 and 517")
+			os.Exit(2)
+		}
+		os.Exit(benchThroughput(*benchThroughputIDFlag, *benchThroughputDeviceFlag, *benchThroughputServiceFlag,
+			*benchThroughputCharFlag, *benchThroughputModeFlag, *benchThroughputSizeFlag,
+			*benchThroughputDurationFlag, *benchThroughputMTUFlag, *benchThroughputSeqFlag))
+	}
+
+	if benchLatencyCommand.Parsed() {
+		if *benchLatencyDeviceFlag == "" || *benchLatencyCharFlag == "" {
+			fmt.Println("Please enter the device and the characteristic to benchmark")
+			benchLatencyCommand.PrintDefaults()
+			os.Exit(2)
+		}
+		if cmdIsOneOf(*benchLatencyModeFlag, benchLatencyModes) == false {
+			fmt.Println("Please enter one of the modes", benchLatencyModes)
+			os.Exit(2)
+		}
+		if *benchLatencyNFlag <= 0 {
+			fmt.Println("Please enter a positive number of round trips")
+			os.Exit(2)
+		}
+		var value []byte
+		if *benchLatencyValueFlag != "" {
+			var err error
+			if value, err = charEncodeValue(*benchLatencyValueFlag, "hex", false, nil); err != nil {
+				fmt.Println("Error encoding value \n\t", err)
+				os.Exit(2)
+			}
+		}
+		os.Exit(benchLatency(*benchLatencyIDFlag, *benchLatencyDeviceFlag, *benchLatencyServiceFlag,
+			*benchLatencyCharFlag, *benchLatencyModeFlag, *benchLatencyNFlag, value))
+	}
+
+	if soakCommand.Parsed() {
+		if *soakDeviceFlag == "" {
+			fmt.Println("Please enter the name of a device to connect to")
+			soakCommand.PrintDefaults()
+			os.Exit(2)
+		}
+		if *soakCyclesFlag <= 0 || *soakIntervalFlag < 0 {
+			fmt.Println("Please enter a positive number of cycles and interval")
+			os.Exit(2)
+		}
+		os.Exit(soakDevice(*soakIDFlag, *soakDeviceFlag, *soakCyclesFlag, *soakDiscoverFlag, *soakSpecFlag,
+			*soakIntervalFlag, *soakOutFlag))
 	}
 }
 
@@ -122,6 +544,16 @@ func cmdGetDeviceConnectID() uint32 {
 	return id
 }
 
+// cmdIsOneOf checks whether a flag value is one of the allowed values
+func cmdIsOneOf(value string, allowed []string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
+	}
+	return false
+}
+
 // cmdGetXmlStatus gets the user's input on whether xml should be generated
 func cmdGetXMLStatus() bool {
 	if prompter.YN("Generate XML after discovery?", false) {
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/currantlabs/gatt"
+)
+
+// CodegenData is the data the code generation templates are executed with. Services lists
+// the services of the device along with the names their identifiers are built from.
+type CodegenData struct {
+	Device   *XMLDevice
+	Services []CodegenService
+	Source   string
+	Package  string
+}
+
+// CodegenService represents a service with the name its identifiers are built from
+type CodegenService struct {
+	XMLService
+	Ident string
+	Chars []CodegenChar
+}
+
+// CodegenChar represents a characteristic with the name its identifiers are built from
+type CodegenChar struct {
+	XMLCharacteristic
+	Ident string
+}
+
+// codegenFuncs are the helpers available to the code generation templates
+var codegenFuncs = map[string]interface{}{
+	"upper":      codegenUpperIdent,
+	"camel":      codegenCamelIdent,
+	"lowerCamel": codegenLowerCamelIdent,
+	"uuid":       codegenFullUUID,
+	"upperUUID":  func(uuid string) string { return strings.ToUpper(codegenFullUUID(uuid)) },
+	"uuidBytes":  codegenUUIDBytes,
+	"mask":       func(p XMLCharProperties) string { return fmt.Sprintf("0x%02x", int(xmlGetBitMask(&p))) },
+	"props":      exportPropertyList,
+	"can":        codegenHasProperty,
+}
+
+// codegenPropertyNames maps the property names usable with "can" onto property flags
+var codegenPropertyNames = map[string]gatt.Property{
+	"broadcast":            gatt.CharBroadcast,
+	"read":                 gatt.CharRead,
+	"writeWithoutResponse": gatt.CharWriteNR,
+	"write":                gatt.CharWrite,
+	"notify":               gatt.CharNotify,
+	"indicate":             gatt.CharIndicate,
+}
+
+// codegenTemplates are the built-in output templates, by language
+var codegenTemplates = map[string]string{
+	"c": `/* Generated by ble-tools from {{.Source}}. Do not edit. */
+#ifndef {{upper .Package ""}}_GATT_H
+#define {{upper .Package ""}}_GATT_H
+
+#include <stdint.h>
+
+/* Characteristic property masks */
+#define {{upper .Package ""}}_PROP_BROADCAST       0x01
+#define {{upper .Package ""}}_PROP_READ            0x02
+#define {{upper .Package ""}}_PROP_WRITE_NR        0x04
+#define {{upper .Package ""}}_PROP_WRITE           0x08
+#define {{upper .Package ""}}_PROP_NOTIFY          0x10
+#define {{upper .Package ""}}_PROP_INDICATE        0x20
+#define {{upper .Package ""}}_PROP_SIGNED_WRITE    0x40
+#define {{upper .Package ""}}_PROP_EXTENDED        0x80
+{{$pkg := .Package}}
+{{- range .Services}}
+/* {{.ServiceName}} */
+#define {{upper $pkg ""}}_{{upper .Ident .ServiceID}}_UUID "{{uuid .ServiceID}}"
+#define {{upper $pkg ""}}_{{upper .Ident .ServiceID}}_UUID_BYTES { {{uuidBytes .ServiceID}} }
+{{- range .Chars}}
+#define {{upper $pkg ""}}_{{upper .Ident .CharID}}_UUID "{{uuid .CharID}}"
+#define {{upper $pkg ""}}_{{upper .Ident .CharID}}_UUID_BYTES { {{uuidBytes .CharID}} }
+#define {{upper $pkg ""}}_{{upper .Ident .CharID}}_PROPS {{mask .Properties}} /* {{props .Properties}} */
+{{- end}}
+{{end}}
+/* UUID to name table */
+static const struct {
+    const char *uuid;
+    const char *name;
+} {{.Package}}_gatt_names[] = {
+{{- range .Services}}
+    { "{{uuid .ServiceID}}", "{{.ServiceName}}" },
+{{- range .Chars}}
+    { "{{uuid .CharID}}", "{{.CharName}}" },
+{{- end}}
+{{- end}}
+};
+
+#endif /* {{upper .Package ""}}_GATT_H */
+`,
+
+	"go": `// Code generated by ble-tools from {{.Source}}. DO NOT EDIT.
+
+package {{.Package}}
+
+// Service and characteristic UUIDs
+const (
+{{- range .Services}}
+	{{camel .Ident .ServiceID}}UUID = "{{.ServiceID}}"
+{{- range .Chars}}
+	{{camel .Ident .CharID}}UUID = "{{.CharID}}"
+{{- end}}
+{{- end}}
+)
+
+// Characteristic property masks
+const (
+{{- range .Services}}
+{{- range .Chars}}
+	{{camel .Ident .CharID}}Properties = {{mask .Properties}} // {{props .Properties}}
+{{- end}}
+{{- end}}
+)
+
+// Names maps service and characteristic UUIDs to their names
+var Names = map[string]string{
+{{- range .Services}}
+	{{camel .Ident .ServiceID}}UUID: "{{.ServiceName}}",
+{{- range .Chars}}
+	{{camel .Ident .CharID}}UUID: "{{.CharName}}",
+{{- end}}
+{{- end}}
+}
+`,
+
+	"swift": `// Generated by ble-tools from {{.Source}}. Do not edit.
+
+import CoreBluetooth
+
+enum {{camel .Package ""}}GATT {
+{{- range .Services}}
+    // {{.ServiceName}}
+    static let {{lowerCamel .Ident .ServiceID}}UUID = CBUUID(string: "{{upperUUID .ServiceID}}")
+{{- range .Chars}}
+    static let {{lowerCamel .Ident .CharID}}UUID = CBUUID(string: "{{upperUUID .CharID}}")
+    static let {{lowerCamel .Ident .CharID}}Properties = CBCharacteristicProperties(rawValue: {{mask .Properties}}) // {{props .Properties}}
+{{- end}}
+{{end}}
+    static let names: [CBUUID: String] = [
+{{- range .Services}}
+        {{lowerCamel .Ident .ServiceID}}UUID: "{{.ServiceName}}",
+{{- range .Chars}}
+        {{lowerCamel .Ident .CharID}}UUID: "{{.CharName}}",
+{{- end}}
+{{- end}}
+    ]
+}
+`,
+
+	"peripheral": `// Code generated by ble-tools from {{.Source}}.
+// This is a starting point for a peripheral implementing the {{.Device.DeviceName}}
+// interface; fill in the handlers below.
+
+package main
+
+import (
+	"fmt"
+	"log"
+{{- if .Can "notify" "indicate"}}
+	"time"
+{{- end}}
+
+	"github.com/currantlabs/gatt"
+	"github.com/currantlabs/gatt/examples/option"
+)
+
+const deviceName = "{{.Device.DeviceName}}"
+{{range .Services}}
+// new{{camel .Ident .ServiceID}}Service builds {{.ServiceName}} with stub handlers
+func new{{camel .Ident .ServiceID}}Service() *gatt.Service {
+	s := gatt.NewService(gatt.MustParseUUID("{{.ServiceID}}"))
+{{range .Chars}}
+	// {{.CharName}}: {{props .Properties}}
+	{
+		{{if .Can "read" "write" "writeWithoutResponse" "notify" "indicate"}}c := {{end -}}
+		s.AddCharacteristic(gatt.MustParseUUID("{{.CharID}}"))
+{{- if can .Properties "read"}}
+		c.HandleReadFunc(func(rsp gatt.ResponseWriter, req *gatt.ReadRequest) {
+			log.Println("{{.CharName}}: read")
+			// TODO: write the value of {{.CharName}}
+			rsp.Write([]byte{})
+		})
+{{- end}}
+{{- if or (can .Properties "write") (can .Properties "writeWithoutResponse")}}
+		c.HandleWriteFunc(func(r gatt.Request, data []byte) (status byte) {
+			log.Printf("{{.CharName}}: write %x\n", data)
+			// TODO: handle the value written to {{.CharName}}
+			return gatt.StatusSuccess
+		})
+{{- end}}
+{{- if or (can .Properties "notify") (can .Properties "indicate")}}
+		c.HandleNotifyFunc(func(r gatt.Request, n gatt.Notifier) {
+			log.Println("{{.CharName}}: subscribed")
+			for !n.Done() {
+				// TODO: send the value of {{.CharName}} when it changes
+				time.Sleep(time.Second)
+			}
+			log.Println("{{.CharName}}: unsubscribed")
+		})
+{{- end}}
+	}
+{{end}}
+	return s
+}
+{{end}}
+// onStateChanged adds the services and starts advertising once powered on
+func onStateChanged(d gatt.Device, s gatt.State) {
+	fmt.Println("State:", s)
+	switch s {
+	case gatt.StatePoweredOn:
+		var uuids []gatt.UUID
+		for _, svc := range []*gatt.Service{
+{{- range .Services}}
+			new{{camel .Ident .ServiceID}}Service(),
+{{- end}}
+		} {
+			if err := d.AddService(svc); err != nil {
+				log.Println("Failed to add service", svc.UUID(), "err:", err)
+				continue
+			}
+			uuids = append(uuids, svc.UUID())
+		}
+		d.AdvertiseNameAndServices(deviceName, uuids)
+	default:
+	}
+}
+
+func main() {
+	d, err := gatt.NewDevice(option.DefaultServerOptions...)
+	if err != nil {
+		log.Fatalf("Failed to open device, err: %s\n", err)
+	}
+
+	d.Handle(
+		gatt.CentralConnected(func(c gatt.Central) { fmt.Println("Connected:", c.ID()) }),
+		gatt.CentralDisconnected(func(c gatt.Central) { fmt.Println("Disconnected:", c.ID()) }),
+	)
+
+	d.Init(onStateChanged)
+	select {}
+}
+`,
+
+	"kotlin": `// Generated by ble-tools from {{.Source}}. Do not edit.
+
+package {{.Package}}
+
+import java.util.UUID
+
+object {{camel .Package ""}}Gatt {
+{{- range .Services}}
+    // {{.ServiceName}}
+    val {{upper .Ident .ServiceID}}_UUID: UUID = UUID.fromString("{{uuid .ServiceID}}")
+{{- range .Chars}}
+    val {{upper .Ident .CharID}}_UUID: UUID = UUID.fromString("{{uuid .CharID}}")
+    const val {{upper .Ident .CharID}}_PROPERTIES = {{mask .Properties}} // {{props .Properties}}
+{{- end}}
+{{end}}
+    val NAMES: Map<UUID, String> = mapOf(
+{{- range .Services}}
+        {{upper .Ident .ServiceID}}_UUID to "{{.ServiceName}}",
+{{- range .Chars}}
+        {{upper .Ident .CharID}}_UUID to "{{.CharName}}",
+{{- end}}
+{{- end}}
+    )
+}
+`,
+}
+
+// codegenHasProperty reports whether a characteristic has the named property
+func codegenHasProperty(p XMLCharProperties, name string) bool {
+	return (xmlGetBitMask(&p) & codegenPropertyNames[name]) != 0
+}
+
+// Can reports whether the characteristic has any of the properties named as for "can"
+func (c CodegenChar) Can(names ...string) bool {
+	for _, name := range names {
+		if codegenHasProperty(c.Properties, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Can reports whether any characteristic of the device has one of the properties named
+// as for "can"
+func (d CodegenData) Can(names ...string) bool {
+	for _, svc := range d.Services {
+		for _, char := range svc.Chars {
+			if char.Can(names...) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// codegenWords splits a name into the words of an identifier, falling back to the
+// uuid when the name is empty
+func codegenWords(name string, uuid string) []string {
+	if len(strings.TrimSpace(name)) == 0 {
+		name = "uuid " + uuid
+	}
+	words := strings.FieldsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) != 0 && unicode.IsDigit(rune(words[0][0])) {
+		words = append([]string{"x"}, words...)
+	}
+	return words
+}
+
+// codegenIdents names the identifiers of the services and characteristics of a device
+// uniquely. Characteristics whose name is found in another service, or is the name of a
+// service, are qualified with the name of their service, and names still repeated are given
+// a number, so the generated code declares every identifier once.
+func codegenIdents(dev *XMLDevice) []CodegenService {
+	name := func(name string, uuid string) string {
+		if len(strings.TrimSpace(name)) == 0 {
+			return "uuid " + uuid
+		}
+		return name
+	}
+	// Identifiers collide when either their CamelCase or UPPER_SNAKE_CASE forms do
+	keys := func(ident string) []string {
+		return []string{codegenCamelIdent(ident, ""), codegenUpperIdent(ident, "")}
+	}
+	count := make(map[string]int)
+	for _, svc := range dev.ServiceList {
+		for _, key := range keys(name(svc.ServiceName, svc.ServiceID)) {
+			count[key] += 2
+		}
+		// A name repeated within a service is numbered, qualifying it would not help
+		seen := make(map[string]bool)
+		for _, char := range svc.CharList {
+			for _, key := range keys(name(char.CharName, char.CharID)) {
+				if !seen[key] {
+					seen[key] = true
+					count[key]++
+				}
+			}
+		}
+	}
+
+	used := make(map[string]bool)
+	unique := func(ident string) string {
+		base := ident
+		for n := 2; ; n++ {
+			free := true
+			for _, key := range keys(ident) {
+				free = free && !used[key]
+			}
+			if free {
+				break
+			}
+			ident = fmt.Sprintf("%s %d", base, n)
+		}
+		for _, key := range keys(ident) {
+			used[key] = true
+		}
+		return ident
+	}
+
+	var services []CodegenService
+	for _, svc := range dev.ServiceList {
+		services = append(services, CodegenService{XMLService: svc,
+			Ident: unique(name(svc.ServiceName, svc.ServiceID))})
+	}
+	for idx := range services {
+		svc := &services[idx]
+		for _, char := range svc.CharList {
+			ident := name(char.CharName, char.CharID)
+			for _, key := range keys(ident) {
+				if count[key] > 1 {
+					ident = svc.Ident + " " + ident
+					break
+				}
+			}
+			svc.Chars = append(svc.Chars, CodegenChar{XMLCharacteristic: char, Ident: unique(ident)})
+		}
+	}
+	return services
+}
+
+// codegenUpperIdent builds an UPPER_SNAKE_CASE identifier
+func codegenUpperIdent(name string, uuid string) string {
+	return strings.ToUpper(strings.Join(codegenWords(name, uuid), "_"))
+}
+
+// codegenCamelIdent builds a CamelCase identifier
+func codegenCamelIdent(name string, uuid string) string {
+	var ident string
+	for _, word := range codegenWords(name, uuid) {
+		ident += strings.ToUpper(word[:1]) + word[1:]
+	}
+	return ident
+}
+
+// codegenLowerCamelIdent builds a lowerCamelCase identifier
+func codegenLowerCamelIdent(name string, uuid string) string {
+	ident := codegenCamelIdent(name, uuid)
+	return strings.ToLower(ident[:1]) + ident[1:]
+}
+
+// codegenFullUUID expands a UUID into its dashed 128-bit form
+func codegenFullUUID(uuid string) string {
+	uuid = xmlNormalizeUUID(uuid)
+	if len(uuid) == 4 {
+		uuid = "0000" + uuid + sigBaseUUID
+	}
+	if len(uuid) != 32 {
+		return uuid
+	}
+	return uuid[0:8] + "-" + uuid[8:12] + "-" + uuid[12:16] + "-" + uuid[16:20] + "-" + uuid[20:32]
+}
+
+// codegenUUIDBytes lists the bytes of a 128-bit UUID in little endian order, as
+// used by most embedded BLE stacks
+func codegenUUIDBytes(uuid string) string {
+	hexUUID := strings.Replace(codegenFullUUID(uuid), "-", "", -1)
+
+	var b []string
+	for idx := len(hexUUID) - 2; idx >= 0; idx -= 2 {
+		b = append(b, "0x"+hexUUID[idx:idx+2])
+	}
+	return strings.Join(b, ", ")
+}
+
+// codegenGenerate executes the template text for the device, formatting the output of the
+// go and peripheral languages
+func codegenGenerate(dev *XMLDevice, source string, lang string, text string, pkg string) ([]byte, error) {
+	t, err := template.New(lang).Funcs(codegenFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template: %v", err)
+	}
+	if len(pkg) == 0 {
+		pkg = strings.ToLower(strings.Join(codegenWords(dev.DeviceName, "device"), ""))
+	}
+
+	var buf bytes.Buffer
+	data := CodegenData{Device: dev, Services: codegenIdents(dev), Source: source, Package: pkg}
+	if err := t.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("failed to generate code: %v", err)
+	}
+	output := buf.Bytes()
+	if lang == "go" || lang == "peripheral" {
+		if output, err = format.Source(output); err != nil {
+			return nil, fmt.Errorf("failed to format generated code: %v", err)
+		}
+	}
+	return output, nil
+}
+
+// codegenDevice generates source constants for the spec in the specified language,
+// using templateFile instead of the built-in template when given
+func codegenDevice(fileName string, lang string, templateFile string, pkg string, outFile string) {
+	text, ok := codegenTemplates[lang]
+	if len(templateFile) != 0 {
+		b, err := ioutil.ReadFile(templateFile)
+		if err != nil {
+			fmt.Println("Error reading template \n\t", err)
+			return
+		}
+		text, ok = string(b), true
+	}
+	if !ok {
+		fmt.Println("Unknown language", lang)
+		return
+	}
+
+	dev, err := xmlLoadDevice(fileName)
+	if err != nil {
+		fmt.Println("Error reading file \n\t", err)
+		return
+	}
+
+	output, err := codegenGenerate(dev, filepath.Base(fileName), lang, text, pkg)
+	if err != nil {
+		fmt.Println("Error generating code \n\t", err)
+		return
+	}
+
+	if len(outFile) == 0 {
+		os.Stdout.Write(output)
+		return
+	}
+	if err := ioutil.WriteFile(outFile, output, 0666); err != nil {
+		fmt.Println("Error writing file \n\t", err)
+		return
+	}
+	fmt.Println("Code created in file", outFile)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strings"
+	"testing"
+)
+
+// codegenTestDevice returns a spec whose services each hold the characteristics listed
+// for them, as name:properties with the properties mandatory
+func codegenTestDevice(services map[string][]string) *XMLDevice {
+	dev := &XMLDevice{DeviceName: "Test Device"}
+	id := 0
+	for _, svcName := range []string{"Light", "Sensor", "Control Point"} {
+		chars, ok := services[svcName]
+		if !ok {
+			continue
+		}
+		id++
+		svc := XMLService{ServiceName: svcName, ServiceID: strings.Repeat(string(rune('0'+id)), 32)}
+		for _, char := range chars {
+			id++
+			name, props := char, ""
+			if i := strings.Index(char, ":"); i >= 0 {
+				name, props = char[:i], char[i+1:]
+			}
+			c := XMLCharacteristic{CharName: name, CharID: strings.Repeat(string(rune('a'+id%6)), 30) +
+				string(rune('0'+id/10)) + string(rune('0'+id%10))}
+			for _, prop := range strings.Split(props, ",") {
+				switch prop {
+				case "read":
+					c.Properties.Read = "Mandatory"
+				case "write":
+					c.Properties.Write = "Mandatory"
+				case "notify":
+					c.Properties.Notify = "Mandatory"
+				}
+			}
+			svc.CharList = append(svc.CharList, c)
+		}
+		dev.ServiceList = append(dev.ServiceList, svc)
+	}
+	return dev
+}
+
+// codegenTestCheck type checks generated Go code, importing packages from source
+func codegenTestCheck(t *testing.T, src []byte) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "generated.go", src, 0)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, src)
+	}
+	conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	if _, err := conf.Check(f.Name.Name, fset, []*ast.File{f}, nil); err != nil {
+		t.Fatalf("%v\n%s", err, src)
+	}
+}
+
+func TestCodegenIdents(t *testing.T) {
+	dev := codegenTestDevice(map[string][]string{
+		"Light":         {"Control Point:write", "Level:read", "Level:read"},
+		"Sensor":        {"Control Point:write", "Sensor:read"},
+		"Control Point": {"uuid:read"},
+	})
+	services := codegenIdents(dev)
+
+	expected := [][]string{
+		{"Light", "Light Control Point", "Level", "Level 2"},
+		{"Sensor", "Sensor Control Point", "Sensor Sensor"},
+		{"Control Point", "uuid"},
+	}
+	for idx, svc := range services {
+		idents := []string{svc.Ident}
+		for _, char := range svc.Chars {
+			idents = append(idents, char.Ident)
+		}
+		if strings.Join(idents, "|") != strings.Join(expected[idx], "|") {
+			t.Errorf("service %d named %q, expected %q", idx, idents, expected[idx])
+		}
+	}
+
+	src, err := codegenGenerate(dev, "test.xml", "go", codegenTemplates["go"], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	codegenTestCheck(t, src)
+}
+
+func TestCodegenPeripheral(t *testing.T) {
+	for _, services := range []map[string][]string{
+		{"Light": {"Level:read", "Mode:write"}, "Sensor": {"Broadcast"}},
+		{"Light": {"Level:read,notify", "Mode:write"}},
+		{},
+	} {
+		dev := codegenTestDevice(services)
+		src, err := codegenGenerate(dev, "test.xml", "peripheral", codegenTemplates["peripheral"], "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		codegenTestCheck(t, src)
+	}
+}
@@ -3,21 +3,22 @@ package main
 import (
 	"encoding/csv"
 	"fmt"
+	"io"
 	"os"
 )
 
-// csvReadFile reads the specified csv file
-func csvReadFile(fileName string) (map[string]string, error) {
+// csvReadFile reads the specified csv file, writing why it could not to w
+func csvReadFile(w io.Writer, fileName string) (map[string]string, error) {
 	file, err := os.Open(fileName)
 	if err != nil {
-		fmt.Println("Error opening file \n\t", err)
+		fmt.Fprintln(w, "Error opening file \n\t", err)
 		return nil, err
 	}
 	defer file.Close()
 
 	lines, err := csv.NewReader(file).ReadAll()
 	if err != nil {
-		fmt.Println("Error reading file \n\t", err)
+		fmt.Fprintln(w, "Error reading file \n\t", err)
 		return nil, err
 	}
 
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// decoderFile is the declarative decoder file loaded from the working directory, like the
+// custom service and characteristic names
+const decoderFile = "CustomDecoders.xml"
+
+// Decoder decodes the value of a characteristic into "name=value" fields, for read, shell,
+// subscribe and log output. Product specific decoders implement it and register with
+// RegisterDecoder from an init function.
+type Decoder interface {
+	Decode(b []byte) ([]string, error)
+}
+
+// DecoderFunc adapts a function to the Decoder interface
+type DecoderFunc func(b []byte) ([]string, error)
+
+// Decode calls f(b)
+func (f DecoderFunc) Decode(b []byte) ([]string, error) {
+	return f(b)
+}
+
+// FormatDecoder decodes values with a value format, for decoders declared in a file
+type FormatDecoder struct {
+	Format *XMLFormat
+}
+
+// Decode decodes a value with the value format
+func (d FormatDecoder) Decode(b []byte) ([]string, error) {
+	return formatDecode(d.Format, b)
+}
+
+// XMLDecoder represents the value format of a characteristic in the decoder file
+type XMLDecoder struct {
+	CharName string    `xml:"name,attr"`
+	CharID   string    `xml:"uuid,attr"`
+	Format   XMLFormat `xml:"format"`
+}
+
+// XMLDecoders represents the decoder file
+type XMLDecoders struct {
+	XMLName  xml.Name     `xml:"decoders"`
+	Decoders []XMLDecoder `xml:"characteristic"`
+}
+
+var decoders = make(map[string]Decoder)
+var decodersMu sync.Mutex
+var decoderFileOnce sync.Once
+
+// RegisterDecoder registers the decoder of a characteristic by UUID, replacing any decoder
+// registered before for it
+func RegisterDecoder(charID string, d Decoder) {
+	decodersMu.Lock()
+	defer decodersMu.Unlock()
+	decoders[xmlNormalizeUUID(charID)] = d
+}
+
+// decoderLoadFile registers a decoder for every characteristic of a decoder file
+func decoderLoadFile(fileName string) error {
+	var file XMLDecoders
+
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	if err := xml.Unmarshal(b, &file); err != nil {
+		return err
+	}
+
+	for idx := range file.Decoders {
+		d := &file.Decoders[idx]
+		if len(d.Format.Fields) == 0 {
+			return fmt.Errorf("no fields in the format of %s", d.CharID)
+		}
+		RegisterDecoder(d.CharID, FormatDecoder{Format: &d.Format})
+	}
+	return nil
+}
+
+// decoderFind returns the decoder registered for a characteristic, or the SIG decoder of a
+// standard characteristic, or nil. The decoder file is loaded on first use, so its decoders
+// replace those registered from Go.
+func decoderFind(charID string) Decoder {
+	decoderFileOnce.Do(func() {
+		if _, err := os.Stat(decoderFile); err != nil {
+			return
+		}
+		if err := decoderLoadFile(decoderFile); err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading", decoderFile, "\n\t", err)
+		}
+	})
+
+	charID = xmlNormalizeUUID(charID)
+	decodersMu.Lock()
+	defer decodersMu.Unlock()
+	if d, ok := decoders[charID]; ok {
+		return d
+	}
+	if d, ok := sigDecoders[charID]; ok {
+		return d
+	}
+	return nil
+}
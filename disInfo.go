@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+
+	"github.com/currantlabs/gatt"
+)
+
+// disServiceID is the UUID of the Device Information Service
+const disServiceID = "180a"
+
+// XMLIdentity represents the identity of a device read from its Device Information Service.
+// In a spec, every value that is set is a regular expression the device value must match.
+type XMLIdentity struct {
+	Manufacturer string `xml:"manufacturer,attr,omitempty" json:"manufacturer,omitempty" yaml:"manufacturer,omitempty"`
+	Model        string `xml:"model,attr,omitempty" json:"model,omitempty" yaml:"model,omitempty"`
+	Serial       string `xml:"serial,attr,omitempty" json:"serial,omitempty" yaml:"serial,omitempty"`
+	Hardware     string `xml:"hardware,attr,omitempty" json:"hardware,omitempty" yaml:"hardware,omitempty"`
+	Firmware     string `xml:"firmware,attr,omitempty" json:"firmware,omitempty" yaml:"firmware,omitempty"`
+	Software     string `xml:"software,attr,omitempty" json:"software,omitempty" yaml:"software,omitempty"`
+	SystemID     string `xml:"systemID,attr,omitempty" json:"systemID,omitempty" yaml:"systemID,omitempty"`
+}
+
+// disChars are the Device Information Service characteristics making up the identity
+var disChars = []struct {
+	charID string
+	name   string
+	value  func(id *XMLIdentity) *string
+}{
+	{"2a29", "Manufacturer Name", func(id *XMLIdentity) *string { return &id.Manufacturer }},
+	{"2a24", "Model Number", func(id *XMLIdentity) *string { return &id.Model }},
+	{"2a25", "Serial Number", func(id *XMLIdentity) *string { return &id.Serial }},
+	{"2a27", "Hardware Revision", func(id *XMLIdentity) *string { return &id.Hardware }},
+	{"2a26", "Firmware Revision", func(id *XMLIdentity) *string { return &id.Firmware }},
+	{"2a28", "Software Revision", func(id *XMLIdentity) *string { return &id.Software }},
+	{"2a23", "System ID", func(id *XMLIdentity) *string { return &id.SystemID }},
+}
+
+// disRead reads the identity of the device from the Device Information Service among the
+// discovered services. It returns nil when the device has no Device Information Service.
+// The System ID is kept as hex, the other values are strings. The characteristics of the
+// service are only discovered when they have not been, as discovering them again adds them
+// to the service once more.
+func disRead(p gatt.Peripheral, ss []*gatt.Service) (*XMLIdentity, error) {
+	for _, s := range ss {
+		if xmlNormalizeUUID(s.UUID().String()) != disServiceID {
+			continue
+		}
+
+		cs := s.Characteristics()
+		if len(cs) == 0 {
+			var err error
+			if cs, err = p.DiscoverCharacteristics(nil, s); err != nil {
+				return nil, fmt.Errorf("failed to discover characteristics: %v", err)
+			}
+		}
+
+		id := &XMLIdentity{}
+		for _, c := range cs {
+			if (c.Properties() & gatt.CharRead) == 0 {
+				continue
+			}
+			charID := xmlNormalizeUUID(c.UUID().String())
+			for _, dc := range disChars {
+				if dc.charID != charID {
+					continue
+				}
+				b, err := bleReadValue(p, c)
+				if err != nil {
+					return id, fmt.Errorf("failed to read %s: %v", dc.name, err)
+				}
+				if charID == "2a23" {
+					*dc.value(id) = fmt.Sprintf("%x", b)
+				} else {
+					*dc.value(id) = string(b)
+				}
+			}
+		}
+		return id, nil
+	}
+	return nil, nil
+}
+
+// disPattern returns the identity to store in a captured spec, so comparing against the
+// capture requires the same values: every value is quoted and anchored as a regular
+// expression. The serial number and System ID are left out, as they differ between units
+// of the same product.
+func disPattern(id *XMLIdentity) *XMLIdentity {
+	pattern := &XMLIdentity{}
+	for _, dc := range disChars {
+		if dc.charID == "2a25" || dc.charID == "2a23" {
+			continue
+		}
+		if value := *dc.value(id); len(value) != 0 {
+			*dc.value(pattern) = "^" + regexp.QuoteMeta(value) + "$"
+		}
+	}
+	return pattern
+}
+
+// disShow displays the identity of a device
+func disShow(w io.Writer, id *XMLIdentity) {
+	fmt.Fprintln(w, "Device Information:")
+	for _, dc := range disChars {
+		if value := *dc.value(id); len(value) != 0 {
+			fmt.Fprintf(w, "  %-17s = %s\n", dc.name, value)
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+// disCheck checks the identity of a device against the expected one, returning every mismatch
+func disCheck(expected *XMLIdentity, found *XMLIdentity) []error {
+	var errs []error
+
+	if found == nil {
+		return []error{fmt.Errorf("expected a Device Information Service but found none")}
+	}
+	for _, dc := range disChars {
+		pattern, value := *dc.value(expected), *dc.value(found)
+		if len(pattern) == 0 {
+			continue
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s pattern %q", dc.name, pattern))
+		} else if !re.MatchString(value) {
+			errs = append(errs, fmt.Errorf("expected %s matching %q but found %q", dc.name, pattern, value))
+		}
+	}
+	return errs
+}
+
+// disDescribe summarizes the values of an identity for reports
+func disDescribe(id *XMLIdentity) string {
+	if id == nil {
+		return "absent"
+	}
+	var s string
+	for _, dc := range disChars {
+		if value := *dc.value(id); len(value) != 0 {
+			if len(s) != 0 {
+				s += ", "
+			}
+			s += dc.name + " " + value
+		}
+	}
+	return s
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/currantlabs/gatt"
+)
+
+func TestDisPattern(t *testing.T) {
+	id := &XMLIdentity{Manufacturer: "BCD (EU)", Model: "LY01", Serial: "000142", Firmware: "2.1.0",
+		SystemID: "0102030000040506"}
+	pattern := disPattern(id)
+
+	if pattern.Serial != "" || pattern.SystemID != "" {
+		t.Errorf("captured serial %q and System ID %q", pattern.Serial, pattern.SystemID)
+	}
+	if errs := disCheck(pattern, id); len(errs) != 0 {
+		t.Errorf("device does not match its capture: %v", errs)
+	}
+
+	// Another unit of the same product matches, other revisions don't
+	other := *id
+	other.Serial, other.SystemID = "000143", "0102030000040507"
+	if errs := disCheck(pattern, &other); len(errs) != 0 {
+		t.Errorf("another unit does not match the capture: %v", errs)
+	}
+	for _, firmware := range []string{"2x1y0", "2.1.0.1", "12.1.0"} {
+		other.Firmware = firmware
+		if errs := disCheck(pattern, &other); len(errs) != 1 {
+			t.Errorf("firmware %q matches the capture of %q", firmware, id.Firmware)
+		}
+	}
+}
+
+// disTestPeripheral counts the characteristic discoveries and reads of a peripheral
+type disTestPeripheral struct {
+	gatt.Peripheral
+	discoveries int
+	reads       int
+}
+
+func (p *disTestPeripheral) DiscoverCharacteristics(cs []gatt.UUID, s *gatt.Service) ([]*gatt.Characteristic, error) {
+	p.discoveries++
+	return p.Peripheral.DiscoverCharacteristics(cs, s)
+}
+
+func (p *disTestPeripheral) ReadLongCharacteristic(c *gatt.Characteristic) ([]byte, error) {
+	p.reads++
+	return p.Peripheral.ReadLongCharacteristic(c)
+}
+
+func TestDisReadDiscovered(t *testing.T) {
+	dev := &XMLDevice{DeviceName: "LY01", ServiceList: []XMLService{{ServiceName: "Device Information",
+		ServiceID: disServiceID, CharList: []XMLCharacteristic{
+			{CharName: "Model Number", CharID: "2a24", Properties: XMLCharProperties{Read: mandatory}},
+			{CharName: "Firmware Revision", CharID: "2a26", Properties: XMLCharProperties{Read: mandatory}},
+		}}}}
+	emu, err := emuNewEmulator(dev, map[string]string{"2a24": "4c593031", "2a26": "322e312e30"}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := emuNewLocalTransport(23)
+	if err := transport.Serve(emu); err != nil {
+		t.Fatal(err)
+	}
+	lp, _ := transport.Connect()
+	ss, err := lp.DiscoverServices(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lp.DiscoverCharacteristics(nil, ss[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// The characteristics discovered by the comparison are read once, without discovering them again
+	p := &disTestPeripheral{Peripheral: lp}
+	id, err := disRead(p, ss)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Model != "LY01" || id.Firmware != "2.1.0" {
+		t.Errorf("read model %q and firmware %q", id.Model, id.Firmware)
+	}
+	if p.discoveries != 0 || p.reads != 2 {
+		t.Errorf("discovered the characteristics %d times and made %d reads, expected 0 and 2", p.discoveries,
+			p.reads)
+	}
+}
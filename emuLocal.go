@@ -0,0 +1,326 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/currantlabs/gatt"
+)
+
+// emuLocalCentral is the central ID the emulator logs requests of the local transport with
+const emuLocalCentral = "local"
+
+// emuLocalTransport serves the emulator in-process, invoking the handlers of its
+// characteristics directly. Clients connect to it through a gatt.Peripheral, so the
+// commands can be run against the emulator without a radio.
+type emuLocalTransport struct {
+	mtu    int
+	device *XMLDevice
+	chars  []*emuChar
+}
+
+// emuNewLocalTransport creates a local transport, which agrees to MTUs up to the given one
+func emuNewLocalTransport(mtu int) *emuLocalTransport {
+	return &emuLocalTransport{mtu: mtu}
+}
+
+// Serve builds the handlers of the characteristics of the emulated device. Requests are
+// served as clients make them, so it returns at once.
+func (t *emuLocalTransport) Serve(e *Emulator) error {
+	t.device = e.device
+	t.chars = nil
+	for _, s := range e.device.ServiceList {
+		for idx := range s.CharList {
+			t.chars = append(t.chars, emuNewChar(e, s.ServiceID, &s.CharList[idx]))
+		}
+	}
+	return nil
+}
+
+// Connect connects a client to the emulated device, returning its peripheral and a
+// channel closed when the peripheral disconnects
+func (t *emuLocalTransport) Connect() (*emuLocalPeripheral, <-chan struct{}) {
+	p := &emuLocalPeripheral{
+		t:     t,
+		mtu:   23,
+		chars: make(map[*gatt.Characteristic]*emuChar),
+		subs:  make(map[*gatt.Characteristic]*emuLocalNotifier),
+		lost:  make(chan struct{}),
+	}
+	emuLog("Connected", emuLocalCentral)
+	return p, p.lost
+}
+
+// ConnectDevice connects to the emulated device and runs the handler, as bleConnectDevice
+// does: when the handler returns errConnectionLost it is connected to again, otherwise it is
+// disconnected. The device is connected to whatever the id and name.
+func (t *emuLocalTransport) ConnectDevice(macIDArg string, name string,
+	handler func(p gatt.Peripheral, lost <-chan struct{}) error) error {
+	for {
+		p, lost := t.Connect()
+		err := handler(p, lost)
+		p.Disconnect()
+		if err != errConnectionLost {
+			return err
+		}
+	}
+}
+
+// emuLocalError represents the status of a request the emulator failed
+type emuLocalError byte
+
+// Error describes the status
+func (e emuLocalError) Error() string {
+	return fmt.Sprintf("status 0x%02x", byte(e))
+}
+
+// emuLocalNotifier passes the values an emulated characteristic notifies to the handler
+// of the client, until it unsubscribes or disconnects
+type emuLocalNotifier struct {
+	mu   sync.Mutex
+	done bool
+	cap  int
+	f    func([]byte)
+}
+
+// Write notifies the client of a value
+func (n *emuLocalNotifier) Write(b []byte) (int, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.done {
+		return 0, errors.New("central stopped notifications")
+	}
+	if len(b) > n.cap {
+		return 0, errors.New("value exceeds cap")
+	}
+	n.f(append([]byte(nil), b...))
+	return len(b), nil
+}
+
+// Done tells whether the client unsubscribed or disconnected
+func (n *emuLocalNotifier) Done() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.done
+}
+
+// Cap returns the size of the values that can be notified
+func (n *emuLocalNotifier) Cap() int {
+	return n.cap
+}
+
+// stop stops the notifications
+func (n *emuLocalNotifier) stop() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.done = true
+}
+
+// emuLocalPeripheral is the gatt.Peripheral of a client of the local transport. Only the
+// requests the emulator serves are supported: descriptors, included services and RSSI are not.
+type emuLocalPeripheral struct {
+	t     *emuLocalTransport
+	mtu   int
+	svcs  []*gatt.Service
+	chars map[*gatt.Characteristic]*emuChar
+	mu    sync.Mutex
+	subs  map[*gatt.Characteristic]*emuLocalNotifier
+	lost  chan struct{}
+	once  sync.Once
+}
+
+// Disconnect drops the connection, failing further requests and stopping notifications
+func (p *emuLocalPeripheral) Disconnect() {
+	p.once.Do(func() {
+		p.mu.Lock()
+		for c, n := range p.subs {
+			n.stop()
+			delete(p.subs, c)
+		}
+		p.mu.Unlock()
+		close(p.lost)
+		emuLog("Disconnected", emuLocalCentral)
+	})
+}
+
+// connected tells whether the connection is still up
+func (p *emuLocalPeripheral) connected() bool {
+	select {
+	case <-p.lost:
+		return false
+	default:
+		return true
+	}
+}
+
+func (p *emuLocalPeripheral) Device() gatt.Device       { return nil }
+func (p *emuLocalPeripheral) ID() string                { return emuLocalCentral }
+func (p *emuLocalPeripheral) Name() string              { return p.t.device.DeviceName }
+func (p *emuLocalPeripheral) Services() []*gatt.Service { return p.svcs }
+func (p *emuLocalPeripheral) ReadRSSI() int             { return 0 }
+func (p *emuLocalPeripheral) MTU() int                  { return p.mtu }
+
+// DiscoverServices discovers the services of the emulated device, along with their
+// characteristics
+func (p *emuLocalPeripheral) DiscoverServices(ds []gatt.UUID) ([]*gatt.Service, error) {
+	if !p.connected() {
+		return nil, gatt.ErrDisconnected
+	}
+	p.svcs = nil
+	h := uint16(1)
+	var svc *gatt.Service
+	for _, ch := range p.t.chars {
+		if svc == nil || xmlNormalizeUUID(svc.UUID().String()) != ch.svcID {
+			u, err := gatt.ParseUUID(ch.svcID)
+			if err != nil {
+				continue
+			}
+			svc = gatt.NewService(u)
+			svc.SetHandle(h)
+			h++
+			if gatt.UUIDContains(ds, u) {
+				p.svcs = append(p.svcs, svc)
+			}
+		}
+		u, err := gatt.ParseUUID(ch.charID)
+		if err != nil {
+			continue
+		}
+		c := gatt.NewCharacteristic(u, svc, ch.props, h, h+1)
+		h += 2
+		svc.SetCharacteristics(append(svc.Characteristics(), c))
+		svc.SetEndHandle(h - 1)
+		p.chars[c] = ch
+	}
+	return p.svcs, nil
+}
+
+func (p *emuLocalPeripheral) DiscoverIncludedServices(ss []gatt.UUID, s *gatt.Service) ([]*gatt.Service, error) {
+	return nil, nil
+}
+
+// DiscoverCharacteristics returns the characteristics of a discovered service
+func (p *emuLocalPeripheral) DiscoverCharacteristics(cs []gatt.UUID, s *gatt.Service) ([]*gatt.Characteristic, error) {
+	if !p.connected() {
+		return nil, gatt.ErrDisconnected
+	}
+	var chars []*gatt.Characteristic
+	for _, c := range s.Characteristics() {
+		if gatt.UUIDContains(cs, c.UUID()) {
+			chars = append(chars, c)
+		}
+	}
+	return chars, nil
+}
+
+func (p *emuLocalPeripheral) DiscoverDescriptors(ds []gatt.UUID, c *gatt.Characteristic) ([]*gatt.Descriptor, error) {
+	if !p.connected() {
+		return nil, gatt.ErrDisconnected
+	}
+	return nil, nil
+}
+
+// read reads the value of a characteristic from the offset
+func (p *emuLocalPeripheral) read(c *gatt.Characteristic, offset int) ([]byte, error) {
+	if !p.connected() {
+		return nil, gatt.ErrDisconnected
+	}
+	ch := p.chars[c]
+	if ch == nil || ch.read == nil {
+		return nil, errors.New("read not permitted")
+	}
+	b, status := ch.read(emuLocalCentral, offset, p.mtu-1)
+	if status != gatt.StatusSuccess {
+		return nil, emuLocalError(status)
+	}
+	return b, nil
+}
+
+func (p *emuLocalPeripheral) ReadCharacteristic(c *gatt.Characteristic) ([]byte, error) {
+	return p.read(c, 0)
+}
+
+func (p *emuLocalPeripheral) ReadLongCharacteristic(c *gatt.Characteristic) ([]byte, error) {
+	var value []byte
+	for {
+		b, err := p.read(c, len(value))
+		if err != nil {
+			return nil, err
+		}
+		value = append(value, b...)
+		if len(b) < p.mtu-1 {
+			return value, nil
+		}
+	}
+}
+
+func (p *emuLocalPeripheral) ReadDescriptor(d *gatt.Descriptor) ([]byte, error) {
+	return nil, errors.New("descriptors are not emulated")
+}
+
+// WriteCharacteristic writes a characteristic, reporting the ATT status of writes with response
+func (p *emuLocalPeripheral) WriteCharacteristic(c *gatt.Characteristic, b []byte, noRsp bool) error {
+	if !p.connected() {
+		return gatt.ErrDisconnected
+	}
+	ch := p.chars[c]
+	if ch == nil || ch.write == nil {
+		if noRsp {
+			return nil
+		}
+		return errors.New("write not permitted")
+	}
+	if len(b) > p.mtu-3 {
+		return errors.New("value exceeds the MTU")
+	}
+	if status := ch.write(emuLocalCentral, b); status != gatt.StatusSuccess && !noRsp {
+		return emuLocalError(status)
+	}
+	return nil
+}
+
+func (p *emuLocalPeripheral) WriteDescriptor(d *gatt.Descriptor, b []byte) error {
+	return errors.New("descriptors are not emulated")
+}
+
+// SetNotifyValue subscribes to the notifications of a characteristic, or unsubscribes when f is nil
+func (p *emuLocalPeripheral) SetNotifyValue(c *gatt.Characteristic, f func(*gatt.Characteristic, []byte, error)) error {
+	if !p.connected() {
+		return gatt.ErrDisconnected
+	}
+	ch := p.chars[c]
+	if ch == nil || ch.notify == nil {
+		return errors.New("characteristic does not notify")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n := p.subs[c]; n != nil {
+		n.stop()
+		delete(p.subs, c)
+	}
+	if f == nil {
+		return nil
+	}
+	n := &emuLocalNotifier{cap: p.mtu - 3, f: func(b []byte) { f(c, b, nil) }}
+	p.subs[c] = n
+	go ch.notify(emuLocalCentral, n)
+	return nil
+}
+
+func (p *emuLocalPeripheral) SetIndicateValue(c *gatt.Characteristic, f func(*gatt.Characteristic, []byte, error)) error {
+	return p.SetNotifyValue(c, f)
+}
+
+// SetMTU agrees to the MTU, up to the one of the transport
+func (p *emuLocalPeripheral) SetMTU(mtu uint16) error {
+	if !p.connected() {
+		return gatt.ErrDisconnected
+	}
+	p.mtu = int(mtu)
+	if p.mtu > p.t.mtu {
+		p.mtu = p.t.mtu
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/currantlabs/gatt"
+	"github.com/currantlabs/gatt/examples/option"
+)
+
+// EmuTransport publishes the GATT database of an emulator to centrals. The gatt
+// transport serves it over the radio, the local transport in-process.
+type EmuTransport interface {
+	Serve(emu *Emulator) error
+}
+
+// Emulator serves a GATT database built from a device spec
+type Emulator struct {
+	device         *XMLDevice
+	notifyInterval time.Duration
+	values         map[string][]byte
+	dfu            *SDFUTarget
+	otau           *OTAUTarget
+	mu             sync.Mutex
+}
+
+// emuLog logs an emulator event with a timestamp
+func emuLog(a ...interface{}) {
+	fmt.Println(append([]interface{}{time.Now().Format("15:04:05.000")}, a...)...)
+}
+
+// emuNewEmulator creates an emulator for the device, with the initial values of its
+// characteristics given as hex strings keyed by UUID
+func emuNewEmulator(dev *XMLDevice, initValues map[string]string, notifyInterval time.Duration) (*Emulator, error) {
+	emu := &Emulator{
+		device:         dev,
+		notifyInterval: notifyInterval,
+		values:         make(map[string][]byte),
+	}
+
+	for uuid, value := range initValues {
+		b, err := hex.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q for %s: %v", value, uuid, err)
+		}
+		emu.values[xmlNormalizeUUID(uuid)] = b
+	}
+	return emu, nil
+}
+
+// Read returns the current value of a characteristic. Reads of the BCD Upgrade
+// characteristics come from the emulated upgrade service.
+func (e *Emulator) Read(charID string) []byte {
+	if e.otau != nil {
+		switch charID {
+		case otauCurrentAppID:
+			return e.otau.CurrentApp()
+		case otauUpgradeStatusID:
+			return e.otau.Status()
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.values[charID]
+}
+
+// Write sets the value of a characteristic, returning the ATT status of the write. Writes
+// of the Secure DFU characteristics go to the emulated bootloader, and those of the BCD
+// Upgrade characteristics to the emulated upgrade service.
+func (e *Emulator) Write(charID string, data []byte) byte {
+	if e.otau != nil {
+		switch charID {
+		case otauCurrentAppID:
+			return e.otau.SelectApp(data)
+		case otauControlPointID:
+			return e.otau.Control(data)
+		case otauUpgradeDataID:
+			return e.otau.Data(data)
+		}
+	}
+	if e.dfu != nil {
+		switch charID {
+		case sdfuControlPointID:
+			return e.dfu.Control(data)
+		case sdfuPacketID:
+			return e.dfu.Packet(data)
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.values[charID] = append([]byte(nil), data...)
+	return gatt.StatusSuccess
+}
+
+// Subscribe pushes the value of a characteristic to the notifier periodically,
+// until the central unsubscribes
+func (e *Emulator) Subscribe(charID string, n gatt.Notifier) {
+	if e.dfu != nil && charID == sdfuControlPointID {
+		e.dfu.Subscribe(n)
+		return
+	}
+	if e.otau != nil && charID == otauControlPointID {
+		e.otau.Subscribe(n)
+		return
+	}
+
+	ticker := time.NewTicker(e.notifyInterval)
+	defer ticker.Stop()
+
+	for !n.Done() {
+		<-ticker.C
+		value := e.Read(charID)
+		if len(value) > n.Cap() {
+			value = value[:n.Cap()]
+		}
+		if _, err := n.Write(value); err != nil {
+			emuLog("Notify", charID, "failed, err:", err)
+			return
+		}
+		emuLog("Notify", charID, formatDescribeChar(e.device, charID, value))
+	}
+}
+
+// emuChar represents a characteristic of the emulated device with the handlers of the
+// requests its properties allow, which transports invoke for the centrals they serve
+type emuChar struct {
+	svcID  string
+	charID string
+	props  gatt.Property
+	read   func(central string, offset int, cap int) ([]byte, byte)
+	write  func(central string, data []byte) byte
+	notify func(central string, n gatt.Notifier)
+}
+
+// emuNewChar creates the handlers of a characteristic of the emulated device, routing
+// requests to the emulator
+func emuNewChar(e *Emulator, svcID string, c *XMLCharacteristic) *emuChar {
+	charID := xmlNormalizeUUID(c.CharID)
+	charName := c.CharName
+	ch := &emuChar{svcID: xmlNormalizeUUID(svcID), charID: charID, props: xmlGetBitMask(&c.Properties)}
+
+	if (ch.props & gatt.CharRead) != 0 {
+		ch.read = func(central string, offset int, cap int) ([]byte, byte) {
+			value := e.Read(charID)
+			if offset > len(value) {
+				return nil, gatt.StatusInvalidOffset
+			}
+			value = value[offset:]
+			if len(value) > cap {
+				value = value[:cap]
+			}
+			emuLog("Read", charName, formatDescribeChar(e.device, charID, value), "from", central)
+			return value, gatt.StatusSuccess
+		}
+	}
+	if (ch.props & (gatt.CharWrite | gatt.CharWriteNR)) != 0 {
+		ch.write = func(central string, data []byte) byte {
+			if charID != sdfuPacketID && charID != otauUpgradeDataID {
+				emuLog("Write", charName, formatDescribeChar(e.device, charID, data), "from", central)
+			}
+			return e.Write(charID, data)
+		}
+	}
+	if (ch.props & (gatt.CharNotify | gatt.CharIndicate)) != 0 {
+		ch.notify = func(central string, n gatt.Notifier) {
+			emuLog("Subscribe", charName, "from", central)
+			e.Subscribe(charID, n)
+			emuLog("Unsubscribe", charName, "from", central)
+		}
+	}
+	return ch
+}
+
+// emuServices builds the gatt services of the emulated device, routing requests to
+// the emulator
+func emuServices(e *Emulator) []*gatt.Service {
+	var svcList []*gatt.Service
+
+	for _, s := range e.device.ServiceList {
+		svcUUID, err := gatt.ParseUUID(s.ServiceID)
+		if err != nil {
+			fmt.Println("Skipping service", s.ServiceID, "err:", err)
+			continue
+		}
+		svc := gatt.NewService(svcUUID)
+
+		for idx := range s.CharList {
+			charUUID, err := gatt.ParseUUID(s.CharList[idx].CharID)
+			if err != nil {
+				fmt.Println("Skipping characteristic", s.CharList[idx].CharID, "err:", err)
+				continue
+			}
+			ch := emuNewChar(e, s.ServiceID, &s.CharList[idx])
+			char := svc.AddCharacteristic(charUUID)
+
+			if ch.read != nil {
+				char.HandleReadFunc(func(rsp gatt.ResponseWriter, req *gatt.ReadRequest) {
+					value, status := ch.read(req.Central.ID(), req.Offset, req.Cap)
+					if status != gatt.StatusSuccess {
+						rsp.SetStatus(status)
+						return
+					}
+					rsp.Write(value)
+				})
+			}
+			if ch.write != nil {
+				char.HandleWriteFunc(func(r gatt.Request, data []byte) byte {
+					return ch.write(r.Central.ID(), data)
+				})
+			}
+			if ch.notify != nil {
+				char.HandleNotifyFunc(func(r gatt.Request, n gatt.Notifier) {
+					ch.notify(r.Central.ID(), n)
+				})
+			}
+		}
+		svcList = append(svcList, svc)
+	}
+	return svcList
+}
+
+// emuGattTransport serves the emulator over the local BLE radio
+type emuGattTransport struct{}
+
+// emuTransport is the transport emulated devices are served over
+var emuTransport EmuTransport = &emuGattTransport{}
+
+// Serve advertises the emulated device and serves its database until the process exits
+func (t *emuGattTransport) Serve(e *Emulator) error {
+	d, err := gatt.NewDevice(option.DefaultServerOptions...)
+	if err != nil {
+		return err
+	}
+
+	d.Handle(
+		gatt.CentralConnected(func(c gatt.Central) { emuLog("Connected", c.ID()) }),
+		gatt.CentralDisconnected(func(c gatt.Central) { emuLog("Disconnected", c.ID()) }),
+	)
+
+	onStateChanged := func(d gatt.Device, s gatt.State) {
+		fmt.Println("State:", s)
+		switch s {
+		case gatt.StatePoweredOn:
+			var uuids []gatt.UUID
+			for _, svc := range emuServices(e) {
+				if err := d.AddService(svc); err != nil {
+					fmt.Println("Failed to add service", svc.UUID(), "err:", err)
+					continue
+				}
+				uuids = append(uuids, svc.UUID())
+			}
+			fmt.Println("Advertising as", e.device.DeviceName)
+			d.AdvertiseNameAndServices(e.device.DeviceName, uuids)
+		default:
+		}
+	}
+	if err := d.Init(onStateChanged); err != nil {
+		return err
+	}
+
+	select {}
+}
+
+// emuEmulateDevice emulates the device described by the spec file, adding an emulated
+// Secure DFU bootloader if dfu is set, and emulating the BCD Upgrade service if otau is set
+func emuEmulateDevice(fileName string, valuesFile string, notifyInterval time.Duration, dfu bool, otau bool) {
+	dev, err := xmlLoadDevice(fileName)
+	if err != nil {
+		fmt.Println("Error reading file \n\t", err)
+		return
+	}
+
+	var initValues map[string]string
+	if len(valuesFile) != 0 {
+		if initValues, err = csvReadFile(os.Stdout, valuesFile); err != nil {
+			return
+		}
+	}
+
+	emu, err := emuNewEmulator(dev, initValues, notifyInterval)
+	if err != nil {
+		fmt.Println("Error setting initial values \n\t", err)
+		return
+	}
+	if dfu {
+		sdfuAddService(dev)
+		emu.dfu = sdfuNewTarget()
+	}
+	if otau {
+		otauAddService(dev)
+		emu.otau = otauNewTarget(1)
+	}
+
+	fmt.Println("Emulating", dev.DeviceName, "with", dev.numServices, "services")
+	if err := emuTransport.Serve(emu); err != nil {
+		fmt.Println("Failed to serve emulated device, err:", err)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/currantlabs/gatt"
+)
+
+// emuTestConnect serves ly01.xml with the initial values over the local transport and
+// connects to it, discovering its services
+func emuTestConnect(t *testing.T, initValues map[string]string, mtu int) (*Emulator, *emuLocalPeripheral) {
+	dev, err := xmlLoadDevice("ly01.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	emu, err := emuNewEmulator(dev, initValues, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := emuNewLocalTransport(mtu)
+	if err := transport.Serve(emu); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := transport.Connect()
+	if _, err := p.DiscoverServices(nil); err != nil {
+		t.Fatal(err)
+	}
+	return emu, p
+}
+
+// emuTestChar finds a discovered characteristic
+func emuTestChar(t *testing.T, p gatt.Peripheral, charID string) *gatt.Characteristic {
+	for _, s := range p.Services() {
+		for _, c := range s.Characteristics() {
+			if xmlNormalizeUUID(c.UUID().String()) == charID {
+				return c
+			}
+		}
+	}
+	t.Fatalf("characteristic %s not found", charID)
+	return nil
+}
+
+func TestEmuLocalDiscover(t *testing.T) {
+	_, p := emuTestConnect(t, nil, 23)
+
+	if len(p.Services()) != 3 {
+		t.Fatalf("discovered %d services, expected 3", len(p.Services()))
+	}
+	svc, c, err := charFind(p, "a86abc2dd44c442e99f780059a873e36", otauCurrentAppID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if xmlNormalizeUUID(svc.UUID().String()) != "a86abc2dd44c442e99f780059a873e36" {
+		t.Errorf("found %s in service %s", c.UUID(), svc.UUID())
+	}
+	if c.Properties() != gatt.CharRead|gatt.CharWrite {
+		t.Errorf("properties of Current App are %s", c.Properties())
+	}
+}
+
+func TestEmuLocalReadWrite(t *testing.T) {
+	serial := strings.Repeat("0123456789", 5)
+	_, p := emuTestConnect(t, map[string]string{
+		otauCurrentAppID: "01",
+		"2a25":           hex.EncodeToString([]byte(serial)),
+	}, 23)
+
+	currentApp := emuTestChar(t, p, otauCurrentAppID)
+	if b, err := bleReadValue(p, currentApp); err != nil || !bytes.Equal(b, []byte{1}) {
+		t.Errorf("read %x, %v, expected 01", b, err)
+	}
+	if err := p.WriteCharacteristic(currentApp, []byte{2}, false); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := bleReadValue(p, currentApp); err != nil || !bytes.Equal(b, []byte{2}) {
+		t.Errorf("read %x, %v after writing 02", b, err)
+	}
+
+	// Values longer than the MTU are read in parts
+	if b, err := bleReadValue(p, emuTestChar(t, p, "2a25")); err != nil || string(b) != serial {
+		t.Errorf("read %q, %v, expected %q", b, err, serial)
+	}
+
+	if err := p.WriteCharacteristic(emuTestChar(t, p, "27919da179b14661af1124417341af11"), []byte{1}, false); err == nil {
+		t.Error("write of a read only characteristic succeeded")
+	}
+}
+
+func TestEmuLocalNotify(t *testing.T) {
+	_, p := emuTestConnect(t, nil, 23)
+	control := emuTestChar(t, p, "1bd19c14b78a4e0faeb58e0352bac382")
+
+	if err := p.WriteCharacteristic(control, []byte{0x80, 0x01}, false); err != nil {
+		t.Fatal(err)
+	}
+	values := make(chan []byte, 16)
+	err := p.SetNotifyValue(control, func(c *gatt.Characteristic, b []byte, err error) {
+		values <- b
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case b := <-values:
+		if !bytes.Equal(b, []byte{0x80, 0x01}) {
+			t.Errorf("notified %x, expected 8001", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no notification")
+	}
+
+	if err := p.SetNotifyValue(control, nil); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	for len(values) != 0 {
+		<-values
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(values) != 0 {
+		t.Error("notified after unsubscribing")
+	}
+}
+
+func TestEmuLocalDisconnect(t *testing.T) {
+	_, p := emuTestConnect(t, map[string]string{otauCurrentAppID: "01"}, 23)
+	currentApp := emuTestChar(t, p, otauCurrentAppID)
+
+	p.Disconnect()
+	if _, err := p.ReadCharacteristic(currentApp); err != gatt.ErrDisconnected {
+		t.Errorf("read after disconnecting returned %v", err)
+	}
+	if err := p.WriteCharacteristic(currentApp, []byte{1}, true); err != gatt.ErrDisconnected {
+		t.Errorf("write after disconnecting returned %v", err)
+	}
+}
+
+func TestEmuLocalMTU(t *testing.T) {
+	_, p := emuTestConnect(t, nil, 185)
+
+	if size := bleSetMTU(p, 247); size != 182 {
+		t.Errorf("chunks of %d bytes with an MTU of 185, expected 182", size)
+	}
+	if err := p.WriteCharacteristic(emuTestChar(t, p, "279f9dab79be4663af1d24407347af13"), make([]byte, 183), false); err == nil {
+		t.Error("write exceeding the MTU succeeded")
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	htmlTemplate "html/template"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+// exportFormats are the formats the export command renders devices in
+var exportFormats = []string{"json", "yaml", "markdown", "html"}
+
+// exportFuncs are the helpers available to the document templates
+var exportFuncs = map[string]interface{}{
+	"props":  exportPropertyList,
+	"inc":    func(i int) int { return i + 1 },
+	"anchor": func(s string) string { return strings.ToLower(strings.Replace(s, " ", "-", -1)) },
+	"cell":   exportMarkdownCell,
+}
+
+// exportMarkdownCellReplacer escapes the pipes that would end a markdown table cell, and
+// replaces the line breaks that would end its row
+var exportMarkdownCellReplacer = strings.NewReplacer("|", "\\|", "\r\n", "<br>", "\n", "<br>", "\r", "<br>")
+
+// exportMarkdownCell escapes text for a markdown table cell or heading
+func exportMarkdownCell(s string) string {
+	return exportMarkdownCellReplacer.Replace(s)
+}
+
+const exportMarkdownTemplate = `# {{cell .DeviceName}} BLE Interface
+
+{{cell .DeviceName}} exposes {{len .ServiceList}} service(s).
+
+| # | Service | UUID | Characteristics |
+|---|---------|------|-----------------|
+{{- range $idx, $svc := .ServiceList}}
+| {{inc $idx}} | {{cell $svc.ServiceName}} | ` + "`{{$svc.ServiceID}}`" + ` | {{len $svc.CharList}} |
+{{- end}}
+{{range .ServiceList}}
+## {{cell .ServiceName}}
+
+UUID: ` + "`{{.ServiceID}}`" + `
+
+| Characteristic | UUID | Requirement | Properties |
+|----------------|------|-------------|------------|
+{{- range .CharList}}
+| {{cell .CharName}} | ` + "`{{.CharID}}`" + ` | {{cell .Requirement}} | {{props .Properties}} |
+{{- end}}
+{{range .CharList}}{{if .Fields}}
+### {{cell .CharName}} value
+
+| Field | Format | Unit | Minimum | Maximum |
+|-------|--------|------|---------|---------|
+{{- range .Fields}}
+| {{cell .Name}} | {{cell .Format}} | {{cell .Unit}} | {{cell .Minimum}} | {{cell .Maximum}} |
+{{- end}}
+{{end}}{{end}}{{end}}`
+
+const exportHTMLTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="UTF-8">
+<title>{{.DeviceName}} BLE Interface</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 4px 10px; text-align: left; }
+th { background: #eee; }
+code { font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>{{.DeviceName}} BLE Interface</h1>
+<p>{{.DeviceName}} exposes {{len .ServiceList}} service(s).</p>
+<table>
+<tr><th>#</th><th>Service</th><th>UUID</th><th>Characteristics</th></tr>
+{{- range $idx, $svc := .ServiceList}}
+<tr><td>{{inc $idx}}</td><td><a href="#{{anchor $svc.ServiceName}}">{{$svc.ServiceName}}</a></td><td><code>{{$svc.ServiceID}}</code></td><td>{{len $svc.CharList}}</td></tr>
+{{- end}}
+</table>
+{{range .ServiceList}}
+<h2 id="{{anchor .ServiceName}}">{{.ServiceName}}</h2>
+<p>UUID: <code>{{.ServiceID}}</code></p>
+<table>
+<tr><th>Characteristic</th><th>UUID</th><th>Requirement</th><th>Properties</th></tr>
+{{- range .CharList}}
+<tr><td>{{.CharName}}</td><td><code>{{.CharID}}</code></td><td>{{.Requirement}}</td><td>{{props .Properties}}</td></tr>
+{{- end}}
+</table>
+{{- range .CharList}}{{if .Fields}}
+<h3>{{.CharName}} value</h3>
+<table>
+<tr><th>Field</th><th>Format</th><th>Unit</th><th>Minimum</th><th>Maximum</th></tr>
+{{- range .Fields}}
+<tr><td>{{.Name}}</td><td>{{.Format}}</td><td>{{.Unit}}</td><td>{{.Minimum}}</td><td>{{.Maximum}}</td></tr>
+{{- end}}
+</table>
+{{- end}}{{end}}
+{{end}}
+</body>
+</html>
+`
+
+// exportPropertyList lists the mandatory properties of a characteristic
+func exportPropertyList(props XMLCharProperties) string {
+	list := strings.Fields(xmlGetBitMask(&props).String())
+	if len(list) == 0 {
+		return "-"
+	}
+	return strings.Join(list, ", ")
+}
+
+// exportWrite renders the device in the specified format
+func exportWrite(w io.Writer, dev *XMLDevice, format string) error {
+	switch format {
+	case "json":
+		output, err := json.MarshalIndent(dev, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(output))
+		return err
+
+	case "yaml":
+		output, err := yaml.Marshal(dev)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(output)
+		return err
+
+	case "markdown":
+		t := template.Must(template.New("markdown").Funcs(exportFuncs).Parse(exportMarkdownTemplate))
+		return t.Execute(w, dev)
+
+	case "html":
+		t := htmlTemplate.Must(htmlTemplate.New("html").Funcs(exportFuncs).Parse(exportHTMLTemplate))
+		return t.Execute(w, dev)
+	}
+	return fmt.Errorf("unknown export format %q", format)
+}
+
+// exportDevice renders a spec or captured device file into the specified format,
+// written to stdout when no output file is given
+func exportDevice(fileName string, format string, outFile string) {
+	// Checked before the output file is created, so an unknown format leaves no empty file
+	if !cmdIsOneOf(format, exportFormats) {
+		fmt.Println("Please enter one of the formats", exportFormats)
+		return
+	}
+
+	dev, err := xmlLoadDevice(fileName)
+	if err != nil {
+		fmt.Println("Error reading file \n\t", err)
+		return
+	}
+
+	w := os.Stdout
+	if len(outFile) != 0 {
+		f, err := os.Create(outFile)
+		if err != nil {
+			fmt.Println("Error creating file \n\t", err)
+			return
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := exportWrite(w, dev, format); err != nil {
+		fmt.Println("Error exporting device \n\t", err)
+		return
+	}
+
+	if len(outFile) != 0 {
+		fmt.Println("Export created in file", outFile)
+	}
+}
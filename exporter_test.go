@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExportMarkdownCells(t *testing.T) {
+	dev := &XMLDevice{DeviceName: "LY01", ServiceList: []XMLService{{ServiceName: "Light | Dimmer",
+		ServiceID: "1c68b3fad44343659e1cb22f44eb0816", CharList: []XMLCharacteristic{
+			{CharName: "Level\nPercent", CharID: "447c291d5318420b980a8f33e22c3744", Requirement: "C1|C2",
+				Fields: []XMLField{{Name: "Level", Format: "uint8", Unit: "a|b\r\nc"}}},
+		}}}}
+	var buf bytes.Buffer
+	if err := exportWrite(&buf, dev, "markdown"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cell := range []string{`| 1 | Light \| Dimmer |`, `| Level<br>Percent |`, `| C1\|C2 |`,
+		`| a\|b<br>c |`, `## Light \| Dimmer`} {
+		if !strings.Contains(buf.String(), cell) {
+			t.Errorf("markdown lacks %q:\n%s", cell, buf.String())
+		}
+	}
+	// Every row of a table has the cells of its header
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, "|") && strings.Count(line, "|")-strings.Count(line, `\|`) < 5 {
+			t.Errorf("row %q has too few cells", line)
+		}
+	}
+}
+
+func TestExportUnknownFormat(t *testing.T) {
+	outFile := filepath.Join(t.TempDir(), "ly01.pdf")
+	exportDevice("ly01.xml", "pdf", outFile)
+	if _, err := os.Stat(outFile); !os.IsNotExist(err) {
+		t.Errorf("exporting to an unknown format created %s", outFile)
+	}
+}
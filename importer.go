@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// importSplitList splits a comma separated list of command line values
+func importSplitList(list string) []string {
+	var items []string
+
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); len(item) != 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// importServices converts the given files of the specified format into services
+func importServices(format string, fileNames []string, charDir string) ([]XMLService, error) {
+	switch format {
+	case "sig":
+		return sigImportServices(fileNames, charDir)
+	case "nrf":
+		return nrfImportServices(fileNames)
+	case "bds":
+		return bdsImportServices(fileNames, charDir)
+	}
+	return nil, fmt.Errorf("unknown import format %q", format)
+}
+
+// importMergeServices appends services to the device, skipping any it already defines
+func importMergeServices(dev *XMLDevice, svcList []XMLService) {
+	for _, svc := range svcList {
+		if isFound, _ := xmlFindService(dev, svc.ServiceID); isFound == true {
+			fmt.Println("Service", svc.ServiceID, "already defined, keeping existing definition")
+			continue
+		}
+		dev.ServiceList = append(dev.ServiceList, svc)
+		dev.numServices++
+	}
+}
+
+// importDevice builds a device spec from imported definitions, optionally merged into
+// an existing XML spec, and writes it out
+func importDevice(format string, fileList string, charDir string, baseFile string, devName string, outFile string) {
+	fileNames := importSplitList(fileList)
+	if len(fileNames) == 0 {
+		fmt.Println(" Please specify the files to import")
+		return
+	}
+
+	dev := &XMLDevice{}
+	if len(baseFile) != 0 {
+		base, err := xmlLoadDevice(baseFile)
+		if err != nil {
+			fmt.Println("Error reading base file \n\t", err)
+			return
+		}
+		dev = base
+	}
+	if len(devName) != 0 {
+		dev.DeviceName = devName
+	}
+	if len(dev.DeviceName) == 0 {
+		fmt.Println(" Please specify the name of the device")
+		return
+	}
+
+	svcList, err := importServices(format, fileNames, charDir)
+	if err != nil {
+		fmt.Println("Error importing files \n\t", err)
+		return
+	}
+	importMergeServices(dev, svcList)
+
+	if len(outFile) == 0 {
+		xmlOutDeviceInfo(dev)
+		return
+	}
+	if err := xmlWriteDevice(dev, outFile); err != nil {
+		fmt.Println("Error writing file \n\t", err)
+		return
+	}
+	fmt.Println("XML Output created in file", outFile)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/currantlabs/gatt"
+)
+
+// NRFProperty represents a characteristic property in an nRF Connect export
+type NRFProperty struct {
+	Name string `xml:"name,attr"`
+}
+
+// NRFCharacteristic represents a characteristic in an nRF Connect export
+type NRFCharacteristic struct {
+	CharName   string        `xml:"name,attr"`
+	CharID     string        `xml:"uuid,attr"`
+	Properties []NRFProperty `xml:"property"`
+}
+
+// NRFService represents a service in an nRF Connect export
+type NRFService struct {
+	ServiceName string              `xml:"name,attr"`
+	ServiceID   string              `xml:"uuid,attr"`
+	CharList    []NRFCharacteristic `xml:"characteristic"`
+}
+
+// NRFServerConfig represents an nRF Connect server configuration export
+type NRFServerConfig struct {
+	XMLName     xml.Name     `xml:"server-configuration"`
+	ServiceList []NRFService `xml:"service"`
+}
+
+// nrfPropertyMask maps nRF Connect property names onto characteristic properties
+var nrfPropertyMask = map[string]func(*XMLCharProperties){
+	"BROADCAST":              func(p *XMLCharProperties) { p.Broadcast = mandatory },
+	"READ":                   func(p *XMLCharProperties) { p.Read = mandatory },
+	"WRITE_NO_RESPONSE":      func(p *XMLCharProperties) { p.WriteWithoutResponse = mandatory },
+	"WRITE_WITHOUT_RESPONSE": func(p *XMLCharProperties) { p.WriteWithoutResponse = mandatory },
+	"WRITE":                  func(p *XMLCharProperties) { p.Write = mandatory },
+	"NOTIFY":                 func(p *XMLCharProperties) { p.Notify = mandatory },
+	"INDICATE":               func(p *XMLCharProperties) { p.Indicate = mandatory },
+	"SIGNED_WRITE":           func(p *XMLCharProperties) { p.SignedWrite = mandatory },
+	"EXTENDED_PROPS":         func(p *XMLCharProperties) { p.Extended = mandatory },
+}
+
+// nrfKnownName returns the assigned name of a service or characteristic when
+// the export doesn't name it
+func nrfKnownName(name string, uuid string, isService bool) string {
+	if len(name) != 0 {
+		return name
+	}
+	u, err := gatt.ParseUUID(xmlNormalizeUUID(uuid))
+	if err != nil {
+		return name
+	}
+	if isService {
+		return gatt.NewService(u).Name()
+	}
+	return gatt.NewCharacteristic(u, nil, 0, 0, 0).Name()
+}
+
+// nrfImportServices converts nRF Connect server configuration exports into the XML spec model
+func nrfImportServices(fileNames []string) ([]XMLService, error) {
+	var svcList []XMLService
+
+	for _, fileName := range fileNames {
+		var cfg NRFServerConfig
+
+		b, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		if err := xml.Unmarshal(b, &cfg); err != nil {
+			return nil, fmt.Errorf("%s: %v", fileName, err)
+		}
+
+		for _, s := range cfg.ServiceList {
+			svc := XMLService{
+				ServiceName: nrfKnownName(s.ServiceName, s.ServiceID, true),
+				ServiceID:   xmlNormalizeUUID(s.ServiceID),
+			}
+			for _, c := range s.CharList {
+				char := XMLCharacteristic{
+					CharName:    nrfKnownName(c.CharName, c.CharID, false),
+					CharID:      xmlNormalizeUUID(c.CharID),
+					Requirement: mandatory,
+					Properties:  *xmlSetProperties(0),
+				}
+				for _, prop := range c.Properties {
+					setProp, ok := nrfPropertyMask[strings.ToUpper(prop.Name)]
+					if !ok {
+						fmt.Println("Ignoring unknown property", prop.Name, "of", c.CharID)
+						continue
+					}
+					setProp(&char.Properties)
+				}
+				svc.CharList = append(svc.CharList, char)
+			}
+			svc.numChars = len(svc.CharList)
+			fmt.Println("Imported service", svc.ServiceID, "(", svc.ServiceName, ") with",
+				svc.numChars, "characteristic(s)")
+			svcList = append(svcList, svc)
+		}
+	}
+	return svcList, nil
+}
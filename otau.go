@@ -0,0 +1,543 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/currantlabs/gatt"
+)
+
+// dfuProtocols are the protocols the dfu command upgrades devices with
+var dfuProtocols = []string{"csr", "nordic"}
+
+// UUIDs of the BCD Upgrade service and its characteristics, as named in the custom service
+// and characteristic files. Current App is the Application Info characteristic.
+const (
+	otauServiceID       = "a86abc2dd44c442e99f780059a873e36"
+	otauCurrentAppID    = "00001013d10211e19b2300025b00a5a5"
+	otauControlPointID  = "1bd19c14b78a4e0faeb58e0352bac382"
+	otauUpgradeDataID   = "279f9dab79be4663af1d24407347af13"
+	otauUpgradeStatusID = "27919da179b14661af1124417341af11"
+)
+
+// States of the Upgrade Control Point characteristic
+const (
+	otauStateReady      = 1
+	otauStateInProgress = 2
+	otauStatePaused     = 3
+	otauStateCompleted  = 4
+	otauStateFailed     = 5
+	otauStateAborted    = 6
+)
+
+// otauStates are the names of the states of the Upgrade Control Point characteristic
+var otauStates = map[uint16]string{
+	otauStateReady:      "ready",
+	otauStateInProgress: "in progress",
+	otauStatePaused:     "paused",
+	otauStateCompleted:  "completed",
+	otauStateFailed:     "failed",
+	otauStateAborted:    "aborted",
+}
+
+// Stages of a CSR upgrade, carried over the connections it takes
+const (
+	otauStageCheck = iota
+	otauStageTransfer
+	otauStageVerify
+	otauStageDone
+)
+
+// otauResponseTimeout is how long to wait for a notification of the device
+const otauResponseTimeout = 10 * time.Second
+
+// exitUpgradeFailed is the exit status when the firmware upgrade fails
+const exitUpgradeFailed = 9
+
+// OTAUSession represents an upgrade over a connection to the BCD Upgrade service of the device
+type OTAUSession struct {
+	p             gatt.Peripheral
+	lost          <-chan struct{}
+	currentApp    *gatt.Characteristic
+	controlPoint  *gatt.Characteristic
+	upgradeData   *gatt.Characteristic
+	upgradeStatus *gatt.Characteristic
+	states        chan uint16
+}
+
+// otauDiscover discovers the characteristics of the BCD Upgrade service of the device,
+// subscribing to the Upgrade Control Point
+func otauDiscover(p gatt.Peripheral, lost <-chan struct{}) (*OTAUSession, error) {
+	o := &OTAUSession{p: p, lost: lost, states: make(chan uint16, 8)}
+
+	ss, err := p.DiscoverServices(nil)
+	if err == gatt.ErrDisconnected {
+		return nil, errConnectionLost
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to discover services: %v", err)
+	}
+
+	var svc *gatt.Service
+	for _, s := range ss {
+		if xmlNormalizeUUID(s.UUID().String()) == otauServiceID {
+			svc = s
+		}
+	}
+	if svc == nil {
+		return nil, errors.New("BCD Upgrade service not found")
+	}
+	cs, err := p.DiscoverCharacteristics(nil, svc)
+	if err == gatt.ErrDisconnected {
+		return nil, errConnectionLost
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to discover characteristics: %v", err)
+	}
+	for _, c := range cs {
+		switch xmlNormalizeUUID(c.UUID().String()) {
+		case otauCurrentAppID:
+			o.currentApp = c
+		case otauControlPointID:
+			o.controlPoint = c
+		case otauUpgradeDataID:
+			o.upgradeData = c
+		case otauUpgradeStatusID:
+			o.upgradeStatus = c
+		}
+	}
+	for c, charName := range map[*gatt.Characteristic]string{o.currentApp: "Current App",
+		o.controlPoint: "Upgrade Control Point", o.upgradeData: "Upgrade Data",
+		o.upgradeStatus: "CSR Upgrade Data"} {
+		if c == nil {
+			return nil, fmt.Errorf("BCD Upgrade service has no %s characteristic", charName)
+		}
+	}
+
+	if _, err := p.DiscoverDescriptors(nil, o.controlPoint); err != nil {
+		return nil, fmt.Errorf("failed to discover descriptors: %v", err)
+	}
+	err = subSetValue(p, o.controlPoint, func(c *gatt.Characteristic, b []byte, err error) {
+		if err == nil && len(b) >= 2 {
+			select {
+			case o.states <- binary.LittleEndian.Uint16(b):
+			default:
+			}
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to Upgrade Control Point: %v", err)
+	}
+	return o, nil
+}
+
+// close unsubscribes from the Upgrade Control Point
+func (o *OTAUSession) close() {
+	subSetValue(o.p, o.controlPoint, nil)
+}
+
+// write writes a characteristic with response
+func (o *OTAUSession) write(c *gatt.Characteristic, b []byte) error {
+	if err := o.p.WriteCharacteristic(c, b, false); err == gatt.ErrDisconnected {
+		return errConnectionLost
+	} else if err != nil {
+		return fmt.Errorf("failed to write %s, ATT error: %v", c.UUID(), err)
+	}
+	return nil
+}
+
+// setState writes the state of the transfer to the Upgrade Control Point
+func (o *OTAUSession) setState(state uint16) error {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, state)
+	return o.write(o.controlPoint, b)
+}
+
+// readCurrentApp reads the index of the application the device runs
+func (o *OTAUSession) readCurrentApp() (int, error) {
+	b, err := bleReadValue(o.p, o.currentApp)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read Current App: %v", err)
+	}
+	if len(b) != 1 {
+		return 0, fmt.Errorf("Current App of %d bytes, expected 1", len(b))
+	}
+	return int(b[0]), nil
+}
+
+// readStatus reads the size and CRC of the image the device received from CSR Upgrade Data
+func (o *OTAUSession) readStatus() (int, uint32, error) {
+	b, err := bleReadValue(o.p, o.upgradeStatus)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read CSR Upgrade Data: %v", err)
+	}
+	if len(b) != 8 {
+		return 0, 0, fmt.Errorf("CSR Upgrade Data of %d bytes, expected 8", len(b))
+	}
+	return int(binary.LittleEndian.Uint32(b)), binary.LittleEndian.Uint32(b[4:]), nil
+}
+
+// otauFirmwareRevision reads the Firmware Revision of the Device Information Service,
+// returning an empty string when the device has none
+func otauFirmwareRevision(p gatt.Peripheral) (string, error) {
+	id, err := disRead(p, p.Services())
+	if err != nil || id == nil {
+		return "", err
+	}
+	return id.Firmware, nil
+}
+
+// otauShowProgress displays the progress of the transfer on stderr
+func otauShowProgress(sent int, total int, start time.Time, startOffset int) {
+	rate := float64(sent-startOffset) / time.Since(start).Seconds() / 1000
+	fmt.Fprintf(os.Stderr, "\rUploading %3d%% %d/%d bytes %.1f kB/s ", 100*sent/total, sent, total, rate)
+}
+
+// send sends the image for the application index: it selects the application with Current
+// App, sets the Upgrade Control Point in progress and writes the image to Upgrade Data in
+// chunks. When resume is set and the device holds the start of the image, as CSR Upgrade
+// Data tells, the transfer continues from there; otherwise the Upgrade Control Point is set
+// ready first, which discards the data the device holds.
+func (o *OTAUSession) send(image []byte, app int, chunkSize int, resume bool) error {
+	if err := o.write(o.currentApp, []byte{byte(app)}); err != nil {
+		return err
+	}
+	size, crc, err := o.readStatus()
+	if err != nil {
+		return err
+	}
+	offset := 0
+	if resume && size != 0 && size <= len(image) && crc == crc32.ChecksumIEEE(image[:size]) {
+		offset = size
+		fmt.Fprintf(os.Stderr, "Resuming at %d bytes\n", offset)
+	} else if err := o.setState(otauStateReady); err != nil {
+		return err
+	}
+	if err := o.setState(otauStateInProgress); err != nil {
+		return err
+	}
+
+	noRsp := (o.upgradeData.Properties() & gatt.CharWrite) == 0
+	start := time.Now()
+	percent := -1
+	for sent := offset; sent < len(image); {
+		end := sent + chunkSize
+		if end > len(image) {
+			end = len(image)
+		}
+		if err := o.p.WriteCharacteristic(o.upgradeData, image[sent:end], noRsp); err == gatt.ErrDisconnected {
+			fmt.Fprintln(os.Stderr)
+			return errConnectionLost
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr)
+			return fmt.Errorf("failed to write Upgrade Data, ATT error: %v", err)
+		}
+		sent = end
+		if 100*sent/len(image) != percent {
+			percent = 100 * sent / len(image)
+			otauShowProgress(sent, len(image), start, offset)
+		}
+	}
+	fmt.Fprintln(os.Stderr)
+	return nil
+}
+
+// verify checks the size and CRC of the image the device received, aborting the transfer
+// when they differ from those of the image
+func (o *OTAUSession) verify(image []byte) error {
+	size, crc, err := o.readStatus()
+	if err != nil {
+		return err
+	}
+	if size != len(image) || crc != crc32.ChecksumIEEE(image) {
+		o.setState(otauStateAborted)
+		return fmt.Errorf("device received %d bytes with CRC 0x%08x, expected %d bytes with CRC 0x%08x",
+			size, crc, len(image), crc32.ChecksumIEEE(image))
+	}
+	return nil
+}
+
+// complete sets the Upgrade Control Point completed, after which the device checks the image
+// and restarts into it. It returns once the device reports the upgrade completed or restarts.
+func (o *OTAUSession) complete() error {
+	for len(o.states) != 0 {
+		<-o.states
+	}
+	// The device may restart into the image before responding
+	if err := o.setState(otauStateCompleted); err == errConnectionLost {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	timeout := time.After(otauResponseTimeout)
+	for {
+		select {
+		case state := <-o.states:
+			switch state {
+			case otauStateCompleted:
+				return nil
+			case otauStateFailed, otauStateAborted:
+				return fmt.Errorf("device reported the upgrade %s", otauStates[state])
+			}
+		case <-o.lost:
+			return nil
+		case <-timeout:
+			return nil
+		}
+	}
+}
+
+// otauUpgrade connects to the specified device and upgrades its firmware with the image over
+// the BCD Upgrade service. It returns the exit status of the command.
+func otauUpgrade(macIDArg string, name string, imageFile string, version string, force bool, resume bool,
+	mtu int, app int) int {
+	image, err := ioutil.ReadFile(imageFile)
+	if err != nil {
+		fmt.Println("Error reading image \n\t", err)
+		return 2
+	}
+	if len(image) == 0 {
+		fmt.Println("Error reading image \n\t the image is empty")
+		return 2
+	}
+	fmt.Fprintf(os.Stderr, "Image %s: %d bytes, CRC 0x%08x\n", imageFile, len(image),
+		crc32.ChecksumIEEE(image))
+	return otauUpgradeImage(bleConnectDevice, macIDArg, name, image, version, force, resume, mtu, app)
+}
+
+// otauUpgradeImage upgrades the specified device with the image over the connections the
+// connect function makes. The application is checked first, and the upgrade skipped when the
+// Firmware Revision of the device is the given version, unless forced. The image is then sent
+// and its size and CRC checked, and the device restarted into it. Once restarted, the device is
+// connected to once more to verify it runs the application, and the version when given. When
+// resume is set, a lost connection is re-established and the transfer continued. It returns
+// the exit status of the command.
+func otauUpgradeImage(connect bleConnectFunc, macIDArg string, name string, image []byte, version string,
+	force bool, resume bool, mtu int, app int) int {
+	stage := otauStageCheck
+	status := exitConnectFailed
+	for stage != otauStageDone {
+		err := connect(macIDArg, name, func(p gatt.Peripheral, lost <-chan struct{}) error {
+			chunkSize := bleSetMTU(p, mtu)
+
+			status = exitNotFound
+			o, err := otauDiscover(p, lost)
+			if err == errConnectionLost && !resume {
+				return fmt.Errorf("%v, not resuming", err)
+			} else if err != nil {
+				return err
+			}
+			defer o.close()
+
+			status = exitReadFailed
+			current, err := o.readCurrentApp()
+			if err != nil {
+				return err
+			}
+			firmware, err := otauFirmwareRevision(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Current application %d, firmware revision %q\n", current, firmware)
+
+			switch stage {
+			case otauStageCheck:
+				if len(version) != 0 && firmware == version && !force {
+					fmt.Println("Device already runs version", version)
+					stage = otauStageDone
+					status = exitOK
+					return nil
+				}
+			case otauStageVerify:
+				status = exitVerifyFailed
+				if current != app {
+					return fmt.Errorf("device runs application %d instead of %d", current, app)
+				}
+				if len(version) != 0 && firmware != version {
+					return fmt.Errorf("device runs version %q instead of %q", firmware, version)
+				}
+				fmt.Println("Upgrade complete")
+				stage = otauStageDone
+				status = exitOK
+				return nil
+			}
+
+			status = exitUpgradeFailed
+			fmt.Fprintln(os.Stderr, "Sending the image for application", app)
+			stage = otauStageTransfer
+			err = o.send(image, app, chunkSize, resume)
+			if err == errConnectionLost && !resume {
+				return fmt.Errorf("%v, not resuming", err)
+			} else if err != nil {
+				return err
+			}
+
+			status = exitVerifyFailed
+			if err := o.verify(image); err != nil {
+				return err
+			}
+			status = exitUpgradeFailed
+			fmt.Fprintln(os.Stderr, "Restarting into the image")
+			if err := o.complete(); err != nil {
+				return err
+			}
+			stage = otauStageVerify
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error upgrading firmware \n\t", err)
+			return status
+		}
+	}
+	return status
+}
+
+// OTAUTarget emulates the BCD Upgrade service of a device, so the dfu command can be run
+// against the emulator. It stores the image it receives, and once completed runs the
+// application the image was for, without otherwise checking or activating it.
+type OTAUTarget struct {
+	mu       sync.Mutex
+	current  byte
+	selected byte
+	state    uint16
+	data     []byte
+	images   map[byte][]byte
+	states   chan uint16
+}
+
+// otauNewTarget creates an emulated upgrade service running the application index
+func otauNewTarget(current int) *OTAUTarget {
+	return &OTAUTarget{
+		current: byte(current),
+		state:   otauStateReady,
+		images:  make(map[byte][]byte),
+		states:  make(chan uint16, 16),
+	}
+}
+
+// otauAddService adds the BCD Upgrade service to a device spec which has none
+func otauAddService(dev *XMLDevice) {
+	for _, svc := range dev.ServiceList {
+		if xmlNormalizeUUID(svc.ServiceID) == otauServiceID {
+			return
+		}
+	}
+	dev.ServiceList = append(dev.ServiceList, XMLService{
+		ServiceName: "BCD Upgrade",
+		ServiceID:   otauServiceID,
+		CharList: []XMLCharacteristic{
+			{CharName: "Upgrade Control Point", CharID: otauControlPointID,
+				Properties: XMLCharProperties{Write: mandatory, Notify: mandatory}},
+			{CharName: "Upgrade Data", CharID: otauUpgradeDataID,
+				Properties: XMLCharProperties{Write: mandatory}},
+			{CharName: "Current App", CharID: otauCurrentAppID,
+				Properties: XMLCharProperties{Read: mandatory, Write: mandatory}},
+			{CharName: "CSR Upgrade Data", CharID: otauUpgradeStatusID,
+				Properties: XMLCharProperties{Read: mandatory}},
+		},
+	})
+	dev.numServices++
+}
+
+// notify queues a notification of the Upgrade Control Point, dropping it when nobody is
+// subscribed
+func (t *OTAUTarget) notify(state uint16) {
+	select {
+	case t.states <- state:
+	default:
+	}
+}
+
+// CurrentApp returns the value of Current App, the index of the running application
+func (t *OTAUTarget) CurrentApp() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return []byte{t.current}
+}
+
+// SelectApp handles a write of Current App, selecting the application the image is for
+func (t *OTAUTarget) SelectApp(data []byte) byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(data) != 1 {
+		return gatt.StatusUnexpectedError
+	}
+	t.selected = data[0]
+	return gatt.StatusSuccess
+}
+
+// Status returns the value of CSR Upgrade Data, the size and CRC of the image received
+func (t *OTAUTarget) Status() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint32(b, uint32(len(t.data)))
+	binary.LittleEndian.PutUint32(b[4:], crc32.ChecksumIEEE(t.data))
+	return b
+}
+
+// Control handles a write of the Upgrade Control Point, returning the ATT status of the write
+func (t *OTAUTarget) Control(data []byte) byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(data) != 2 {
+		return gatt.StatusUnexpectedError
+	}
+	switch state := binary.LittleEndian.Uint16(data); state {
+	case otauStateReady, otauStateAborted:
+		t.data, t.state = nil, state
+	case otauStateInProgress, otauStatePaused:
+		t.state = state
+	case otauStateCompleted:
+		if t.state != otauStateInProgress || len(t.data) == 0 || t.selected == 0 {
+			t.notify(otauStateFailed)
+			break
+		}
+		t.images[t.selected] = t.data
+		t.current = t.selected
+		emuLog("OTAU", fmt.Sprintf("restarted into application %d, %d bytes, CRC 0x%08x", t.current,
+			len(t.data), crc32.ChecksumIEEE(t.data)))
+		t.data, t.state = nil, otauStateReady
+		t.notify(otauStateCompleted)
+	default:
+		return gatt.StatusUnexpectedError
+	}
+	return gatt.StatusSuccess
+}
+
+// Data handles a write of Upgrade Data, storing the data while the transfer is in progress
+func (t *OTAUTarget) Data(data []byte) byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state != otauStateInProgress {
+		emuLog("OTAU", "dropped", len(data), "bytes, the transfer is", otauStates[t.state])
+		return gatt.StatusSuccess
+	}
+	t.data = append(t.data, data...)
+	return gatt.StatusSuccess
+}
+
+// Subscribe sends the states of the Upgrade Control Point to the notifier, until the
+// central unsubscribes
+func (t *OTAUTarget) Subscribe(n gatt.Notifier) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for !n.Done() {
+		select {
+		case state := <-t.states:
+			b := make([]byte, 2)
+			binary.LittleEndian.PutUint16(b, state)
+			if _, err := n.Write(b); err != nil {
+				emuLog("OTAU", "notify failed, err:", err)
+				return
+			}
+		case <-ticker.C:
+		}
+	}
+}
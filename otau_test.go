@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/currantlabs/gatt"
+)
+
+// otauTestServe serves an emulated device with the BCD Upgrade service over the local
+// transport, running application 1 with the firmware revision when given
+func otauTestServe(t *testing.T, mtu int, firmware string) (*OTAUTarget, *emuLocalTransport) {
+	dev := &XMLDevice{DeviceName: "LY01"}
+	initValues := map[string]string{}
+	if len(firmware) != 0 {
+		dev.ServiceList = append(dev.ServiceList, XMLService{ServiceName: "Device Information", ServiceID: "180a",
+			CharList: []XMLCharacteristic{{CharName: "Firmware Revision", CharID: "2a26",
+				Properties: XMLCharProperties{Read: mandatory}}}})
+		initValues["2a26"] = hex.EncodeToString([]byte(firmware))
+	}
+	otauAddService(dev)
+	emu, err := emuNewEmulator(dev, initValues, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emu.otau = otauNewTarget(1)
+	transport := emuNewLocalTransport(mtu)
+	if err := transport.Serve(emu); err != nil {
+		t.Fatal(err)
+	}
+	return emu.otau, transport
+}
+
+// otauTestImage returns an image of random data
+func otauTestImage(size int) []byte {
+	image := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(image)
+	return image
+}
+
+// otauTestCheckTarget checks the emulated device runs the application with the image
+func otauTestCheckTarget(t *testing.T, target *OTAUTarget, app int, image []byte) {
+	target.mu.Lock()
+	defer target.mu.Unlock()
+	if int(target.current) != app {
+		t.Errorf("device runs application %d, expected %d", target.current, app)
+	}
+	if !bytes.Equal(target.images[byte(app)], image) {
+		t.Errorf("device holds an image of %d bytes for application %d, expected %d",
+			len(target.images[byte(app)]), app, len(image))
+	}
+}
+
+// otauTestPeripheral intercepts the writes of Upgrade Data to count the bytes sent, and to
+// corrupt a chunk or drop the connection at a chunk, counting the chunks from 1 over all
+// connections
+type otauTestPeripheral struct {
+	gatt.Peripheral
+	chunks       int
+	sent         int
+	corruptAt    int
+	disconnectAt int
+}
+
+func (p *otauTestPeripheral) WriteCharacteristic(c *gatt.Characteristic, b []byte, noRsp bool) error {
+	if xmlNormalizeUUID(c.UUID().String()) == otauUpgradeDataID {
+		p.chunks++
+		if p.chunks == p.disconnectAt {
+			p.Peripheral.(*emuLocalPeripheral).Disconnect()
+		}
+		if p.chunks == p.corruptAt {
+			b = append([]byte{^b[0]}, b[1:]...)
+		}
+		p.sent += len(b)
+	}
+	return p.Peripheral.WriteCharacteristic(c, b, noRsp)
+}
+
+// connect connects to the emulated device through the test peripheral
+func (p *otauTestPeripheral) connect(transport *emuLocalTransport) bleConnectFunc {
+	return func(macIDArg string, name string, handler func(p gatt.Peripheral, lost <-chan struct{}) error) error {
+		return transport.ConnectDevice(macIDArg, name, func(lp gatt.Peripheral, lost <-chan struct{}) error {
+			p.Peripheral = lp
+			return handler(p, lost)
+		})
+	}
+}
+
+func TestOTAUTransfer(t *testing.T) {
+	target, transport := otauTestServe(t, 64, "")
+	image := otauTestImage(5000)
+	p := &otauTestPeripheral{}
+
+	status := otauUpgradeImage(p.connect(transport), "", "LY01", image, "", false, true, 64, 2)
+	if status != exitOK {
+		t.Fatalf("upgrade failed with status %d", status)
+	}
+	otauTestCheckTarget(t, target, 2, image)
+	if p.chunks != (len(image)+60)/61 {
+		t.Errorf("sent %d chunks, expected %d of 61 bytes", p.chunks, (len(image)+60)/61)
+	}
+}
+
+func TestOTAUResume(t *testing.T) {
+	target, transport := otauTestServe(t, 23, "")
+	image := otauTestImage(5000)
+	p := &otauTestPeripheral{disconnectAt: 100}
+
+	status := otauUpgradeImage(p.connect(transport), "", "LY01", image, "", false, true, 23, 1)
+	if status != exitOK {
+		t.Fatalf("upgrade failed with status %d", status)
+	}
+	otauTestCheckTarget(t, target, 1, image)
+	// The chunk written as the connection dropped may be sent again, not the whole image
+	if p.sent > len(image)+20 {
+		t.Errorf("sent %d bytes of a %d byte image, the transfer was not resumed", p.sent, len(image))
+	}
+}
+
+func TestOTAUNoResume(t *testing.T) {
+	_, transport := otauTestServe(t, 23, "")
+	p := &otauTestPeripheral{disconnectAt: 100}
+
+	status := otauUpgradeImage(p.connect(transport), "", "LY01", otauTestImage(5000), "", false, false, 23, 1)
+	if status != exitUpgradeFailed {
+		t.Errorf("upgrade returned status %d after a disconnect, expected %d", status, exitUpgradeFailed)
+	}
+}
+
+func TestOTAUVerify(t *testing.T) {
+	// A corrupted chunk is caught by the CRC of CSR Upgrade Data before restarting
+	target, transport := otauTestServe(t, 23, "")
+	p := &otauTestPeripheral{corruptAt: 10}
+	status := otauUpgradeImage(p.connect(transport), "", "LY01", otauTestImage(5000), "", false, true, 23, 2)
+	if status != exitVerifyFailed {
+		t.Errorf("upgrade returned status %d for a corrupted image, expected %d", status, exitVerifyFailed)
+	}
+	if current := target.CurrentApp()[0]; current != 1 {
+		t.Errorf("device restarted into application %d with a corrupted image", current)
+	}
+
+	// The device still reports the firmware revision it ran before the upgrade
+	_, transport = otauTestServe(t, 23, "1.1.3")
+	p = &otauTestPeripheral{}
+	status = otauUpgradeImage(p.connect(transport), "", "LY01", otauTestImage(5000), "1.2.0", false, true, 23, 1)
+	if status != exitVerifyFailed {
+		t.Errorf("upgrade returned status %d for a device on the old version, expected %d", status,
+			exitVerifyFailed)
+	}
+}
+
+func TestOTAUVersion(t *testing.T) {
+	_, transport := otauTestServe(t, 23, "1.2.0")
+	for _, force := range []bool{false, true} {
+		p := &otauTestPeripheral{}
+		status := otauUpgradeImage(p.connect(transport), "", "LY01", otauTestImage(5000), "1.2.0", force, true,
+			23, 1)
+		if force && p.sent != 5000 || !force && (status != exitOK || p.sent != 0) {
+			t.Errorf("force %v: upgrade returned status %d after sending %d bytes", force, status, p.sent)
+		}
+	}
+}
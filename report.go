@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/xml"
+	"fmt"
+	htmlTemplate "html/template"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// reportFormats are the formats compare and test run reports can be written in
+var reportFormats = []string{"junit", "tap", "html"}
+
+// Statuses of the checks of a report
+const (
+	reportPass = "PASS"
+	reportFail = "FAIL"
+	reportSkip = "SKIP"
+)
+
+// ReportCase represents a single check of a compare or test run, with what was expected
+// and found when the check compares the device against its spec
+type ReportCase struct {
+	Class    string
+	Name     string
+	Status   string
+	Expected string
+	Found    string
+	Duration time.Duration
+	Message  string
+}
+
+// ReportDevice represents the identity of the device a report was made for, from its advertisement
+type ReportDevice struct {
+	ID        string
+	LocalName string
+	TxPower   int
+	MfgData   string
+}
+
+// Report represents the checks of a compare or test run, for CI systems to ingest. Compare
+// runs also record the device identity, the spec file and the discovered services.
+type Report struct {
+	Name       string
+	Start      time.Time
+	Cases      []ReportCase
+	DeviceName string
+	Device     *ReportDevice
+	Spec       string
+	SpecHash   string
+	Tree       *XMLDevice
+}
+
+// JUnitFailure represents the failure of a JUnit testcase
+type JUnitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// JUnitTestCase represents a JUnit testcase
+type JUnitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *JUnitFailure `xml:"failure,omitempty"`
+	Skipped   *struct{}     `xml:"skipped,omitempty"`
+}
+
+// JUnitTestSuite represents a JUnit testsuite
+type JUnitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	TestCases []JUnitTestCase `xml:"testcase"`
+}
+
+// JUnitTestSuites represents a JUnit XML document
+type JUnitTestSuites struct {
+	XMLName    xml.Name         `xml:"testsuites"`
+	TestSuites []JUnitTestSuite `xml:"testsuite"`
+}
+
+// reportNew creates an empty report
+func reportNew(name string) *Report {
+	return &Report{Name: name, Start: time.Now()}
+}
+
+// reportHashFile returns the SHA-256 hash of a file, identifying the spec a report was made against
+func reportHashFile(fileName string) string {
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b))
+}
+
+// Add adds a check to the report, failed when there are messages
+func (r *Report) Add(class string, name string, duration time.Duration, messages ...string) {
+	r.Check(class, name, "", "", duration, messages...)
+}
+
+// Check adds a check of what was expected against what was found to the report, failed
+// when there are messages
+func (r *Report) Check(class string, name string, expected string, found string, duration time.Duration,
+	messages ...string) {
+	status := reportPass
+	if len(messages) != 0 {
+		status = reportFail
+	}
+	r.Cases = append(r.Cases, ReportCase{Class: class, Name: name, Status: status, Expected: expected,
+		Found: found, Duration: duration, Message: strings.Join(messages, "\n")})
+}
+
+// Count counts the passed, failed and skipped checks of the report
+func (r *Report) Count() (int, int, int) {
+	passed, failed, skipped := 0, 0, 0
+	for _, c := range r.Cases {
+		switch c.Status {
+		case reportPass:
+			passed++
+		case reportFail:
+			failed++
+		default:
+			skipped++
+		}
+	}
+	return passed, failed, skipped
+}
+
+// reportSeconds formats a duration in seconds, as JUnit expects
+func reportSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// reportWriteJUnit writes a report as a JUnit XML document with a single testsuite
+func reportWriteJUnit(w io.Writer, r *Report) error {
+	_, failed, skipped := r.Count()
+	suite := JUnitTestSuite{
+		Name:      r.Name,
+		Tests:     len(r.Cases),
+		Failures:  failed,
+		Skipped:   skipped,
+		Time:      reportSeconds(time.Since(r.Start)),
+		Timestamp: r.Start.Format("2006-01-02T15:04:05"),
+	}
+
+	for _, c := range r.Cases {
+		tc := JUnitTestCase{ClassName: c.Class, Name: c.Name, Time: reportSeconds(c.Duration)}
+		switch c.Status {
+		case reportFail:
+			tc.Failure = &JUnitFailure{Message: strings.SplitN(c.Message, "\n", 2)[0], Text: c.Message}
+		case reportSkip:
+			tc.Skipped = &struct{}{}
+		}
+		suite.TestCases = append(suite.TestCases, tc)
+	}
+
+	output, err := xml.MarshalIndent(JUnitTestSuites{TestSuites: []JUnitTestSuite{suite}}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(output))
+	return err
+}
+
+// reportWriteTAP writes a report in the Test Anything Protocol, version 13. Failure messages
+// and durations are given in YAML blocks.
+func reportWriteTAP(w io.Writer, r *Report) error {
+	fmt.Fprintln(w, "TAP version 13")
+	fmt.Fprintf(w, "1..%d\n", len(r.Cases))
+
+	for idx, c := range r.Cases {
+		name := c.Name
+		if len(c.Class) != 0 {
+			name = c.Class + ": " + c.Name
+		}
+		switch c.Status {
+		case reportPass:
+			fmt.Fprintf(w, "ok %d - %s\n", idx+1, name)
+		case reportSkip:
+			fmt.Fprintf(w, "ok %d - %s # SKIP\n", idx+1, name)
+			continue
+		default:
+			fmt.Fprintf(w, "not ok %d - %s\n", idx+1, name)
+		}
+
+		fmt.Fprintln(w, "  ---")
+		if len(c.Message) != 0 {
+			fmt.Fprintln(w, "  message: |")
+			for _, line := range strings.Split(c.Message, "\n") {
+				fmt.Fprintln(w, "    "+line)
+			}
+		}
+		fmt.Fprintf(w, "  duration_ms: %d\n", c.Duration/time.Millisecond)
+		if _, err := fmt.Fprintln(w, "  ..."); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const reportHTMLTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="UTF-8">
+<title>{{.Name}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 4px 10px; text-align: left; vertical-align: top; }
+th { background: #eee; }
+code { font-size: 0.9em; }
+.PASS { background: #dff0d8; }
+.FAIL { background: #f2dede; }
+.SKIP { background: #fcf8e3; }
+pre { margin: 0; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>{{.Name}}</h1>
+<table>
+{{- if .DeviceName}}
+<tr><th>Device</th><td>{{.DeviceName}}</td></tr>
+{{- end}}
+{{- with .Device}}
+<tr><th>Peripheral ID</th><td><code>{{.ID}}</code></td></tr>
+<tr><th>Local Name</th><td>{{.LocalName}}</td></tr>
+<tr><th>Manufacturer Data</th><td><code>{{.MfgData}}</code></td></tr>
+<tr><th>TX Power Level</th><td>{{.TxPower}}</td></tr>
+{{- end}}
+{{- with .Tree}}{{with .Identity}}
+<tr><th>Manufacturer</th><td>{{.Manufacturer}}</td></tr>
+<tr><th>Model</th><td>{{.Model}}</td></tr>
+<tr><th>Serial</th><td>{{.Serial}}</td></tr>
+<tr><th>Hardware Revision</th><td>{{.Hardware}}</td></tr>
+<tr><th>Firmware Revision</th><td>{{.Firmware}}</td></tr>
+<tr><th>Software Revision</th><td>{{.Software}}</td></tr>
+<tr><th>System ID</th><td><code>{{.SystemID}}</code></td></tr>
+{{- end}}{{end}}
+{{- if .Spec}}
+<tr><th>Spec</th><td>{{.Spec}}</td></tr>
+<tr><th>Spec SHA-256</th><td><code>{{.SpecHash}}</code></td></tr>
+{{- end}}
+<tr><th>Date</th><td>{{.Start.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+<tr><th>Result</th><td class="{{result .}}">{{result .}}: {{counts .}}</td></tr>
+</table>
+<h2>Checks</h2>
+<table>
+<tr><th>Scope</th><th>Check</th><th>Expected</th><th>Found</th><th>Result</th><th>Details</th></tr>
+{{- range .Cases}}
+<tr class="{{.Status}}"><td>{{.Class}}</td><td>{{.Name}}</td><td>{{.Expected}}</td><td>{{.Found}}</td><td>{{.Status}}</td><td><pre>{{.Message}}</pre></td></tr>
+{{- end}}
+</table>
+{{- with .Tree}}
+<h2>Discovered services</h2>
+<ul>
+{{- range .ServiceList}}
+<li>Service <code>{{.ServiceID}}</code> {{.ServiceName}}
+<ul>
+{{- range .CharList}}
+<li>Characteristic <code>{{.CharID}}</code> {{.CharName}}: {{props .Properties}}</li>
+{{- end}}
+</ul>
+</li>
+{{- end}}
+</ul>
+{{- end}}
+</body>
+</html>
+`
+
+// reportResult returns the overall result of a report
+func reportResult(r *Report) string {
+	if _, failed, _ := r.Count(); failed != 0 {
+		return reportFail
+	}
+	return reportPass
+}
+
+// reportCounts summarizes the checks of a report
+func reportCounts(r *Report) string {
+	passed, failed, skipped := r.Count()
+	return fmt.Sprintf("%d checks, %d passed, %d failed, %d skipped", len(r.Cases), passed, failed, skipped)
+}
+
+// reportWriteHTML writes a report as a self-contained HTML document
+func reportWriteHTML(w io.Writer, r *Report) error {
+	funcs := map[string]interface{}{
+		"props":  exportPropertyList,
+		"result": reportResult,
+		"counts": reportCounts,
+	}
+	t := htmlTemplate.Must(htmlTemplate.New("report").Funcs(funcs).Parse(reportHTMLTemplate))
+	return t.Execute(w, r)
+}
+
+// reportOutput returns where a command writes its output: stderr when its report is written
+// to stdout, so the report can be piped on its own, and stdout otherwise
+func reportOutput(format string, fileName string) io.Writer {
+	if len(format) != 0 && len(fileName) == 0 {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// reportWrite writes a report in the given format to a file, or to stdout if no file is given
+func reportWrite(r *Report, format string, fileName string) error {
+	w := io.Writer(os.Stdout)
+	if len(fileName) != 0 {
+		f, err := os.Create(fileName)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	switch format {
+	case "tap":
+		return reportWriteTAP(w, r)
+	case "html":
+		return reportWriteHTML(w, r)
+	}
+	return reportWriteJUnit(w, r)
+}
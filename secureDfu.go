@@ -0,0 +1,795 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/currantlabs/gatt"
+)
+
+// UUIDs of the Nordic Secure DFU service
+const (
+	sdfuServiceID          = "fe59"
+	sdfuControlPointID     = "8ec90001f3154f609fb8838830daea50"
+	sdfuPacketID           = "8ec90002f3154f609fb8838830daea50"
+	sdfuButtonlessID       = "8ec90003f3154f609fb8838830daea50"
+	sdfuBondedButtonlessID = "8ec90004f3154f609fb8838830daea50"
+)
+
+// Opcodes of the DFU Control Point
+const (
+	sdfuOpCreate   = 0x01
+	sdfuOpSetPRN   = 0x02
+	sdfuOpChecksum = 0x03
+	sdfuOpExecute  = 0x04
+	sdfuOpSelect   = 0x06
+	sdfuOpResponse = 0x60
+)
+
+// Object types of the DFU Control Point
+const (
+	sdfuObjCommand = 0x01
+	sdfuObjData    = 0x02
+)
+
+// Result codes of DFU Control Point responses
+const (
+	sdfuResSuccess       = 0x01
+	sdfuResNotSupported  = 0x02
+	sdfuResInvalidParam  = 0x03
+	sdfuResNoResources   = 0x04
+	sdfuResInvalidObject = 0x05
+	sdfuResBadType       = 0x07
+	sdfuResNotPermitted  = 0x08
+	sdfuResFailed        = 0x0a
+	sdfuResExtended      = 0x0b
+)
+
+// sdfuResults are the names of the result codes of DFU Control Point responses
+var sdfuResults = map[byte]string{
+	sdfuResNotSupported:  "opcode not supported",
+	sdfuResInvalidParam:  "invalid parameter",
+	sdfuResNoResources:   "insufficient resources",
+	sdfuResInvalidObject: "invalid object",
+	sdfuResBadType:       "unsupported type",
+	sdfuResNotPermitted:  "operation not permitted",
+	sdfuResFailed:        "operation failed",
+	sdfuResExtended:      "extended error",
+}
+
+// Opcodes of the buttonless DFU characteristics
+const (
+	sdfuOpEnterBootloader = 0x01
+	sdfuOpSetName         = 0x02
+	sdfuOpButtonlessRsp   = 0x20
+)
+
+// sdfuBootloaderName is the name the bootloader advertises with by default
+const sdfuBootloaderName = "DfuTarg"
+
+// sdfuImageTypes are the image types of a DFU package, in the order they are transferred
+var sdfuImageTypes = []string{"softdevice_bootloader", "softdevice", "bootloader", "application"}
+
+// sdfuObjectAttempts is how many times an object is sent before giving up on checksum errors
+const sdfuObjectAttempts = 3
+
+// errChecksumMismatch is returned when the checksum of the device does not match the data sent
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// SDFUImage represents an image of a DFU package, with its init packet
+type SDFUImage struct {
+	Type       string
+	InitPacket []byte
+	Firmware   []byte
+}
+
+// SDFUManifestImage represents an image in the manifest of a DFU package
+type SDFUManifestImage struct {
+	BinFile string `json:"bin_file"`
+	DatFile string `json:"dat_file"`
+}
+
+// sdfuReadZipFile reads a file of a zip archive
+func sdfuReadZipFile(r *zip.ReadCloser, name string) ([]byte, error) {
+	for _, f := range r.File {
+		if f.Name != name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return ioutil.ReadAll(rc)
+	}
+	return nil, fmt.Errorf("%s not found in the package", name)
+}
+
+// sdfuLoadPackage loads the images of a DFU zip package, as generated by nrfutil, in the
+// order they are to be transferred
+func sdfuLoadPackage(fileName string) ([]SDFUImage, error) {
+	r, err := zip.OpenReader(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	b, err := sdfuReadZipFile(r, "manifest.json")
+	if err != nil {
+		return nil, err
+	}
+	var manifest struct {
+		Manifest map[string]json.RawMessage `json:"manifest"`
+	}
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+
+	var images []SDFUImage
+	for _, imageType := range sdfuImageTypes {
+		raw, ok := manifest.Manifest[imageType]
+		if !ok {
+			continue
+		}
+		var entry SDFUManifestImage
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			return nil, fmt.Errorf("invalid manifest entry %s: %v", imageType, err)
+		}
+		img := SDFUImage{Type: imageType}
+		if img.InitPacket, err = sdfuReadZipFile(r, entry.DatFile); err != nil {
+			return nil, err
+		}
+		if img.Firmware, err = sdfuReadZipFile(r, entry.BinFile); err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	if len(images) == 0 {
+		return nil, errors.New("no images in the manifest")
+	}
+	return images, nil
+}
+
+// SDFUSession represents a Secure DFU transfer over a connection to the device
+type SDFUSession struct {
+	p          gatt.Peripheral
+	lost       <-chan struct{}
+	control    *gatt.Characteristic
+	packet     *gatt.Characteristic
+	buttonless *gatt.Characteristic
+	responses  chan []byte
+}
+
+// sdfuDiscover discovers the Secure DFU service and subscribes to the responses of its
+// DFU Control Point, or of its buttonless characteristic when the device runs its
+// application rather than the bootloader
+func sdfuDiscover(p gatt.Peripheral, lost <-chan struct{}) (*SDFUSession, error) {
+	s := &SDFUSession{p: p, lost: lost, responses: make(chan []byte, 16)}
+
+	ss, err := p.DiscoverServices(nil)
+	if err == gatt.ErrDisconnected {
+		return nil, errConnectionLost
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to discover services: %v", err)
+	}
+	for _, svc := range ss {
+		if xmlNormalizeUUID(svc.UUID().String()) != sdfuServiceID {
+			continue
+		}
+		cs, err := p.DiscoverCharacteristics(nil, svc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover characteristics: %v", err)
+		}
+		for _, c := range cs {
+			switch xmlNormalizeUUID(c.UUID().String()) {
+			case sdfuControlPointID:
+				s.control = c
+			case sdfuPacketID:
+				s.packet = c
+			case sdfuButtonlessID, sdfuBondedButtonlessID:
+				s.buttonless = c
+			}
+		}
+	}
+
+	c := s.control
+	if c == nil || s.packet == nil {
+		if c = s.buttonless; c == nil {
+			return nil, errors.New("Secure DFU service not found")
+		}
+		s.control, s.packet = nil, nil
+	}
+	if _, err := p.DiscoverDescriptors(nil, c); err != nil {
+		return nil, fmt.Errorf("failed to discover descriptors: %v", err)
+	}
+	err = subSetValue(p, c, func(c *gatt.Characteristic, b []byte, err error) {
+		if err == nil {
+			select {
+			case s.responses <- append([]byte(nil), b...):
+			default:
+			}
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to %s: %v", c.UUID(), err)
+	}
+	return s, nil
+}
+
+// close unsubscribes from the responses of the session
+func (s *SDFUSession) close() {
+	if s.control != nil {
+		subSetValue(s.p, s.control, nil)
+	} else {
+		subSetValue(s.p, s.buttonless, nil)
+	}
+}
+
+// wait waits for the response to an opcode, returning its parameters
+func (s *SDFUSession) wait(rspOp byte, op byte) ([]byte, error) {
+	timeout := time.After(otauResponseTimeout)
+	for {
+		select {
+		case rsp := <-s.responses:
+			if len(rsp) < 3 || rsp[0] != rspOp || rsp[1] != op {
+				continue
+			}
+			if rsp[2] == sdfuResSuccess {
+				return rsp[3:], nil
+			}
+			result, ok := sdfuResults[rsp[2]]
+			if !ok {
+				result = fmt.Sprintf("result 0x%02x", rsp[2])
+			}
+			if rsp[2] == sdfuResExtended && len(rsp) > 3 {
+				result = fmt.Sprintf("%s 0x%02x", result, rsp[3])
+			}
+			return nil, &SDFUError{Op: op, Result: rsp[2], Text: result}
+		case <-s.lost:
+			return nil, errConnectionLost
+		case <-timeout:
+			return nil, fmt.Errorf("no response to opcode 0x%02x", op)
+		}
+	}
+}
+
+// SDFUError represents a failed response of the device
+type SDFUError struct {
+	Op     byte
+	Result byte
+	Text   string
+}
+
+// Error describes the failed opcode and its result
+func (e *SDFUError) Error() string {
+	return fmt.Sprintf("opcode 0x%02x failed: %s", e.Op, e.Text)
+}
+
+// request writes a command to the DFU Control Point and waits for its response
+func (s *SDFUSession) request(cmd ...byte) ([]byte, error) {
+	for len(s.responses) != 0 {
+		<-s.responses
+	}
+	if err := s.p.WriteCharacteristic(s.control, cmd, false); err == gatt.ErrDisconnected {
+		return nil, errConnectionLost
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to write the DFU Control Point, ATT error: %v", err)
+	}
+	return s.wait(sdfuOpResponse, cmd[0])
+}
+
+// selectObject selects the object type, returning its maximum size and the offset and CRC
+// of the data the device holds
+func (s *SDFUSession) selectObject(objType byte) (int, int, uint32, error) {
+	params, err := s.request(sdfuOpSelect, objType)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if len(params) < 12 {
+		return 0, 0, 0, errors.New("short response to select")
+	}
+	return int(binary.LittleEndian.Uint32(params)), int(binary.LittleEndian.Uint32(params[4:])),
+		binary.LittleEndian.Uint32(params[8:]), nil
+}
+
+// createObject creates an object of the type and size, to be sent next
+func (s *SDFUSession) createObject(objType byte, size int) error {
+	cmd := []byte{sdfuOpCreate, objType, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(cmd[2:], uint32(size))
+	_, err := s.request(cmd...)
+	return err
+}
+
+// sdfuCheckChecksum checks the offset and CRC of a checksum response against the data sent
+func sdfuCheckChecksum(params []byte, sent []byte) error {
+	if len(params) < 8 {
+		return errors.New("short checksum response")
+	}
+	offset, crc := binary.LittleEndian.Uint32(params), binary.LittleEndian.Uint32(params[4:])
+	if int(offset) != len(sent) || crc != crc32.ChecksumIEEE(sent) {
+		return errChecksumMismatch
+	}
+	return nil
+}
+
+// stream writes data[from:to] to the DFU Packet in chunks, checking the checksum the device
+// notifies every prn packets against the data sent so far
+func (s *SDFUSession) stream(data []byte, from int, to int, chunkSize int, prn int, progress func(int)) error {
+	packets := 0
+	for offset := from; offset < to; {
+		select {
+		case <-s.lost:
+			return errConnectionLost
+		default:
+		}
+
+		end := offset + chunkSize
+		if end > to {
+			end = to
+		}
+		if err := s.p.WriteCharacteristic(s.packet, data[offset:end], true); err == gatt.ErrDisconnected {
+			return errConnectionLost
+		} else if err != nil {
+			return fmt.Errorf("failed to write the DFU Packet, ATT error: %v", err)
+		}
+		offset = end
+		packets++
+
+		if prn > 0 && packets%prn == 0 {
+			params, err := s.wait(sdfuOpResponse, sdfuOpChecksum)
+			if err != nil {
+				return err
+			}
+			if err := sdfuCheckChecksum(params, data[:offset]); err != nil {
+				return err
+			}
+		}
+		if progress != nil {
+			progress(offset)
+		}
+	}
+	return nil
+}
+
+// sendObject sends data[from:to] as the rest of the current object, then checks and executes it
+func (s *SDFUSession) sendObject(data []byte, from int, to int, chunkSize int, prn int,
+	progress func(int)) error {
+	if err := s.stream(data, from, to, chunkSize, prn, progress); err != nil {
+		return err
+	}
+	params, err := s.request(sdfuOpChecksum)
+	if err != nil {
+		return err
+	}
+	if err := sdfuCheckChecksum(params, data[:to]); err != nil {
+		return err
+	}
+	_, err = s.request(sdfuOpExecute)
+	return err
+}
+
+// sendInitPacket sends the init packet of an image, unless resume is set and the device
+// already holds it along with some of the firmware
+func (s *SDFUSession) sendInitPacket(img *SDFUImage, chunkSize int, prn int, resume bool) error {
+	maxSize, offset, crc, err := s.selectObject(sdfuObjCommand)
+	if err != nil {
+		return err
+	}
+	if resume && offset == len(img.InitPacket) && crc == crc32.ChecksumIEEE(img.InitPacket) {
+		if _, dataOffset, _, err := s.selectObject(sdfuObjData); err != nil {
+			return err
+		} else if dataOffset != 0 {
+			return nil
+		}
+	}
+	if len(img.InitPacket) > maxSize {
+		return fmt.Errorf("init packet of %d bytes exceeds the maximum of %d", len(img.InitPacket), maxSize)
+	}
+
+	for attempt := 1; ; attempt++ {
+		if err := s.createObject(sdfuObjCommand, len(img.InitPacket)); err != nil {
+			return err
+		}
+		err := s.sendObject(img.InitPacket, 0, len(img.InitPacket), chunkSize, prn, nil)
+		if err != errChecksumMismatch || attempt == sdfuObjectAttempts {
+			return err
+		}
+	}
+}
+
+// sendFirmware sends the firmware of an image in objects of the maximum size of the device,
+// continuing from the data the device holds when its CRC matches
+func (s *SDFUSession) sendFirmware(img *SDFUImage, chunkSize int, prn int) error {
+	fw := img.Firmware
+	maxSize, offset, crc, err := s.selectObject(sdfuObjData)
+	if err != nil {
+		return err
+	}
+	if maxSize == 0 {
+		return errors.New("device reported a maximum object size of 0")
+	}
+
+	start := time.Now()
+	startOffset := offset
+	percent := -1
+	progress := func(sent int) {
+		// Objects sent again after a mismatch restart the rate
+		if sent < startOffset {
+			start, startOffset = time.Now(), sent
+		}
+		if 100*sent/len(fw) != percent {
+			percent = 100 * sent / len(fw)
+			otauShowProgress(sent, len(fw), start, startOffset)
+		}
+	}
+	defer fmt.Fprintln(os.Stderr)
+
+	if offset > len(fw) || crc != crc32.ChecksumIEEE(fw[:offset]) {
+		// Only the object the device holds part of can be sent again
+		if offset > len(fw) || offset%maxSize == 0 {
+			return errors.New("the device holds firmware not matching the image")
+		}
+		offset -= offset % maxSize
+	} else if offset%maxSize != 0 {
+		// Complete the object the device holds part of
+		end := offset - offset%maxSize + maxSize
+		if end > len(fw) {
+			end = len(fw)
+		}
+		err := s.sendObject(fw, offset, end, chunkSize, prn, progress)
+		if err == errChecksumMismatch {
+			offset -= offset % maxSize
+		} else if err != nil {
+			return err
+		} else {
+			offset = end
+		}
+	} else if offset != 0 {
+		// Execute the last object, in case it was received but not executed
+		if _, err := s.request(sdfuOpExecute); err != nil {
+			if e, ok := err.(*SDFUError); !ok || e.Result != sdfuResNotPermitted {
+				return err
+			}
+		}
+	}
+
+	for offset < len(fw) {
+		end := offset + maxSize
+		if end > len(fw) {
+			end = len(fw)
+		}
+		for attempt := 1; ; attempt++ {
+			if err := s.createObject(sdfuObjData, end-offset); err != nil {
+				return err
+			}
+			err := s.sendObject(fw, offset, end, chunkSize, prn, progress)
+			if err == nil {
+				break
+			}
+			if err != errChecksumMismatch || attempt == sdfuObjectAttempts {
+				return err
+			}
+		}
+		offset = end
+	}
+	return nil
+}
+
+// transfer transfers an image to the bootloader
+func (s *SDFUSession) transfer(img *SDFUImage, chunkSize int, prn int, resume bool) error {
+	cmd := []byte{sdfuOpSetPRN, 0, 0}
+	binary.LittleEndian.PutUint16(cmd[1:], uint16(prn))
+	if _, err := s.request(cmd...); err != nil {
+		return err
+	}
+	if err := s.sendInitPacket(img, chunkSize, prn, resume); err == errConnectionLost {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("failed to send the init packet: %v", err)
+	}
+	if err := s.sendFirmware(img, chunkSize, prn); err == errConnectionLost {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("failed to send the firmware: %v", err)
+	}
+	return nil
+}
+
+// enterBootloader restarts the device into its bootloader through the buttonless DFU
+// characteristic, returning the name the bootloader advertises with. A device not
+// requiring bonds is asked to advertise with a name unique to this upgrade.
+func (s *SDFUSession) enterBootloader() (string, error) {
+	name := sdfuBootloaderName
+	if xmlNormalizeUUID(s.buttonless.UUID().String()) == sdfuButtonlessID {
+		unique := fmt.Sprintf("Dfu%05X", time.Now().UnixNano()&0xfffff)
+		cmd := append([]byte{sdfuOpSetName, byte(len(unique))}, unique...)
+		if err := s.buttonlessRequest(cmd); err == nil {
+			name = unique
+		} else if err == errConnectionLost {
+			return "", err
+		}
+	}
+
+	// The device may restart before the response gets through
+	if err := s.buttonlessRequest([]byte{sdfuOpEnterBootloader}); err != nil && err != errConnectionLost {
+		return "", err
+	}
+	return name, nil
+}
+
+// buttonlessRequest writes a command to the buttonless DFU characteristic and waits for its response
+func (s *SDFUSession) buttonlessRequest(cmd []byte) error {
+	for len(s.responses) != 0 {
+		<-s.responses
+	}
+	if err := s.p.WriteCharacteristic(s.buttonless, cmd, false); err == gatt.ErrDisconnected {
+		return errConnectionLost
+	} else if err != nil {
+		return fmt.Errorf("failed to write the buttonless DFU characteristic, ATT error: %v", err)
+	}
+	_, err := s.wait(sdfuOpButtonlessRsp, cmd[0])
+	return err
+}
+
+// sdfuUpgrade connects to the specified device and upgrades it with the images of a DFU zip
+// package over Nordic Secure DFU. A device running its application is restarted into the
+// bootloader through the buttonless DFU characteristic, and connected to again. When resume
+// is set, a lost connection is re-established and the transfer continued from the data the
+// device holds. It returns the exit status of the command.
+func sdfuUpgrade(macIDArg string, name string, packageFile string, resume bool, mtu int, prn int) int {
+	images, err := sdfuLoadPackage(packageFile)
+	if err != nil {
+		fmt.Println("Error reading DFU package \n\t", err)
+		return 2
+	}
+	return sdfuUpgradeImages(bleConnectDevice, macIDArg, name, images, resume, mtu, prn)
+}
+
+// sdfuUpgradeImages upgrades the specified device with the images over the connections the
+// connect function makes, returning the exit status of the command
+func sdfuUpgradeImages(connect bleConnectFunc, macIDArg string, name string, images []SDFUImage, resume bool,
+	mtu int, prn int) int {
+	status := exitConnectFailed
+	for idx := 0; idx < len(images); {
+		img := &images[idx]
+		bootloaderName := ""
+
+		err := connect(macIDArg, name, func(p gatt.Peripheral, lost <-chan struct{}) error {
+			chunkSize := bleSetMTU(p, mtu)
+
+			status = exitNotFound
+			s, err := sdfuDiscover(p, lost)
+			if err == errConnectionLost && !resume {
+				return fmt.Errorf("%v, not resuming", err)
+			} else if err != nil {
+				return err
+			}
+			defer s.close()
+
+			status = exitUpgradeFailed
+			if s.control == nil {
+				fmt.Fprintln(os.Stderr, "Entering the bootloader")
+				bootloaderName, err = s.enterBootloader()
+			} else {
+				fmt.Fprintf(os.Stderr, "Sending %s: init packet %d bytes, firmware %d bytes, CRC 0x%08x\n",
+					img.Type, len(img.InitPacket), len(img.Firmware), crc32.ChecksumIEEE(img.Firmware))
+				err = s.transfer(img, chunkSize, prn, resume)
+			}
+			if err == errConnectionLost && !resume {
+				return fmt.Errorf("%v, not resuming", err)
+			}
+			return err
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error upgrading firmware \n\t", err)
+			return status
+		}
+
+		// The bootloader advertises without the manufacturer data of the application
+		if len(bootloaderName) != 0 {
+			macIDArg, name = "", bootloaderName
+			fmt.Fprintln(os.Stderr, "Connecting to the bootloader as", name)
+			continue
+		}
+		idx++
+	}
+
+	fmt.Println("Upgrade complete")
+	return exitOK
+}
+
+// sdfuObject represents the data received of an object type by the emulated bootloader
+type sdfuObject struct {
+	maxSize  int
+	data     []byte
+	executed int
+	size     int
+}
+
+// SDFUTarget emulates the object transfer of a Nordic Secure DFU bootloader, so the dfu
+// command can be run against the emulator. It stores the init packet and firmware it
+// receives, without validating or activating them.
+type SDFUTarget struct {
+	mu        sync.Mutex
+	prn       int
+	packets   int
+	selected  *sdfuObject
+	objects   map[byte]*sdfuObject
+	initCRC   uint32
+	responses chan []byte
+}
+
+// sdfuNewTarget creates an emulated bootloader
+func sdfuNewTarget() *SDFUTarget {
+	return &SDFUTarget{
+		objects: map[byte]*sdfuObject{
+			sdfuObjCommand: {maxSize: 256},
+			sdfuObjData:    {maxSize: 4096},
+		},
+		responses: make(chan []byte, 16),
+	}
+}
+
+// sdfuAddService adds the Secure DFU service to a device spec
+func sdfuAddService(dev *XMLDevice) {
+	dev.ServiceList = append(dev.ServiceList, XMLService{
+		ServiceName: "Secure DFU",
+		ServiceID:   sdfuServiceID,
+		CharList: []XMLCharacteristic{
+			{CharName: "DFU Control Point", CharID: sdfuControlPointID,
+				Properties: XMLCharProperties{Write: mandatory, Notify: mandatory}},
+			{CharName: "DFU Packet", CharID: sdfuPacketID,
+				Properties: XMLCharProperties{WriteWithoutResponse: mandatory}},
+		},
+	})
+	dev.numServices++
+}
+
+// respond queues a response of the DFU Control Point, dropping it when nobody is subscribed
+func (t *SDFUTarget) respond(op byte, result byte, params ...uint32) {
+	rsp := []byte{sdfuOpResponse, op, result}
+	for _, param := range params {
+		rsp = append(rsp, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(rsp[len(rsp)-4:], param)
+	}
+	select {
+	case t.responses <- rsp:
+	default:
+	}
+}
+
+// checksum returns the offset and CRC of the data of an object type
+func (o *sdfuObject) checksum() (uint32, uint32) {
+	return uint32(len(o.data)), crc32.ChecksumIEEE(o.data)
+}
+
+// Control handles a write of the DFU Control Point, returning the ATT status of the write
+func (t *SDFUTarget) Control(cmd []byte) byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(cmd) == 0 {
+		return gatt.StatusUnexpectedError
+	}
+	op := cmd[0]
+	switch op {
+	case sdfuOpSelect, sdfuOpCreate:
+		if len(cmd) < 2 || (op == sdfuOpCreate && len(cmd) < 6) {
+			t.respond(op, sdfuResInvalidParam)
+			break
+		}
+		o, ok := t.objects[cmd[1]]
+		if !ok {
+			t.respond(op, sdfuResBadType)
+			break
+		}
+		if op == sdfuOpSelect {
+			t.selected = o
+			offset, crc := o.checksum()
+			t.respond(op, sdfuResSuccess, uint32(o.maxSize), offset, crc)
+			break
+		}
+		size := int(binary.LittleEndian.Uint32(cmd[2:]))
+		if size == 0 || size > o.maxSize {
+			t.respond(op, sdfuResNoResources)
+			break
+		}
+		if cmd[1] == sdfuObjCommand {
+			o.data, o.executed = nil, 0
+		} else {
+			o.data = o.data[:o.executed]
+		}
+		o.size = size
+		t.selected, t.packets = o, 0
+		emuLog("DFU", "create object", cmd[1], "of", size, "bytes")
+		t.respond(op, sdfuResSuccess)
+	case sdfuOpSetPRN:
+		if len(cmd) < 3 {
+			t.respond(op, sdfuResInvalidParam)
+			break
+		}
+		// Packets are counted for notifications from when the PRN is set, as on resume
+		t.prn, t.packets = int(binary.LittleEndian.Uint16(cmd[1:])), 0
+		t.respond(op, sdfuResSuccess)
+	case sdfuOpChecksum:
+		if t.selected == nil {
+			t.respond(op, sdfuResNotPermitted)
+			break
+		}
+		offset, crc := t.selected.checksum()
+		t.respond(op, sdfuResSuccess, offset, crc)
+	case sdfuOpExecute:
+		o := t.selected
+		if o == nil || len(o.data) != o.executed && len(o.data) != o.executed+o.size {
+			t.respond(op, sdfuResNotPermitted)
+			break
+		}
+		o.executed = len(o.data)
+		offset, crc := o.checksum()
+		if o == t.objects[sdfuObjCommand] {
+			// A new init packet invalidates the firmware received for another one
+			if crc != t.initCRC {
+				data := t.objects[sdfuObjData]
+				data.data, data.executed = nil, 0
+			}
+			t.initCRC = crc
+			emuLog("DFU", fmt.Sprintf("init packet executed, %d bytes, CRC 0x%08x", offset, crc))
+		} else {
+			emuLog("DFU", fmt.Sprintf("firmware executed up to %d bytes, CRC 0x%08x", offset, crc))
+		}
+		t.respond(op, sdfuResSuccess)
+	default:
+		t.respond(op, sdfuResNotSupported)
+	}
+	return gatt.StatusSuccess
+}
+
+// Packet handles a write of the DFU Packet, notifying the checksum every PRN packets
+func (t *SDFUTarget) Packet(data []byte) byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	o := t.selected
+	if o == nil || len(o.data)+len(data) > o.executed+o.size {
+		emuLog("DFU", "dropped", len(data), "bytes beyond the object")
+		return gatt.StatusSuccess
+	}
+	o.data = append(o.data, data...)
+	t.packets++
+	if t.prn > 0 && t.packets%t.prn == 0 {
+		offset, crc := o.checksum()
+		t.respond(sdfuOpChecksum, sdfuResSuccess, offset, crc)
+	}
+	return gatt.StatusSuccess
+}
+
+// Subscribe sends the responses of the DFU Control Point to the notifier, until the central
+// unsubscribes
+func (t *SDFUTarget) Subscribe(n gatt.Notifier) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for !n.Done() {
+		select {
+		case rsp := <-t.responses:
+			if _, err := n.Write(rsp); err != nil {
+				// Leave the response to the next subscriber
+				select {
+				case t.responses <- rsp:
+				default:
+				}
+				emuLog("DFU", "notify failed, err:", err)
+				return
+			}
+		case <-ticker.C:
+		}
+	}
+}
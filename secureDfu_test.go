@@ -0,0 +1,250 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/currantlabs/gatt"
+)
+
+// sdfuTestServe serves an emulated Secure DFU bootloader over the local transport
+func sdfuTestServe(t *testing.T, mtu int) (*SDFUTarget, *emuLocalTransport) {
+	dev := &XMLDevice{DeviceName: sdfuBootloaderName}
+	sdfuAddService(dev)
+	emu, err := emuNewEmulator(dev, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emu.dfu = sdfuNewTarget()
+	transport := emuNewLocalTransport(mtu)
+	if err := transport.Serve(emu); err != nil {
+		t.Fatal(err)
+	}
+	return emu.dfu, transport
+}
+
+// sdfuTestImage returns an application image of random data
+func sdfuTestImage(initSize int, firmwareSize int) SDFUImage {
+	r := rand.New(rand.NewSource(int64(firmwareSize)))
+	img := SDFUImage{Type: "application", InitPacket: make([]byte, initSize), Firmware: make([]byte, firmwareSize)}
+	r.Read(img.InitPacket)
+	r.Read(img.Firmware)
+	return img
+}
+
+// sdfuTestCheckTarget checks the emulated bootloader executed the whole image
+func sdfuTestCheckTarget(t *testing.T, target *SDFUTarget, img *SDFUImage) {
+	target.mu.Lock()
+	defer target.mu.Unlock()
+	if init := target.objects[sdfuObjCommand]; !bytes.Equal(init.data, img.InitPacket) {
+		t.Errorf("bootloader holds an init packet of %d bytes, expected %d", len(init.data), len(img.InitPacket))
+	}
+	fw := target.objects[sdfuObjData]
+	if !bytes.Equal(fw.data, img.Firmware) || fw.executed != len(img.Firmware) {
+		t.Errorf("bootloader executed %d of %d bytes of firmware, expected %d", fw.executed, len(fw.data),
+			len(img.Firmware))
+	}
+}
+
+// sdfuTestPeripheral intercepts the requests of a Secure DFU session to count the objects
+// created and the checksums notified, and to corrupt a packet or drop the connection at a
+// packet, counting the packets from 1 over all connections
+type sdfuTestPeripheral struct {
+	gatt.Peripheral
+	mu           sync.Mutex
+	packets      int
+	corruptAt    int
+	disconnectAt int
+	creates      map[byte]int
+	checksums    int
+}
+
+func (p *sdfuTestPeripheral) WriteCharacteristic(c *gatt.Characteristic, b []byte, noRsp bool) error {
+	switch xmlNormalizeUUID(c.UUID().String()) {
+	case sdfuPacketID:
+		p.packets++
+		if p.packets == p.disconnectAt {
+			p.Peripheral.(*emuLocalPeripheral).Disconnect()
+		}
+		if p.packets == p.corruptAt {
+			b = append([]byte{^b[0]}, b[1:]...)
+		}
+	case sdfuControlPointID:
+		if b[0] == sdfuOpCreate {
+			p.creates[b[1]]++
+		}
+	}
+	return p.Peripheral.WriteCharacteristic(c, b, noRsp)
+}
+
+func (p *sdfuTestPeripheral) SetNotifyValue(c *gatt.Characteristic, f func(*gatt.Characteristic, []byte, error)) error {
+	if f == nil {
+		return p.Peripheral.SetNotifyValue(c, nil)
+	}
+	return p.Peripheral.SetNotifyValue(c, func(c *gatt.Characteristic, b []byte, err error) {
+		if len(b) >= 3 && b[0] == sdfuOpResponse && b[1] == sdfuOpChecksum {
+			p.mu.Lock()
+			p.checksums++
+			p.mu.Unlock()
+		}
+		f(c, b, err)
+	})
+}
+
+// connect connects to the emulated bootloader through the test peripheral
+func (p *sdfuTestPeripheral) connect(transport *emuLocalTransport) bleConnectFunc {
+	return func(macIDArg string, name string, handler func(p gatt.Peripheral, lost <-chan struct{}) error) error {
+		return transport.ConnectDevice(macIDArg, name, func(lp gatt.Peripheral, lost <-chan struct{}) error {
+			p.Peripheral = lp
+			return handler(p, lost)
+		})
+	}
+}
+
+// sdfuTestSession connects to the emulated bootloader through the test peripheral and
+// starts a session, returning the chunk size of the MTU
+func sdfuTestSession(t *testing.T, transport *emuLocalTransport, p *sdfuTestPeripheral, mtu int) (*SDFUSession, int) {
+	lp, lost := transport.Connect()
+	p.Peripheral = lp
+	chunkSize := bleSetMTU(p, mtu)
+	s, err := sdfuDiscover(p, lost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, chunkSize
+}
+
+func TestSDFUTransferPRN(t *testing.T) {
+	target, transport := sdfuTestServe(t, 64)
+	img := sdfuTestImage(100, 10000)
+	p := &sdfuTestPeripheral{creates: make(map[byte]int)}
+	s, chunkSize := sdfuTestSession(t, transport, p, 247)
+	defer s.close()
+
+	if chunkSize != 61 {
+		t.Fatalf("chunks of %d bytes with an MTU of 64, expected 61", chunkSize)
+	}
+	prn := 4
+	if err := s.transfer(&img, chunkSize, prn, true); err != nil {
+		t.Fatal(err)
+	}
+	sdfuTestCheckTarget(t, target, &img)
+
+	// A checksum every prn packets of an object, and one once it is sent
+	sizes := []int{len(img.InitPacket)}
+	for offset := 0; offset < len(img.Firmware); offset += 4096 {
+		if len(img.Firmware)-offset < 4096 {
+			sizes = append(sizes, len(img.Firmware)-offset)
+		} else {
+			sizes = append(sizes, 4096)
+		}
+	}
+	expected := 0
+	for _, size := range sizes {
+		expected += (size+chunkSize-1)/chunkSize/prn + 1
+	}
+	if p.checksums != expected {
+		t.Errorf("received %d checksums, expected %d", p.checksums, expected)
+	}
+	if p.creates[sdfuObjCommand] != 1 || p.creates[sdfuObjData] != len(sizes)-1 {
+		t.Errorf("created %d command and %d data objects, expected 1 and %d", p.creates[sdfuObjCommand],
+			p.creates[sdfuObjData], len(sizes)-1)
+	}
+}
+
+func TestSDFUChecksumMismatch(t *testing.T) {
+	for _, prn := range []int{0, 4} {
+		target, transport := sdfuTestServe(t, 23)
+		img := sdfuTestImage(100, 10000)
+		// The 10th packet of the second data object, of 4096 / 20 packets each
+		p := &sdfuTestPeripheral{creates: make(map[byte]int), corruptAt: 5 + 205 + 10}
+		s, chunkSize := sdfuTestSession(t, transport, p, 23)
+
+		if err := s.transfer(&img, chunkSize, prn, true); err != nil {
+			t.Fatalf("PRN %d: %v", prn, err)
+		}
+		s.close()
+		sdfuTestCheckTarget(t, target, &img)
+		if p.creates[sdfuObjData] != 4 {
+			t.Errorf("PRN %d: created %d data objects, expected 3 and a retry", prn, p.creates[sdfuObjData])
+		}
+		if prn != 0 && p.packets >= 5+3*205+105 {
+			t.Errorf("PRN %d: sent %d packets, the mismatch was not caught before the end of the object",
+				prn, p.packets)
+		}
+	}
+}
+
+func TestSDFUResume(t *testing.T) {
+	target, transport := sdfuTestServe(t, 64)
+	img := sdfuTestImage(100, 10000)
+	// The 30th packet of the second data object, of 4096 / 61 packets each
+	p := &sdfuTestPeripheral{creates: make(map[byte]int), disconnectAt: 2 + 68 + 30}
+
+	status := sdfuUpgradeImages(p.connect(transport), "", sdfuBootloaderName, []SDFUImage{img}, true, 64, 4)
+	if status != exitOK {
+		t.Fatalf("upgrade failed with status %d", status)
+	}
+	sdfuTestCheckTarget(t, target, &img)
+
+	// The init packet is kept, and the second data object completed rather than sent again
+	if p.creates[sdfuObjCommand] != 1 || p.creates[sdfuObjData] != 3 {
+		t.Errorf("created %d command and %d data objects, expected 1 and 3", p.creates[sdfuObjCommand],
+			p.creates[sdfuObjData])
+	}
+}
+
+func TestSDFUNoResume(t *testing.T) {
+	_, transport := sdfuTestServe(t, 64)
+	img := sdfuTestImage(100, 10000)
+	p := &sdfuTestPeripheral{creates: make(map[byte]int), disconnectAt: 100}
+
+	status := sdfuUpgradeImages(p.connect(transport), "", sdfuBootloaderName, []SDFUImage{img}, false, 64, 4)
+	if status != exitUpgradeFailed {
+		t.Errorf("upgrade returned status %d after a disconnect, expected %d", status, exitUpgradeFailed)
+	}
+}
+
+func TestSDFULoadPackage(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "package.zip")
+	f, err := os.Create(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := zip.NewWriter(f)
+	files := map[string]string{
+		"manifest.json": `{"manifest": {
+			"application": {"bin_file": "app.bin", "dat_file": "app.dat"},
+			"softdevice": {"bin_file": "sd.bin", "dat_file": "sd.dat"}}}`,
+		"app.bin": "application", "app.dat": "app init",
+		"sd.bin": "softdevice", "sd.dat": "sd init",
+	}
+	for name, content := range files {
+		fw, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(content))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	images, err := sdfuLoadPackage(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 || images[0].Type != "softdevice" || images[1].Type != "application" {
+		t.Fatalf("loaded %+v, expected the softdevice then the application", images)
+	}
+	if string(images[1].Firmware) != "application" || string(images[1].InitPacket) != "app init" {
+		t.Errorf("loaded application %q with init packet %q", images[1].Firmware, images[1].InitPacket)
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/currantlabs/gatt"
+	"github.com/peterh/liner"
+)
+
+// shellCommands are the commands of the shell, with their usage
+var shellCommands = []struct {
+	name  string
+	usage string
+}{
+	{"ls", "ls                              list services and characteristics"},
+	{"read", "read CHAR                       read a characteristic"},
+	{"write", "write [-nr] CHAR VALUE [ENC]    write a characteristic, without response with -nr"},
+	{"sub", "sub CHAR                        subscribe to notifications or indications"},
+	{"unsub", "unsub CHAR                      unsubscribe from notifications or indications"},
+	{"desc", "desc CHAR                       list and read the descriptors of a characteristic"},
+	{"rssi", "rssi                            read the RSSI of the connection"},
+	{"mtu", "mtu [SIZE]                      request an ATT MTU, showing the one agreed"},
+	{"disconnect", "disconnect                      unsubscribe from everything and disconnect"},
+	{"help", "help                            show this help"},
+}
+
+// ShellChar represents a characteristic discovered by the shell
+type ShellChar struct {
+	name string
+	c    *gatt.Characteristic
+}
+
+// Shell represents an interactive session with a connected device. The subscriptions and a
+// command entered as the connection was lost are kept for the next connection.
+type Shell struct {
+	p          gatt.Peripheral
+	spec       *XMLDevice
+	chars      []ShellChar
+	subscribed map[string]*gatt.Characteristic
+	pending    string
+}
+
+// shellHistoryFile returns the file the shell history is kept in
+func shellHistoryFile() string {
+	return filepath.Join(os.Getenv("HOME"), ".ble-tools_history")
+}
+
+// shellCharName returns the name of a characteristic from the spec, the gatt package
+// or the custom characteristics file, in that order
+func shellCharName(c *gatt.Characteristic, spec *XMLDevice, charUUIDNames map[string]string) string {
+	charID := xmlNormalizeUUID(c.UUID().String())
+	if spec != nil {
+		for _, s := range spec.ServiceList {
+			for _, sc := range s.CharList {
+				if xmlNormalizeUUID(sc.CharID) == charID && len(sc.CharName) != 0 {
+					return sc.CharName
+				}
+			}
+		}
+	}
+	if len(c.Name()) != 0 {
+		return c.Name()
+	}
+	return charUUIDNames[c.UUID().String()]
+}
+
+// discover discovers every service, characteristic and descriptor of the device
+func (sh *Shell) discover() error {
+	charUUIDNames, _ := csvReadFile(os.Stdout, "CustomCharacteristics.csv")
+
+	ss, err := sh.p.DiscoverServices(nil)
+	if err != nil {
+		return fmt.Errorf("failed to discover services: %v", err)
+	}
+
+	sh.chars = nil
+	for _, s := range ss {
+		cs, err := sh.p.DiscoverCharacteristics(nil, s)
+		if err != nil {
+			return fmt.Errorf("failed to discover characteristics: %v", err)
+		}
+		for _, c := range cs {
+			if _, err := sh.p.DiscoverDescriptors(nil, c); err != nil {
+				return fmt.Errorf("failed to discover descriptors: %v", err)
+			}
+			sh.chars = append(sh.chars, ShellChar{name: shellCharName(c, sh.spec, charUUIDNames), c: c})
+		}
+	}
+	return nil
+}
+
+// shellWordName turns a characteristic name into a single word for the command line
+func shellWordName(name string) string {
+	return strings.Replace(name, " ", "_", -1)
+}
+
+// findChar finds a characteristic by its index in ls, its UUID or its name
+func (sh *Shell) findChar(ref string) (*gatt.Characteristic, error) {
+	for _, sc := range sh.chars {
+		if xmlNormalizeUUID(sc.c.UUID().String()) == xmlNormalizeUUID(ref) ||
+			(len(sc.name) != 0 && strings.EqualFold(shellWordName(sc.name), ref)) {
+			return sc.c, nil
+		}
+	}
+	if idx, err := strconv.Atoi(ref); err == nil && idx >= 0 && idx < len(sh.chars) {
+		return sh.chars[idx].c, nil
+	}
+	return nil, fmt.Errorf("characteristic %s not found", ref)
+}
+
+// complete completes command names for the first word, and characteristic UUIDs
+// and names for the others
+func (sh *Shell) complete(line string, pos int) (string, []string, string) {
+	head, tail := line[:pos], line[pos:]
+	start := strings.LastIndex(head, " ") + 1
+	word := strings.ToLower(head[start:])
+
+	var candidates []string
+	if start == 0 {
+		for _, cmd := range shellCommands {
+			candidates = append(candidates, cmd.name)
+		}
+	} else {
+		for _, sc := range sh.chars {
+			candidates = append(candidates, sc.c.UUID().String())
+			if len(sc.name) != 0 {
+				candidates = append(candidates, shellWordName(sc.name))
+			}
+		}
+	}
+
+	var completions []string
+	for _, c := range candidates {
+		if strings.HasPrefix(strings.ToLower(c), word) {
+			completions = append(completions, c)
+		}
+	}
+	return head[:start], completions, tail
+}
+
+// list lists the discovered characteristics by service
+func (sh *Shell) list() {
+	var svc *gatt.Service
+	for idx, sc := range sh.chars {
+		if sc.c.Service() != svc {
+			svc = sc.c.Service()
+			fmt.Println("Service:", svc.UUID().String(), "("+svc.Name()+")")
+		}
+		fmt.Printf("  %2d %s (%s) %s\n", idx, sc.c.UUID().String(), sc.name, sc.c.Properties().String())
+	}
+}
+
+// value renders a value with its decoded fields when the spec has a format for it, or
+// the characteristic is a standard one
+func (sh *Shell) value(c *gatt.Characteristic, b []byte) string {
+	return formatDescribeChar(sh.spec, c.UUID().String(), b)
+}
+
+// subscribe subscribes to a characteristic, printing its notifications or indications
+func (sh *Shell) subscribe(c *gatt.Characteristic) error {
+	err := subSetValue(sh.p, c, func(c *gatt.Characteristic, b []byte, err error) {
+		if err == nil {
+			fmt.Println(time.Now().Format("15:04:05.000"), c.UUID().String(), sh.value(c, b))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	sh.subscribed[c.UUID().String()] = c
+	return nil
+}
+
+// resubscribe subscribes again to the characteristics subscribed to over the previous
+// connection, once the device is discovered again
+func (sh *Shell) resubscribe() {
+	previous := sh.subscribed
+	sh.subscribed = make(map[string]*gatt.Characteristic)
+	for uuid := range previous {
+		for _, sc := range sh.chars {
+			if sc.c.UUID().String() != uuid {
+				continue
+			}
+			if err := sh.subscribe(sc.c); err != nil {
+				fmt.Println("Failed to subscribe to", uuid, "again, err:", err)
+			} else {
+				fmt.Println("Subscribed to", uuid, "again")
+			}
+			break
+		}
+	}
+}
+
+// run runs a single shell command, returning false when the shell should end
+func (sh *Shell) run(args []string) bool {
+	if len(args) == 0 {
+		return true
+	}
+
+	needChar := func() *gatt.Characteristic {
+		if len(args) < 2 {
+			fmt.Println("Please enter a characteristic")
+			return nil
+		}
+		c, err := sh.findChar(args[1])
+		if err != nil {
+			fmt.Println(err)
+			return nil
+		}
+		return c
+	}
+
+	switch args[0] {
+	case "ls":
+		sh.list()
+
+	case "read":
+		if c := needChar(); c != nil {
+			b, err := bleReadValue(sh.p, c)
+			if err != nil {
+				fmt.Println("Failed to read value, err:", err)
+				return true
+			}
+			fmt.Println(sh.value(c, b))
+		}
+
+	case "write":
+		noRsp := len(args) > 1 && args[1] == "-nr"
+		if noRsp {
+			args = args[1:]
+		}
+		c := needChar()
+		if c == nil {
+			return true
+		}
+		if len(args) < 3 {
+			fmt.Println("Please enter a value")
+			return true
+		}
+		encoding := "hex"
+		if len(args) > 3 {
+			encoding = args[3]
+		}
+		value, err := charEncodeValue(args[2], encoding, false, xmlFindCharFormat(sh.spec, c.UUID().String()))
+		if err != nil {
+			fmt.Println("Invalid value, err:", err)
+			return true
+		}
+		if err := sh.p.WriteCharacteristic(c, value, noRsp); err != nil {
+			fmt.Println("Failed to write value, ATT error:", err)
+			return true
+		}
+		fmt.Printf("Wrote %x\n", value)
+
+	case "sub":
+		if c := needChar(); c != nil {
+			if (c.Properties() & (gatt.CharNotify | gatt.CharIndicate)) == 0 {
+				fmt.Println("Characteristic does not support notifications or indications")
+				return true
+			}
+			if err := sh.subscribe(c); err != nil {
+				fmt.Println("Failed to subscribe, err:", err)
+			}
+		}
+
+	case "unsub":
+		if c := needChar(); c != nil {
+			if err := subSetValue(sh.p, c, nil); err != nil {
+				fmt.Println("Failed to unsubscribe, err:", err)
+			}
+			delete(sh.subscribed, c.UUID().String())
+		}
+
+	case "desc":
+		if c := needChar(); c != nil {
+			for _, d := range c.Descriptors() {
+				b, err := sh.p.ReadDescriptor(d)
+				if err != nil {
+					fmt.Println("  Descriptor:", d.UUID().String(), "("+d.Name()+") read failed, err:", err)
+					continue
+				}
+				fmt.Printf("  Descriptor: %s (%s) %x\n", d.UUID().String(), d.Name(), b)
+			}
+		}
+
+	case "rssi":
+		if rssi := sh.p.ReadRSSI(); rssi == -1 {
+			fmt.Println("RSSI is not available on this platform")
+		} else {
+			fmt.Println("RSSI:", rssi)
+		}
+
+	case "mtu":
+		if len(args) >= 2 {
+			mtu, err := strconv.ParseUint(args[1], 10, 16)
+			if err != nil {
+				fmt.Println("Invalid MTU", args[1])
+				return true
+			}
+			if err := sh.p.SetMTU(uint16(mtu)); err != nil {
+				fmt.Println("Failed to set MTU, err:", err)
+			}
+		}
+		// The device may agree to less than requested
+		fmt.Println("MTU:", sh.p.MTU())
+
+	case "disconnect", "exit", "quit":
+		for _, c := range sh.subscribed {
+			subSetValue(sh.p, c, nil)
+		}
+		return false
+
+	case "help":
+		for _, cmd := range shellCommands {
+			fmt.Println(" ", cmd.usage)
+		}
+		fmt.Println("  CHAR is an index from ls, a UUID or a name, with spaces written as _")
+
+	default:
+		fmt.Println("Unknown command", args[0], "- enter help for a list of commands")
+	}
+	return true
+}
+
+// shellRunDevice connects to the specified device and runs an interactive shell on it
+// until disconnected. Lost connections are re-established.
+func shellRunDevice(macIDArg string, name string, specFile string) {
+	sh := &Shell{}
+	if len(specFile) != 0 {
+		var err error
+		if sh.spec, err = xmlLoadDevice(specFile); err != nil {
+			fmt.Println("Error reading file \n\t", err)
+			return
+		}
+	}
+
+	line := liner.NewLiner()
+	defer line.Close()
+	line.SetCtrlCAborts(true)
+	line.SetWordCompleter(func(l string, pos int) (string, []string, string) {
+		return sh.complete(l, pos)
+	})
+
+	if f, err := os.Open(shellHistoryFile()); err == nil {
+		line.ReadHistory(f)
+		f.Close()
+	}
+	defer func() {
+		if f, err := os.Create(shellHistoryFile()); err == nil {
+			line.WriteHistory(f)
+			f.Close()
+		}
+	}()
+
+	sh.subscribed = make(map[string]*gatt.Characteristic)
+	err := bleConnectDevice(macIDArg, name, func(p gatt.Peripheral, lost <-chan struct{}) error {
+		sh.p = p
+		if err := sh.discover(); err != nil {
+			return err
+		}
+		fmt.Println("Connected to", name, "- enter help for a list of commands")
+		sh.resubscribe()
+
+		for {
+			// The command entered as the connection was lost runs once reconnected
+			input := sh.pending
+			sh.pending = ""
+			if len(input) != 0 {
+				fmt.Println(name+">", input)
+			} else {
+				var err error
+				input, err = line.Prompt(name + "> ")
+				if err == liner.ErrPromptAborted || err == io.EOF {
+					input = "disconnect"
+				} else if err != nil {
+					return err
+				}
+				if len(strings.TrimSpace(input)) != 0 {
+					line.AppendHistory(input)
+				}
+			}
+
+			args := strings.Fields(input)
+			select {
+			case <-lost:
+				if len(args) != 0 && cmdIsOneOf(args[0], []string{"disconnect", "exit", "quit"}) {
+					return nil
+				}
+				fmt.Println("Connection lost, reconnecting to run", input)
+				sh.pending = strings.Join(args, " ")
+				return errConnectionLost
+			default:
+			}
+
+			if sh.run(args) == false {
+				return nil
+			}
+		}
+	})
+
+	if err != nil {
+		fmt.Println("Error running shell \n\t", err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/currantlabs/gatt"
+)
+
+func TestShellResubscribe(t *testing.T) {
+	dev := &XMLDevice{DeviceName: "LY01", ServiceList: []XMLService{{ServiceName: "Battery", ServiceID: "180f",
+		CharList: []XMLCharacteristic{
+			{CharName: "Battery Level", CharID: "2a19", Properties: XMLCharProperties{Read: mandatory,
+				Notify: mandatory}}}}}}
+	emu, err := emuNewEmulator(dev, map[string]string{"2a19": "39"}, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := emuNewLocalTransport(23)
+	if err := transport.Serve(emu); err != nil {
+		t.Fatal(err)
+	}
+
+	sh := &Shell{subscribed: make(map[string]*gatt.Characteristic)}
+	for idx := 0; idx < 2; idx++ {
+		lp, _ := transport.Connect()
+		sh.p = lp
+		if err := sh.discover(); err != nil {
+			t.Fatal(err)
+		}
+		if idx == 0 {
+			sh.run([]string{"sub", "2a19"})
+			lp.Disconnect()
+			continue
+		}
+		sh.resubscribe()
+	}
+
+	c, ok := sh.subscribed["2a19"]
+	if !ok || len(sh.subscribed) != 1 {
+		t.Fatalf("subscribed to %v after reconnecting", sh.subscribed)
+	}
+	if c != sh.chars[0].c {
+		t.Error("subscribed to the characteristic of the previous connection")
+	}
+	sh.run([]string{"disconnect"})
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// sigDecoders are the decoders of standard SIG characteristics, by normalized UUID
+var sigDecoders = map[string]DecoderFunc{
+	"2a00": sigDecodeString("Device Name"),
+	"2a01": sigDecodeAppearance,
+	"2a04": sigDecodeConnParams,
+	"2a05": sigDecodeServiceChanged,
+	"2a07": sigDecodeTxPower,
+	"2a08": sigDecodeDateTime,
+	"2a19": sigDecodeBatteryLevel,
+	"2a1c": sigDecodeTemperatureMeasurement,
+	"2a1d": sigDecodeTemperatureType,
+	"2a23": sigDecodeSystemID,
+	"2a24": sigDecodeString("Model Number"),
+	"2a25": sigDecodeString("Serial Number"),
+	"2a26": sigDecodeString("Firmware Revision"),
+	"2a27": sigDecodeString("Hardware Revision"),
+	"2a28": sigDecodeString("Software Revision"),
+	"2a29": sigDecodeString("Manufacturer Name"),
+	"2a2b": sigDecodeCurrentTime,
+	"2a37": sigDecodeHeartRateMeasurement,
+	"2a38": sigDecodeBodySensorLocation,
+	"2a50": sigDecodePnPID,
+	"2a6d": sigDecodeScaled("Pressure", 4, false, 0.1, "Pa"),
+	"2a6e": sigDecodeScaled("Temperature", 2, true, 0.01, "C"),
+	"2a6f": sigDecodeScaled("Humidity", 2, false, 0.01, "%"),
+}
+
+// sigAppearanceCategories are the names of the appearance categories
+var sigAppearanceCategories = map[uint64]string{
+	0: "Unknown", 1: "Phone", 2: "Computer", 3: "Watch", 4: "Clock", 5: "Display",
+	6: "Remote Control", 7: "Eye-glasses", 8: "Tag", 9: "Keyring", 10: "Media Player",
+	11: "Barcode Scanner", 12: "Thermometer", 13: "Heart Rate Sensor", 14: "Blood Pressure",
+	15: "Human Interface Device", 16: "Glucose Meter", 17: "Running Walking Sensor", 18: "Cycling",
+	49: "Pulse Oximeter", 50: "Weight Scale", 51: "Personal Mobility Device",
+	52: "Continuous Glucose Monitor", 53: "Insulin Pump", 54: "Medication Delivery",
+	81: "Outdoor Sports Activity",
+}
+
+// sigTemperatureTypes are the names of the temperature measurement locations
+var sigTemperatureTypes = map[uint64]string{
+	1: "Armpit", 2: "Body", 3: "Ear", 4: "Finger", 5: "Gastro-intestinal Tract",
+	6: "Mouth", 7: "Rectum", 8: "Toe", 9: "Tympanum",
+}
+
+// sigBodySensorLocations are the names of the heart rate sensor locations
+var sigBodySensorLocations = map[uint64]string{
+	0: "Other", 1: "Chest", 2: "Wrist", 3: "Finger", 4: "Hand", 5: "Ear Lobe", 6: "Foot",
+}
+
+// sigDaysOfWeek are the names of the days of the week, 0 being unknown
+var sigDaysOfWeek = []string{"Unknown", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday",
+	"Saturday", "Sunday"}
+
+// sigAdjustReasons are the names of the bits of the current time adjust reason
+var sigAdjustReasons = []string{"Manual", "External Reference", "Time Zone", "DST"}
+
+// sigReader reads the little endian fields of a value in order, keeping the first error
+type sigReader struct {
+	b   []byte
+	err error
+}
+
+// next reads the bytes of the next field
+func (r *sigReader) next(size int, name string) []byte {
+	if r.err == nil && len(r.b) < size {
+		r.err = fmt.Errorf("value too short for field %s", name)
+	}
+	if r.err != nil {
+		return make([]byte, size)
+	}
+	b := r.b[:size]
+	r.b = r.b[size:]
+	return b
+}
+
+// uint reads an unsigned integer field
+func (r *sigReader) uint(size int, name string) uint64 {
+	return formatGetUint(r.next(size, name), false)
+}
+
+// int reads a signed integer field
+func (r *sigReader) int(size int, name string) int64 {
+	return formatSignExtend(r.uint(size, name), size)
+}
+
+// dateTime reads a date time field as year, month, day, hours, minutes and seconds
+func (r *sigReader) dateTime(name string) string {
+	year := r.uint(2, name)
+	b := r.next(5, name)
+	return fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d", year, b[0], b[1], b[2], b[3], b[4])
+}
+
+// done returns the first error, or an error if bytes are left over
+func (r *sigReader) done() error {
+	if r.err == nil && len(r.b) != 0 {
+		return fmt.Errorf("%d unexpected trailing bytes", len(r.b))
+	}
+	return r.err
+}
+
+// sigNumber renders a number with its unit
+func sigNumber(value float64, unit string) string {
+	return strconv.FormatFloat(value, 'f', -1, 64) + " " + unit
+}
+
+// sigName renders a value with its name, if it has one
+func sigName(names map[uint64]string, value uint64) string {
+	if name, ok := names[value]; ok {
+		return name
+	}
+	return strconv.FormatUint(value, 10)
+}
+
+// sigDecodeString returns a decoder of a UTF-8 string characteristic
+func sigDecodeString(name string) DecoderFunc {
+	return func(b []byte) ([]string, error) {
+		if !utf8.Valid(b) {
+			return nil, fmt.Errorf("%s is not a UTF-8 string", name)
+		}
+		return []string{name + "=" + strconv.Quote(string(b))}, nil
+	}
+}
+
+// sigDecodeScaled returns a decoder of a characteristic made of a single scaled integer
+func sigDecodeScaled(name string, size int, signed bool, multiplier float64, unit string) DecoderFunc {
+	return func(b []byte) ([]string, error) {
+		r := &sigReader{b: b}
+		u := r.uint(size, name)
+		raw := float64(u)
+		if signed {
+			raw = float64(formatSignExtend(u, size))
+		}
+		return []string{name + "=" + sigNumber(raw*multiplier, unit)}, r.done()
+	}
+}
+
+// sigDecodeBatteryLevel decodes the Battery Level characteristic
+func sigDecodeBatteryLevel(b []byte) ([]string, error) {
+	r := &sigReader{b: b}
+	level := r.uint(1, "Level")
+	return []string{"Level=" + strconv.FormatUint(level, 10) + " %"}, r.done()
+}
+
+// sigDecodeAppearance decodes the Appearance characteristic into its category and subcategory
+func sigDecodeAppearance(b []byte) ([]string, error) {
+	r := &sigReader{b: b}
+	appearance := r.uint(2, "Appearance")
+	return []string{
+		"Category=" + sigName(sigAppearanceCategories, appearance>>6),
+		"Subcategory=" + strconv.FormatUint(appearance&0x3f, 10),
+	}, r.done()
+}
+
+// sigDecodeConnParams decodes the Peripheral Preferred Connection Parameters characteristic
+func sigDecodeConnParams(b []byte) ([]string, error) {
+	r := &sigReader{b: b}
+	minInterval := r.uint(2, "Minimum Interval")
+	maxInterval := r.uint(2, "Maximum Interval")
+	latency := r.uint(2, "Slave Latency")
+	timeout := r.uint(2, "Supervision Timeout")
+	return []string{
+		"Minimum Interval=" + sigNumber(float64(minInterval)*1.25, "ms"),
+		"Maximum Interval=" + sigNumber(float64(maxInterval)*1.25, "ms"),
+		"Slave Latency=" + strconv.FormatUint(latency, 10),
+		"Supervision Timeout=" + sigNumber(float64(timeout)*10, "ms"),
+	}, r.done()
+}
+
+// sigDecodeServiceChanged decodes the Service Changed characteristic
+func sigDecodeServiceChanged(b []byte) ([]string, error) {
+	r := &sigReader{b: b}
+	start := r.uint(2, "Start Handle")
+	end := r.uint(2, "End Handle")
+	return []string{fmt.Sprintf("Start Handle=0x%04x", start), fmt.Sprintf("End Handle=0x%04x", end)}, r.done()
+}
+
+// sigDecodeTxPower decodes the Tx Power Level characteristic
+func sigDecodeTxPower(b []byte) ([]string, error) {
+	r := &sigReader{b: b}
+	level := r.int(1, "Tx Power Level")
+	return []string{"Tx Power Level=" + strconv.FormatInt(level, 10) + " dBm"}, r.done()
+}
+
+// sigDecodeDateTime decodes the Date Time characteristic
+func sigDecodeDateTime(b []byte) ([]string, error) {
+	r := &sigReader{b: b}
+	dateTime := r.dateTime("Date Time")
+	return []string{"Date Time=" + dateTime}, r.done()
+}
+
+// sigDecodeCurrentTime decodes the Current Time characteristic
+func sigDecodeCurrentTime(b []byte) ([]string, error) {
+	r := &sigReader{b: b}
+	dateTime := r.dateTime("Date Time")
+	dayOfWeek := r.uint(1, "Day of Week")
+	fractions := r.uint(1, "Fractions256")
+	reason := r.uint(1, "Adjust Reason")
+
+	day := strconv.FormatUint(dayOfWeek, 10)
+	if dayOfWeek < uint64(len(sigDaysOfWeek)) {
+		day = sigDaysOfWeek[dayOfWeek]
+	}
+	var reasons []string
+	for bit, name := range sigAdjustReasons {
+		if reason&(1<<uint(bit)) != 0 {
+			reasons = append(reasons, name)
+		}
+	}
+	if len(reasons) == 0 {
+		reasons = append(reasons, "none")
+	}
+
+	return []string{
+		"Date Time=" + dateTime,
+		"Day of Week=" + day,
+		"Fractions=" + strconv.FormatUint(fractions, 10) + "/256",
+		"Adjust Reason=" + strings.Join(reasons, "|"),
+	}, r.done()
+}
+
+// sigDecodeTemperatureMeasurement decodes the Temperature Measurement characteristic,
+// whose flags give the unit and which of the optional fields are present
+func sigDecodeTemperatureMeasurement(b []byte) ([]string, error) {
+	r := &sigReader{b: b}
+	flags := r.uint(1, "Flags")
+
+	unit := "C"
+	if flags&0x01 != 0 {
+		unit = "F"
+	}
+	fields := []string{"Temperature=" + sigNumber(formatIEEE11073(r.uint(4, "Temperature"), 4), unit)}
+	if flags&0x02 != 0 {
+		fields = append(fields, "Time Stamp="+r.dateTime("Time Stamp"))
+	}
+	if flags&0x04 != 0 {
+		fields = append(fields, "Type="+sigName(sigTemperatureTypes, r.uint(1, "Temperature Type")))
+	}
+	return fields, r.done()
+}
+
+// sigDecodeTemperatureType decodes the Temperature Type characteristic
+func sigDecodeTemperatureType(b []byte) ([]string, error) {
+	r := &sigReader{b: b}
+	tempType := r.uint(1, "Type")
+	return []string{"Type=" + sigName(sigTemperatureTypes, tempType)}, r.done()
+}
+
+// sigDecodeHeartRateMeasurement decodes the Heart Rate Measurement characteristic, whose
+// flags give the size of the heart rate, the sensor contact status, and which of the
+// optional fields are present
+func sigDecodeHeartRateMeasurement(b []byte) ([]string, error) {
+	r := &sigReader{b: b}
+	flags := r.uint(1, "Flags")
+
+	size := 1
+	if flags&0x01 != 0 {
+		size = 2
+	}
+	fields := []string{"Heart Rate=" + strconv.FormatUint(r.uint(size, "Heart Rate"), 10) + " bpm"}
+
+	switch (flags >> 1) & 0x03 {
+	case 2:
+		fields = append(fields, "Sensor Contact=not detected")
+	case 3:
+		fields = append(fields, "Sensor Contact=detected")
+	}
+	if flags&0x08 != 0 {
+		fields = append(fields, "Energy Expended="+strconv.FormatUint(r.uint(2, "Energy Expended"), 10)+" kJ")
+	}
+	if flags&0x10 != 0 {
+		for r.err == nil && len(r.b) != 0 {
+			rr := r.uint(2, "RR-Interval")
+			fields = append(fields, "RR-Interval="+sigNumber(float64(rr)/1024, "s"))
+		}
+	}
+	return fields, r.done()
+}
+
+// sigDecodeBodySensorLocation decodes the Body Sensor Location characteristic
+func sigDecodeBodySensorLocation(b []byte) ([]string, error) {
+	r := &sigReader{b: b}
+	location := r.uint(1, "Location")
+	return []string{"Location=" + sigName(sigBodySensorLocations, location)}, r.done()
+}
+
+// sigDecodeSystemID decodes the System ID characteristic into its manufacturer
+// identifier and organizationally unique identifier
+func sigDecodeSystemID(b []byte) ([]string, error) {
+	r := &sigReader{b: b}
+	manufacturer := r.uint(5, "Manufacturer Identifier")
+	oui := r.uint(3, "Organizationally Unique Identifier")
+	return []string{
+		fmt.Sprintf("Manufacturer Identifier=0x%010x", manufacturer),
+		fmt.Sprintf("OUI=0x%06x", oui),
+	}, r.done()
+}
+
+// sigDecodePnPID decodes the PnP ID characteristic
+func sigDecodePnPID(b []byte) ([]string, error) {
+	r := &sigReader{b: b}
+	source := r.uint(1, "Vendor ID Source")
+	vendor := r.uint(2, "Vendor ID")
+	product := r.uint(2, "Product ID")
+	version := r.uint(2, "Product Version")
+	return []string{
+		"Vendor ID Source=" + sigName(map[uint64]string{1: "Bluetooth SIG", 2: "USB"}, source),
+		fmt.Sprintf("Vendor ID=0x%04x", vendor),
+		fmt.Sprintf("Product ID=0x%04x", product),
+		fmt.Sprintf("Product Version=%d.%d.%d", version>>8, (version>>4)&0x0f, version&0x0f),
+	}, r.done()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestSigDecoders(t *testing.T) {
+	for _, test := range []struct {
+		uuid   string
+		value  string
+		fields string
+		err    string
+	}{
+		{"2a00", "4c593031", `Device Name="LY01"`, ""},
+		{"2a00", "ff", "", "Device Name is not a UTF-8 string"},
+		{"2a01", "c103", "Category=Human Interface Device|Subcategory=1", ""},
+		{"2a01", "4011", "Category=69|Subcategory=0", ""},
+		{"2a04", "06000c0000009001", "Minimum Interval=7.5 ms|Maximum Interval=15 ms|Slave Latency=0|" +
+			"Supervision Timeout=4000 ms", ""},
+		{"2a05", "0100ffff", "Start Handle=0x0001|End Handle=0xffff", ""},
+		{"2a07", "f8", "Tx Power Level=-8 dBm", ""},
+		{"2a08", "e207030f0c1e2d", "Date Time=2018-03-15 12:30:45", ""},
+		{"2a19", "64", "Level=100 %", ""},
+		{"2a19", "6400", "", "1 unexpected trailing bytes"},
+		{"2a19", "", "", "value too short for field Level"},
+		{"2a23", "0102030405060708", "Manufacturer Identifier=0x0504030201|OUI=0x080706", ""},
+		{"2a2b", "e207030f0c1e2d048003", "Date Time=2018-03-15 12:30:45|Day of Week=Thursday|" +
+			"Fractions=128/256|Adjust Reason=Manual|External Reference", ""},
+		{"2a2b", "e207030f0c1e2d090000", "Date Time=2018-03-15 12:30:45|Day of Week=9|" +
+			"Fractions=0/256|Adjust Reason=none", ""},
+		{"2a2b", "e207030f0c1e2d0480", "", "value too short for field Adjust Reason"},
+		{"2a38", "01", "Location=Chest", ""},
+		{"2a50", "010d0034122301", "Vendor ID Source=Bluetooth SIG|Vendor ID=0x000d|Product ID=0x1234|" +
+			"Product Version=1.2.3", ""},
+		{"2a6d", "40420f00", "Pressure=100000 Pa", ""},
+		{"2a6e", "3408", "Temperature=21 C", ""},
+		{"2a6e", "ccf7", "Temperature=-21 C", ""},
+		{"2a6f", "8813", "Humidity=50 %", ""},
+
+		// Temperature Measurement: unit, time stamp and type flags
+		{"2a1c", "006c0100ff", "Temperature=36.4 C", ""},
+		{"2a1c", "01da0300ff", "Temperature=98.6 F", ""},
+		{"2a1c", "026c0100ffe207030f0c1e2d", "Temperature=36.4 C|Time Stamp=2018-03-15 12:30:45", ""},
+		{"2a1c", "046c0100ff02", "Temperature=36.4 C|Type=Body", ""},
+		{"2a1c", "076c0100ffe207030f0c1e2d0a", "Temperature=36.4 F|Time Stamp=2018-03-15 12:30:45|Type=10", ""},
+		{"2a1c", "00ffff7f00", "Temperature=NaN C", ""},
+		{"2a1c", "006c01", "", "value too short for field Temperature"},
+		{"2a1c", "046c0100ff", "", "value too short for field Temperature Type"},
+		{"2a1c", "006c0100ff02", "", "1 unexpected trailing bytes"},
+
+		// Temperature Type
+		{"2a1d", "02", "Type=Body", ""},
+		{"2a1d", "09", "Type=Tympanum", ""},
+		{"2a1d", "0a", "Type=10", ""},
+		{"2a1d", "", "", "value too short for field Type"},
+
+		// Heart Rate Measurement: heart rate size, sensor contact, energy and RR-interval flags
+		{"2a37", "0048", "Heart Rate=72 bpm", ""},
+		{"2a37", "014801", "Heart Rate=328 bpm", ""},
+		{"2a37", "0248", "Heart Rate=72 bpm", ""},
+		{"2a37", "0448", "Heart Rate=72 bpm|Sensor Contact=not detected", ""},
+		{"2a37", "0648", "Heart Rate=72 bpm|Sensor Contact=detected", ""},
+		{"2a37", "08481000", "Heart Rate=72 bpm|Energy Expended=16 kJ", ""},
+		{"2a37", "1048", "Heart Rate=72 bpm", ""},
+		{"2a37", "104800040002", "Heart Rate=72 bpm|RR-Interval=1 s|RR-Interval=0.5 s", ""},
+		{"2a37", "1f480010000004", "Heart Rate=72 bpm|Sensor Contact=detected|Energy Expended=16 kJ|" +
+			"RR-Interval=1 s", ""},
+		{"2a37", "0148", "", "value too short for field Heart Rate"},
+		{"2a37", "0848", "", "value too short for field Energy Expended"},
+		{"2a37", "1048000400", "", "value too short for field RR-Interval"},
+		{"2a37", "004800", "", "1 unexpected trailing bytes"},
+	} {
+		b, err := hex.DecodeString(test.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields, err := sigDecoders[test.uuid](b)
+		if len(test.err) != 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: decoded %s with error %v, expected %q", test.uuid, test.value, err, test.err)
+			}
+			continue
+		}
+		if err != nil || strings.Join(fields, "|") != test.fields {
+			t.Errorf("%s: decoded %s as %q, %v, expected %q", test.uuid, test.value, fields, err, test.fields)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SIGCharacteristicRef represents a characteristic referenced from a SIG service definition
+type SIGCharacteristicRef struct {
+	CharName    string `xml:"name,attr"`
+	CharType    string `xml:"type,attr"`
+	Requirement string
+	Properties  XMLCharProperties
+}
+
+// SIGService represents a Bluetooth SIG GATT service definition (org.bluetooth.service.*.xml)
+type SIGService struct {
+	XMLName     xml.Name               `xml:"Service"`
+	ServiceName string                 `xml:"name,attr"`
+	ServiceType string                 `xml:"type,attr"`
+	ServiceID   string                 `xml:"uuid,attr"`
+	CharList    []SIGCharacteristicRef `xml:"Characteristics>Characteristic"`
+}
+
+// SIGCharacteristic represents a Bluetooth SIG GATT characteristic definition (org.bluetooth.characteristic.*.xml)
+type SIGCharacteristic struct {
+	XMLName  xml.Name   `xml:"Characteristic"`
+	CharName string     `xml:"name,attr"`
+	CharType string     `xml:"type,attr"`
+	CharID   string     `xml:"uuid,attr"`
+	Fields   []XMLField `xml:"Value>Field"`
+}
+
+// sigReadService parses a SIG service definition file
+func sigReadService(fileName string) (*SIGService, error) {
+	var svc SIGService
+
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if err := xml.Unmarshal(b, &svc); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return &svc, nil
+}
+
+// sigReadCharacteristic parses the SIG characteristic definition for the given type
+// from the characteristic directory
+func sigReadCharacteristic(charDir string, charType string) (*SIGCharacteristic, error) {
+	var char SIGCharacteristic
+
+	b, err := ioutil.ReadFile(filepath.Join(charDir, charType+".xml"))
+	if err != nil {
+		return nil, err
+	}
+	if err := xml.Unmarshal(b, &char); err != nil {
+		return nil, fmt.Errorf("%s: %v", charType, err)
+	}
+	for idx := range char.Fields {
+		char.Fields[idx].Unit = strings.TrimPrefix(char.Fields[idx].Unit, "org.bluetooth.unit.")
+	}
+	return &char, nil
+}
+
+// sigFormatTypes maps SIG field formats to value format field types. The bits of SIG bit
+// fields are not imported, so their values are shown as hex.
+var sigFormatTypes = map[string]string{
+	"boolean": "uint8", "uint8": "uint8", "uint16": "uint16", "uint24": "uint24",
+	"uint32": "uint32", "uint64": "uint64", "sint8": "int8", "sint16": "int16",
+	"sint24": "int24", "sint32": "int32", "sint64": "int64", "float32": "float32",
+	"float64": "float64", "SFLOAT": "sfloat", "FLOAT": "medfloat", "utf8s": "utf8",
+	"8bit": "bitfield", "16bit": "bitfield",
+}
+
+// sigFieldsFormat derives the value format of a characteristic from its SIG fields.
+// Values with optional or conditional fields have no fixed layout and get no format.
+func sigFieldsFormat(fields []XMLField) *XMLFormat {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	format := &XMLFormat{}
+	for _, field := range fields {
+		fieldType, ok := sigFormatTypes[field.Format]
+		if !ok || field.Requirement != mandatory {
+			return nil
+		}
+		f := XMLFormatField{Name: field.Name, Type: fieldType, Unit: field.Unit}
+		if field.Format == "16bit" {
+			f.Size = 2
+		}
+		if len(field.DecimalExponent) != 0 {
+			exponent, err := strconv.Atoi(field.DecimalExponent)
+			if err != nil {
+				return nil
+			}
+			f.Exponent = exponent
+		}
+		if field.Enumerations != nil {
+			for _, e := range field.Enumerations.Enumeration {
+				value, err := strconv.ParseInt(e.Key, 0, 64)
+				if err != nil {
+					continue
+				}
+				f.Enums = append(f.Enums, XMLFormatEnum{Value: value, Name: e.Value})
+			}
+		}
+		format.Fields = append(format.Fields, f)
+	}
+	return format
+}
+
+// sigImportService converts a SIG service definition into the XML spec model.
+// Characteristic definitions are looked up in charDir, or next to the service file
+// when charDir is empty.
+func sigImportService(fileName string, charDir string) (*XMLService, error) {
+	sigSvc, err := sigReadService(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if len(sigSvc.ServiceID) == 0 {
+		return nil, fmt.Errorf("%s: service has no uuid", fileName)
+	}
+	if len(charDir) == 0 {
+		charDir = filepath.Dir(fileName)
+	}
+
+	svc := &XMLService{
+		ServiceName: sigSvc.ServiceName,
+		ServiceID:   xmlNormalizeUUID(sigSvc.ServiceID),
+	}
+
+	for _, ref := range sigSvc.CharList {
+		sigChar, err := sigReadCharacteristic(charDir, ref.CharType)
+		if err != nil {
+			fmt.Println("Skipping characteristic", ref.CharName, "of", sigSvc.ServiceName, "\n\t", err)
+			continue
+		}
+
+		char := XMLCharacteristic{
+			CharName:    ref.CharName,
+			CharID:      xmlNormalizeUUID(sigChar.CharID),
+			Requirement: ref.Requirement,
+			Properties:  ref.Properties,
+			Fields:      sigChar.Fields,
+			Format:      sigFieldsFormat(sigChar.Fields),
+		}
+		svc.CharList = append(svc.CharList, char)
+	}
+	svc.numChars = len(svc.CharList)
+
+	return svc, nil
+}
+
+// sigImportServices converts the given SIG service definitions into the XML spec model
+func sigImportServices(fileNames []string, charDir string) ([]XMLService, error) {
+	var svcList []XMLService
+
+	for _, fileName := range fileNames {
+		svc, err := sigImportService(fileName, charDir)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("Imported service", svc.ServiceID, "(", svc.ServiceName, ") with",
+			svc.numChars, "characteristic(s)")
+		svcList = append(svcList, *svc)
+	}
+	return svcList, nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/currantlabs/gatt"
+)
+
+// exitCyclesFailed is the exit status when a soak cycle failed
+const exitCyclesFailed = 10
+
+// Stages of a soak cycle
+const (
+	soakStageConnect    = "connect"
+	soakStageDiscover   = "discover"
+	soakStageCompare    = "compare"
+	soakStageDisconnect = "disconnect"
+)
+
+// soakCSVHeader are the columns of the soak log
+var soakCSVHeader = []string{"cycle", "time", "result", "stage", "connect_ms", "discover_ms", "disconnect_ms",
+	"services", "characteristics", "error"}
+
+// SoakCycle represents a connect, discover and disconnect cycle of a soak test. Stage is the
+// stage the cycle failed in, if it failed.
+type SoakCycle struct {
+	Index      int
+	Start      time.Time
+	Stage      string
+	Connect    time.Duration
+	Discover   time.Duration
+	Disconnect time.Duration
+	Services   int
+	Chars      int
+	Err        error
+}
+
+// record returns the fields of the cycle in the soak log
+func (c *SoakCycle) record() []string {
+	result, reason := "ok", ""
+	if c.Err != nil {
+		result, reason = "fail", c.Err.Error()
+	}
+	millis := func(d time.Duration) string {
+		if d == 0 {
+			return ""
+		}
+		return fmt.Sprintf("%.1f", float64(d)/float64(time.Millisecond))
+	}
+	return []string{strconv.Itoa(c.Index), c.Start.Format(time.RFC3339), result, c.Stage, millis(c.Connect),
+		millis(c.Discover), millis(c.Disconnect), strconv.Itoa(c.Services), strconv.Itoa(c.Chars), reason}
+}
+
+// soakCompare checks the discovered properties of the characteristics of each service against
+// the spec, returning the first mismatch
+func soakCompare(spec *XMLDevice, found map[string]map[string]gatt.Property) error {
+	for _, svc := range spec.ServiceList {
+		chars, ok := found[xmlNormalizeUUID(svc.ServiceID)]
+		if !ok {
+			return fmt.Errorf("service %s not found", svc.ServiceID)
+		}
+		for _, char := range svc.CharList {
+			props, ok := chars[xmlNormalizeUUID(char.CharID)]
+			if !ok {
+				return fmt.Errorf("characteristic %s not found in service %s", char.CharID, svc.ServiceID)
+			}
+			if props != char.Properties.bitMask {
+				return fmt.Errorf("expected properties %s of %s but found %s", char.Properties.bitMask,
+					char.CharID, props)
+			}
+		}
+	}
+	if len(found) != len(spec.ServiceList) {
+		return fmt.Errorf("expected %d services but found %d", len(spec.ServiceList), len(found))
+	}
+	return nil
+}
+
+// soakRunCycle connects to the specified device, optionally discovers its services and
+// characteristics and compares them against the spec, then disconnects, timing each stage.
+// Once cancel is closed the cycle is given up, with errConnectCanceled.
+func soakRunCycle(macIDArg string, name string, discover bool, spec *XMLDevice, cancel <-chan struct{},
+	cycle *SoakCycle) {
+	var handlerEnd time.Time
+
+	cycle.Start = time.Now()
+	cycle.Stage = soakStageConnect
+	cycle.Err = bleConnectDeviceUntil(macIDArg, name, cancel, func(p gatt.Peripheral, lost <-chan struct{}) error {
+		defer func() { handlerEnd = time.Now() }()
+		cycle.Connect = time.Since(cycle.Start)
+		if !discover && spec == nil {
+			return nil
+		}
+
+		stop, done := benchWatch(p, cancel, nil)
+		defer done()
+		// A request failing once canceled was aborted rather than failed, and a disconnect
+		// fails the requests in progress
+		discoverError := func(err error, format string, a ...interface{}) error {
+			select {
+			case <-stop:
+				return errConnectCanceled
+			default:
+			}
+			if err == gatt.ErrDisconnected {
+				return errors.New("connection lost during discovery")
+			}
+			return fmt.Errorf(format, append(a, err)...)
+		}
+
+		cycle.Stage = soakStageDiscover
+		start := time.Now()
+		ss, err := p.DiscoverServices(nil)
+		if err != nil {
+			return discoverError(err, "failed to discover services: %v")
+		}
+		found := make(map[string]map[string]gatt.Property)
+		for _, s := range ss {
+			cs, err := p.DiscoverCharacteristics(nil, s)
+			if err != nil {
+				return discoverError(err, "failed to discover characteristics of %s: %v", s.UUID())
+			}
+			chars := make(map[string]gatt.Property)
+			for _, c := range cs {
+				chars[xmlNormalizeUUID(c.UUID().String())] = c.Properties()
+			}
+			found[xmlNormalizeUUID(s.UUID().String())] = chars
+			cycle.Chars += len(cs)
+		}
+		cycle.Services = len(ss)
+		cycle.Discover = time.Since(start)
+
+		select {
+		case <-lost:
+			return discoverError(gatt.ErrDisconnected, "")
+		default:
+		}
+
+		if spec != nil {
+			cycle.Stage = soakStageCompare
+			if err := soakCompare(spec, found); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if !handlerEnd.IsZero() {
+		cycle.Disconnect = time.Since(handlerEnd)
+	}
+	if cycle.Err == nil && cycle.Disconnect >= maxTimeoutTime {
+		cycle.Stage = soakStageDisconnect
+		cycle.Err = fmt.Errorf("not disconnected within %v", maxTimeoutTime)
+	}
+	if cycle.Err == nil {
+		cycle.Stage = ""
+	}
+}
+
+// soakSummarize displays the failure rate of the cycles, the spread of their timings and
+// the failures by stage and reason
+func soakSummarize(cycles []SoakCycle) {
+	var connect, discover benchDurations
+	failures := make(map[string]int)
+	var reasons []string
+	failed := 0
+
+	for _, c := range cycles {
+		if c.Err != nil {
+			failed++
+			reason := c.Stage + ": " + c.Err.Error()
+			if failures[reason] == 0 {
+				reasons = append(reasons, reason)
+			}
+			failures[reason]++
+		}
+		if c.Connect != 0 {
+			connect = append(connect, c.Connect)
+		}
+		if c.Discover != 0 {
+			discover = append(discover, c.Discover)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "\n%-10s %d\n", "Cycles", len(cycles))
+	fmt.Fprintf(os.Stderr, "%-10s %d\n", "Passed", len(cycles)-failed)
+	fmt.Fprintf(os.Stderr, "%-10s %d (%.1f%%)\n", "Failed", failed, 100*float64(failed)/float64(len(cycles)))
+	for _, timing := range []struct {
+		name    string
+		samples benchDurations
+	}{{"Connect", connect}, {"Discover", discover}} {
+		if len(timing.samples) == 0 {
+			continue
+		}
+		sort.Sort(timing.samples)
+		fmt.Fprintf(os.Stderr, "%-10s min %s, median %s, p95 %s, max %s\n", timing.name,
+			benchMillis(timing.samples[0]), benchMillis(benchPercentile(timing.samples, 50)),
+			benchMillis(benchPercentile(timing.samples, 95)), benchMillis(timing.samples[len(timing.samples)-1]))
+	}
+	if failed != 0 {
+		fmt.Fprintln(os.Stderr, "Failures:")
+		for _, reason := range reasons {
+			fmt.Fprintf(os.Stderr, "  %4d  %s\n", failures[reason], reason)
+		}
+	}
+}
+
+// soakDevice connects to the specified device for the given number of cycles, or until
+// interrupted, waiting the interval between cycles. Each cycle optionally discovers the
+// device or compares it against a spec file, and is logged to the csv file, or to stdout if
+// no file is given. It returns the exit status of the command.
+func soakDevice(macIDArg string, name string, cycleCount int, discover bool, specFile string,
+	interval time.Duration, outFile string) int {
+	var spec *XMLDevice
+	if len(specFile) != 0 {
+		var err error
+		if spec, err = xmlLoadDevice(specFile); err != nil {
+			fmt.Println("Error reading file \n\t", err)
+			return 2
+		}
+	}
+
+	w := io.Writer(os.Stdout)
+	if len(outFile) != 0 {
+		f, err := os.Create(outFile)
+		if err != nil {
+			fmt.Println("Error creating file \n\t", err)
+			return 2
+		}
+		defer f.Close()
+		w = f
+	}
+	out := csv.NewWriter(w)
+	out.Write(soakCSVHeader)
+	out.Flush()
+
+	cancel, stop := bleCancelOnInterrupt(0)
+	defer stop()
+
+	var cycles []SoakCycle
+	for idx := 1; idx <= cycleCount; idx++ {
+		cycle := SoakCycle{Index: idx}
+		soakRunCycle(macIDArg, name, discover, spec, cancel, &cycle)
+		// An interrupted cycle is left out, as it neither passed nor failed
+		if cycle.Err == errConnectCanceled {
+			break
+		}
+		cycles = append(cycles, cycle)
+
+		out.Write(cycle.record())
+		out.Flush()
+		if cycle.Err != nil {
+			fmt.Fprintf(os.Stderr, "Cycle %d failed to %s \n\t %v\n", idx, cycle.Stage, cycle.Err)
+		} else {
+			fmt.Fprintf(os.Stderr, "Cycle %d ok, connected in %s\n", idx, benchMillis(cycle.Connect))
+		}
+
+		if idx == cycleCount {
+			break
+		}
+		select {
+		case <-cancel:
+			cycleCount = idx
+		case <-time.After(interval):
+		}
+	}
+
+	if len(cycles) == 0 {
+		return exitOK
+	}
+	soakSummarize(cycles)
+	if err := out.Error(); err != nil {
+		fmt.Println("Error writing log \n\t", err)
+		return 2
+	}
+	for _, c := range cycles {
+		if c.Err != nil {
+			return exitCyclesFailed
+		}
+	}
+	return exitOK
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/currantlabs/gatt"
+)
+
+// exitSubscribeFailed is the exit status when notifications or indications can't be enabled
+const exitSubscribeFailed = 8
+
+// subOutputFormats are the formats received values can be written in
+var subOutputFormats = []string{"text", "json", "csv"}
+
+// SubRecord represents a value received in a notification or indication
+type SubRecord struct {
+	Time           time.Time `json:"time"`
+	Characteristic string    `json:"characteristic"`
+	Hex            string    `json:"hex"`
+	Decoded        string    `json:"decoded,omitempty"`
+}
+
+// SubWriter writes received values in the selected output format
+type SubWriter struct {
+	format string
+	w      io.Writer
+	csv    *csv.Writer
+	mu     sync.Mutex
+}
+
+// subNewWriter creates a writer for received values, writing the csv header if needed
+func subNewWriter(w io.Writer, format string) *SubWriter {
+	sw := &SubWriter{format: format, w: w}
+	if format == "csv" {
+		sw.csv = csv.NewWriter(w)
+		sw.csv.Write([]string{"time", "characteristic", "hex", "decoded"})
+		sw.csv.Flush()
+	}
+	return sw
+}
+
+// Write writes a received value
+func (sw *SubWriter) Write(r SubRecord) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	switch sw.format {
+	case "json":
+		b, _ := json.Marshal(r)
+		fmt.Fprintln(sw.w, string(b))
+	case "csv":
+		sw.csv.Write([]string{r.Time.Format(time.RFC3339Nano), r.Characteristic, r.Hex, r.Decoded})
+		sw.csv.Flush()
+	default:
+		line := r.Time.Format("15:04:05.000") + " " + r.Characteristic + " " + r.Hex
+		if len(r.Decoded) != 0 {
+			line += " [" + r.Decoded + "]"
+		}
+		fmt.Fprintln(sw.w, line)
+	}
+}
+
+// subFindChars discovers the characteristics to subscribe to, along with their descriptors
+// so their CCCD can be written
+func subFindChars(p gatt.Peripheral, charIDs []string) ([]*gatt.Characteristic, error) {
+	wanted := make(map[string]bool)
+	for _, id := range charIDs {
+		wanted[xmlNormalizeUUID(id)] = true
+	}
+
+	ss, err := p.DiscoverServices(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover services: %v", err)
+	}
+
+	var chars []*gatt.Characteristic
+	for _, s := range ss {
+		cs, err := p.DiscoverCharacteristics(nil, s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover characteristics: %v", err)
+		}
+		for _, c := range cs {
+			charID := xmlNormalizeUUID(c.UUID().String())
+			if !wanted[charID] {
+				continue
+			}
+			if _, err := p.DiscoverDescriptors(nil, c); err != nil {
+				return nil, fmt.Errorf("failed to discover descriptors of %s: %v", charID, err)
+			}
+			delete(wanted, charID)
+			chars = append(chars, c)
+		}
+	}
+
+	if len(wanted) != 0 {
+		var missing []string
+		for charID := range wanted {
+			missing = append(missing, charID)
+		}
+		return nil, fmt.Errorf("characteristic(s) %s not found", strings.Join(missing, ", "))
+	}
+	return chars, nil
+}
+
+// subSetValue enables, or disables when f is nil, notifications of a characteristic, or
+// indications if it does not support notifications. macOS enables either through
+// SetNotifyValue.
+func subSetValue(p gatt.Peripheral, c *gatt.Characteristic, f func(*gatt.Characteristic, []byte, error)) error {
+	if (c.Properties()&gatt.CharNotify) != 0 || runtime.GOOS == "darwin" {
+		return p.SetNotifyValue(c, f)
+	}
+	return p.SetIndicateValue(c, f)
+}
+
+// subSubscribe connects to the specified device and streams the notifications or indications
+// of the given characteristics until the duration elapses, or until interrupted when no duration
+// is given. The connection is re-established if lost, until either happens. It returns the
+// exit status of the command.
+func subSubscribe(macIDArg string, name string, charIDs []string, duration time.Duration, spec *XMLDevice,
+	sw *SubWriter) int {
+	status := exitConnectFailed
+	subscribed := false
+
+	cancel, stop := bleCancelOnInterrupt(duration)
+	defer stop()
+
+	onValue := func(c *gatt.Characteristic, b []byte, err error) {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error receiving value of", c.UUID(), "\n\t", err)
+			return
+		}
+		r := SubRecord{Time: time.Now(), Characteristic: c.UUID().String(), Hex: fmt.Sprintf("%x", b)}
+		fields, err := formatDecodeChar(spec, r.Characteristic, b)
+		if err != nil {
+			fields = append(fields, "("+err.Error()+")")
+		}
+		r.Decoded = strings.Join(fields, ", ")
+		sw.Write(r)
+	}
+
+	err := bleConnectDeviceUntil(macIDArg, name, cancel, func(p gatt.Peripheral, lost <-chan struct{}) error {
+		chars, err := subFindChars(p, charIDs)
+		if err != nil {
+			status = exitNotFound
+			return err
+		}
+
+		status = exitSubscribeFailed
+		for _, c := range chars {
+			if (c.Properties() & (gatt.CharNotify | gatt.CharIndicate)) == 0 {
+				return fmt.Errorf("characteristic %s does not support notifications or indications", c.UUID())
+			}
+			if err := subSetValue(p, c, onValue); err != nil {
+				return fmt.Errorf("failed to subscribe to %s: %v", c.UUID(), err)
+			}
+			fmt.Fprintln(os.Stderr, "Subscribed to", c.UUID())
+		}
+		subscribed = true
+
+		select {
+		case <-lost:
+			status = exitConnectFailed
+			return errConnectionLost
+		case <-cancel:
+		}
+
+		for _, c := range chars {
+			if err := subSetValue(p, c, nil); err != nil {
+				fmt.Fprintln(os.Stderr, "Failed to unsubscribe from", c.UUID(), "\n\t", err)
+			}
+		}
+		status = exitOK
+		return nil
+	})
+
+	// Ending while reconnecting ends a subscription like any other
+	if err == errConnectCanceled && subscribed {
+		return exitOK
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error subscribing \n\t", err)
+	}
+	return status
+}
+
+// subSubscribeDevice sets up the output and spec of a subscription and runs it
+func subSubscribeDevice(macIDArg string, name string, charList string, duration time.Duration, specFile string,
+	outFile string, format string) int {
+	var spec *XMLDevice
+	if len(specFile) != 0 {
+		var err error
+		if spec, err = xmlLoadDevice(specFile); err != nil {
+			fmt.Println("Error reading file \n\t", err)
+			return 2
+		}
+	}
+
+	w := io.Writer(os.Stdout)
+	if len(outFile) != 0 {
+		f, err := os.Create(outFile)
+		if err != nil {
+			fmt.Println("Error creating file \n\t", err)
+			return 2
+		}
+		defer f.Close()
+		w = f
+	}
+
+	return subSubscribe(macIDArg, name, importSplitList(charList), duration, spec, subNewWriter(w, format))
+}
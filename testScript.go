@@ -0,0 +1,503 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/currantlabs/gatt"
+	"gopkg.in/yaml.v2"
+)
+
+// scriptActions are the actions a test script step can take
+var scriptActions = []string{"connect", "write", "read", "subscribe", "notification", "wait", "disconnect"}
+
+// scriptDefaultTimeout is how long subscribe and notification steps wait for a notification
+const scriptDefaultTimeout = 5 * time.Second
+
+// errStepFailed is returned by the connection handler of a test script when a step failed
+var errStepFailed = errors.New("step failed")
+
+// ScriptStep represents a step of a test script
+type ScriptStep struct {
+	Name       string              `json:"name,omitempty" yaml:"name,omitempty"`
+	Action     string              `json:"action" yaml:"action"`
+	Service    string              `json:"service,omitempty" yaml:"service,omitempty"`
+	Char       string              `json:"char,omitempty" yaml:"char,omitempty"`
+	Value      string              `json:"value,omitempty" yaml:"value,omitempty"`
+	Encoding   string              `json:"encoding,omitempty" yaml:"encoding,omitempty"`
+	NoResponse bool                `json:"noResponse,omitempty" yaml:"noResponse,omitempty"`
+	Expect     *XMLValueConstraint `json:"expect,omitempty" yaml:"expect,omitempty"`
+	Timeout    string              `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	Duration   string              `json:"duration,omitempty" yaml:"duration,omitempty"`
+
+	svcID    string
+	charID   string
+	timeout  time.Duration
+	duration time.Duration
+}
+
+// Script represents a test script, the steps of a manual test procedure run against a device
+type Script struct {
+	Name   string       `json:"name,omitempty" yaml:"name,omitempty"`
+	Device string       `json:"device,omitempty" yaml:"device,omitempty"`
+	ID     string       `json:"id,omitempty" yaml:"id,omitempty"`
+	Spec   string       `json:"spec,omitempty" yaml:"spec,omitempty"`
+	Steps  []ScriptStep `json:"steps" yaml:"steps"`
+}
+
+// ScriptRunner runs a test script against a device
+type ScriptRunner struct {
+	script        *Script
+	spec          *XMLDevice
+	p             gatt.Peripheral
+	lost          <-chan struct{}
+	subscribed    []*gatt.Characteristic
+	notifications map[string]chan []byte
+	chars         map[string]*gatt.Characteristic
+	report        *Report
+	out           io.Writer
+}
+
+// scriptLoad reads a test script. JSON being a subset of YAML, both are read by the YAML parser.
+func scriptLoad(fileName string) (*Script, error) {
+	var script Script
+
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(b, &script); err != nil {
+		return nil, err
+	}
+	if len(script.Spec) != 0 && !filepath.IsAbs(script.Spec) {
+		script.Spec = filepath.Join(filepath.Dir(fileName), script.Spec)
+	}
+	return &script, nil
+}
+
+// scriptResolveChar resolves the characteristic of a step, given by UUID or by its name in the
+// spec, to its service and characteristic UUIDs. The service may be given by UUID or name too.
+func scriptResolveChar(spec *XMLDevice, svcRef string, charRef string) (string, string, error) {
+	if spec != nil {
+		for _, s := range spec.ServiceList {
+			if len(svcRef) != 0 && !strings.EqualFold(s.ServiceName, svcRef) &&
+				xmlNormalizeUUID(s.ServiceID) != xmlNormalizeUUID(svcRef) {
+				continue
+			}
+			for _, c := range s.CharList {
+				if strings.EqualFold(c.CharName, charRef) || xmlNormalizeUUID(c.CharID) == xmlNormalizeUUID(charRef) {
+					return s.ServiceID, c.CharID, nil
+				}
+			}
+		}
+	}
+
+	if _, err := charParseUUID(charRef); err != nil {
+		return "", "", fmt.Errorf("characteristic %q is not a UUID nor a name in the spec", charRef)
+	}
+	if len(svcRef) != 0 {
+		if _, err := charParseUUID(svcRef); err != nil {
+			return "", "", fmt.Errorf("service %q is not a UUID nor a name in the spec", svcRef)
+		}
+	}
+	return svcRef, charRef, nil
+}
+
+// scriptPrepare checks the steps of a test script before running it, resolving their
+// characteristics and parsing their durations
+func scriptPrepare(script *Script, spec *XMLDevice) error {
+	if len(script.Steps) == 0 {
+		return errors.New("the script has no steps")
+	}
+
+	for idx := range script.Steps {
+		step := &script.Steps[idx]
+		fail := func(format string, args ...interface{}) error {
+			return fmt.Errorf("step %d (%s): %s", idx+1, step.Action, fmt.Sprintf(format, args...))
+		}
+
+		if !cmdIsOneOf(step.Action, scriptActions) {
+			return fail("unknown action, expected one of %s", strings.Join(scriptActions, ", "))
+		}
+
+		switch step.Action {
+		case "write", "read", "subscribe", "notification":
+			if len(step.Char) == 0 {
+				return fail("no characteristic given")
+			}
+			var err error
+			if step.svcID, step.charID, err = scriptResolveChar(spec, step.Service, step.Char); err != nil {
+				return fail("%v", err)
+			}
+		}
+
+		switch step.Action {
+		case "write":
+			if len(step.Value) == 0 {
+				return fail("no value given")
+			}
+			if len(step.Encoding) == 0 {
+				step.Encoding = "hex"
+			}
+			if !cmdIsOneOf(step.Encoding, charWriteEncodings) {
+				return fail("unknown encoding %q", step.Encoding)
+			}
+
+		case "subscribe", "notification":
+			step.timeout = scriptDefaultTimeout
+			if len(step.Timeout) != 0 {
+				var err error
+				if step.timeout, err = time.ParseDuration(step.Timeout); err != nil {
+					return fail("invalid timeout %q", step.Timeout)
+				}
+			}
+
+		case "wait":
+			var err error
+			if step.duration, err = time.ParseDuration(step.Duration); err != nil {
+				return fail("invalid duration %q", step.Duration)
+			}
+		}
+	}
+	return nil
+}
+
+// scriptStepName returns the name of a step for the results
+func scriptStepName(step *ScriptStep) string {
+	if len(step.Name) != 0 {
+		return step.Name
+	}
+	switch step.Action {
+	case "write", "read", "subscribe", "notification":
+		return step.Action + " " + step.Char
+	case "wait":
+		return step.Action + " " + step.Duration
+	}
+	return step.Action
+}
+
+// record records and prints the outcome of a step
+func (sr *ScriptRunner) record(step *ScriptStep, status string, start time.Time, message string) {
+	r := ReportCase{Class: sr.report.Name, Name: scriptStepName(step), Status: status, Message: message}
+	if status != reportSkip {
+		r.Duration = time.Since(start)
+	}
+	sr.report.Cases = append(sr.report.Cases, r)
+
+	fmt.Fprintf(sr.out, "%s  %-48s %8.3fs\n", r.Status, r.Name, r.Duration.Seconds())
+	if len(message) != 0 {
+		fmt.Fprintln(sr.out, "\t", message)
+	}
+}
+
+// char returns the characteristic of a step. The services and characteristics of the device
+// are discovered by the first step of a connection which needs one, and looked up by service
+// and characteristic UUID afterwards, as discovering them again adds them to the peripheral
+// once more. A step without a service gets the characteristic of the first service having it.
+func (sr *ScriptRunner) char(svcID string, charID string) (*gatt.Characteristic, error) {
+	if sr.chars == nil {
+		ss, err := sr.p.DiscoverServices(nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover services: %v", err)
+		}
+		chars := make(map[string]*gatt.Characteristic)
+		for _, s := range ss {
+			cs, err := sr.p.DiscoverCharacteristics(nil, s)
+			if err != nil {
+				return nil, fmt.Errorf("failed to discover characteristics: %v", err)
+			}
+			for _, c := range cs {
+				cID := xmlNormalizeUUID(c.UUID().String())
+				chars[xmlNormalizeUUID(s.UUID().String())+"/"+cID] = c
+				if _, ok := chars["/"+cID]; !ok {
+					chars["/"+cID] = c
+				}
+			}
+		}
+		sr.chars = chars
+	}
+
+	if c, ok := sr.chars[xmlNormalizeUUID(svcID)+"/"+xmlNormalizeUUID(charID)]; ok {
+		return c, nil
+	}
+	if len(svcID) != 0 {
+		return nil, fmt.Errorf("characteristic %s not found in service %s", charID, svcID)
+	}
+	return nil, fmt.Errorf("characteristic %s not found", charID)
+}
+
+// describe renders a value with its decoded fields when the spec has a format for it, or
+// the characteristic is a standard one
+func (sr *ScriptRunner) describe(step *ScriptStep, b []byte) string {
+	return formatDescribeChar(sr.spec, step.charID, b)
+}
+
+// waitNotification waits for a notification of the step characteristic matching its
+// expected value, if any, returning the value received
+func (sr *ScriptRunner) waitNotification(step *ScriptStep) (string, error) {
+	values, ok := sr.notifications[xmlNormalizeUUID(step.charID)]
+	if !ok {
+		return "", fmt.Errorf("not subscribed to %s", step.Char)
+	}
+
+	deadline := time.After(step.timeout)
+	var mismatch error
+	for {
+		select {
+		case b := <-values:
+			if step.Expect == nil {
+				return sr.describe(step, b), nil
+			}
+			if mismatch = valueCheck(step.Expect, b); mismatch == nil {
+				return sr.describe(step, b), nil
+			}
+		case <-sr.lost:
+			return "", errConnectionLost
+		case <-deadline:
+			if mismatch != nil {
+				return "", fmt.Errorf("no matching notification within %v, last one: %v", step.timeout, mismatch)
+			}
+			return "", fmt.Errorf("no notification within %v", step.timeout)
+		}
+	}
+}
+
+// runStep runs a step on the connected device, returning a message describing its outcome
+func (sr *ScriptRunner) runStep(step *ScriptStep) (string, error) {
+	if step.Action == "wait" {
+		select {
+		case <-time.After(step.duration):
+			return "", nil
+		case <-sr.lost:
+			return "", errConnectionLost
+		}
+	}
+	if sr.p == nil {
+		return "", errors.New("not connected")
+	}
+
+	select {
+	case <-sr.lost:
+		return "", errConnectionLost
+	default:
+	}
+
+	switch step.Action {
+	case "connect":
+		return "", errors.New("already connected")
+
+	case "read":
+		c, err := sr.char(step.svcID, step.charID)
+		if err != nil {
+			return "", err
+		}
+		b, err := bleReadValue(sr.p, c)
+		if err != nil {
+			return "", fmt.Errorf("failed to read value: %v", err)
+		}
+		if step.Expect != nil {
+			if err := valueCheck(step.Expect, b); err != nil {
+				return "", err
+			}
+		}
+		return sr.describe(step, b), nil
+
+	case "write":
+		c, err := sr.char(step.svcID, step.charID)
+		if err != nil {
+			return "", err
+		}
+		value, err := charEncodeValue(step.Value, step.Encoding, false, xmlFindCharFormat(sr.spec, step.charID))
+		if err != nil {
+			return "", fmt.Errorf("invalid value: %v", err)
+		}
+		if err := sr.p.WriteCharacteristic(c, value, step.NoResponse); err != nil {
+			return "", fmt.Errorf("failed to write value, ATT error: %v", err)
+		}
+		return fmt.Sprintf("wrote %x", value), nil
+
+	case "subscribe":
+		c, err := sr.char(step.svcID, step.charID)
+		if err != nil {
+			return "", err
+		}
+		if (c.Properties() & (gatt.CharNotify | gatt.CharIndicate)) == 0 {
+			return "", errors.New("characteristic does not support notifications or indications")
+		}
+		if _, err := sr.p.DiscoverDescriptors(nil, c); err != nil {
+			return "", fmt.Errorf("failed to discover descriptors: %v", err)
+		}
+
+		values := make(chan []byte, 64)
+		err = subSetValue(sr.p, c, func(c *gatt.Characteristic, b []byte, err error) {
+			if err != nil {
+				return
+			}
+			select {
+			case values <- b:
+			default:
+			}
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to subscribe: %v", err)
+		}
+		sr.subscribed = append(sr.subscribed, c)
+		sr.notifications[xmlNormalizeUUID(step.charID)] = values
+
+		if step.Expect == nil && len(step.Timeout) == 0 {
+			return "", nil
+		}
+		return sr.waitNotification(step)
+
+	case "notification":
+		return sr.waitNotification(step)
+	}
+	return "", fmt.Errorf("unknown action %q", step.Action)
+}
+
+// unsubscribeAll disables the notifications and indications enabled by the script
+func (sr *ScriptRunner) unsubscribeAll() {
+	for _, c := range sr.subscribed {
+		subSetValue(sr.p, c, nil)
+	}
+	sr.subscribed = nil
+}
+
+// run runs the steps of the script, stopping at the first failed step. The steps between
+// a connect and a disconnect step run on the connection, which is closed at the end of the
+// script if not disconnected before. Steps after a failed step are skipped.
+func (sr *ScriptRunner) run() {
+	steps := sr.script.Steps
+	idx := 0
+
+	for idx < len(steps) {
+		start := time.Now()
+		if steps[idx].Action != "connect" {
+			message, err := sr.runStep(&steps[idx])
+			if err != nil {
+				sr.record(&steps[idx], reportFail, start, err.Error())
+				idx++
+				break
+			}
+			sr.record(&steps[idx], reportPass, start, message)
+			idx++
+			continue
+		}
+
+		connected := false
+		var disconnectStart time.Time
+		err := bleConnectDevice(sr.script.ID, sr.script.Device, func(p gatt.Peripheral, lost <-chan struct{}) error {
+			sr.p, sr.lost = p, lost
+			sr.notifications = make(map[string]chan []byte)
+			sr.chars = nil
+			connected = true
+			sr.record(&steps[idx], reportPass, start, "")
+			idx++
+
+			for idx < len(steps) {
+				step := &steps[idx]
+				if step.Action == "disconnect" {
+					disconnectStart = time.Now()
+					sr.unsubscribeAll()
+					return nil
+				}
+
+				stepStart := time.Now()
+				message, err := sr.runStep(step)
+				idx++
+				if err != nil {
+					sr.record(step, reportFail, stepStart, err.Error())
+					return errStepFailed
+				}
+				sr.record(step, reportPass, stepStart, message)
+			}
+			sr.unsubscribeAll()
+			return nil
+		})
+		sr.p, sr.lost, sr.chars = nil, nil, nil
+
+		if !connected {
+			sr.record(&steps[idx], reportFail, start, err.Error())
+			idx++
+			break
+		}
+		if err != nil {
+			break
+		}
+		if !disconnectStart.IsZero() {
+			sr.record(&steps[idx], reportPass, disconnectStart, "")
+			idx++
+		}
+	}
+
+	for ; idx < len(steps); idx++ {
+		sr.record(&steps[idx], reportSkip, time.Time{}, "")
+	}
+}
+
+// scriptRunFile runs a test script against the device it names, or the given device when set,
+// and writes the outcome of every step to out, writing a report of the run when a report
+// format is given. It returns the exit status of the command: 0 when every step passed, 1 when a step
+// failed and 2 when the script or the report could not be read or written.
+func scriptRunFile(out io.Writer, fileName string, macIDArg string, name string, specFile string,
+	reportFormat string, reportFile string) int {
+	script, err := scriptLoad(fileName)
+	if err != nil {
+		fmt.Fprintln(out, "Error reading script \n\t", err)
+		return 2
+	}
+	if len(name) != 0 {
+		script.Device = name
+	}
+	if len(macIDArg) != 0 {
+		script.ID = macIDArg
+	}
+	if len(specFile) != 0 {
+		script.Spec = specFile
+	}
+	if len(script.Device) == 0 {
+		fmt.Fprintln(out, "Error reading script \n\t no device given")
+		return 2
+	}
+
+	if len(script.Name) == 0 {
+		script.Name = filepath.Base(fileName)
+	}
+
+	sr := &ScriptRunner{script: script, report: reportNew(script.Name), out: out}
+	sr.report.DeviceName = script.Device
+	sr.report.Spec = script.Spec
+	sr.report.SpecHash = reportHashFile(script.Spec)
+	if len(script.Spec) != 0 {
+		if sr.spec, err = xmlLoadDevice(script.Spec); err != nil {
+			fmt.Fprintln(out, "Error reading file \n\t", err)
+			return 2
+		}
+	}
+	if err := scriptPrepare(script, sr.spec); err != nil {
+		fmt.Fprintln(out, "Error reading script \n\t", err)
+		return 2
+	}
+
+	fmt.Fprintln(out, "Running", script.Name, "on", script.Device)
+	sr.run()
+
+	passed, failed, skipped := sr.report.Count()
+	fmt.Fprintf(out, "\n%d steps: %d passed, %d failed, %d skipped\n", len(sr.report.Cases), passed, failed, skipped)
+
+	if len(reportFormat) != 0 {
+		if err := reportWrite(sr.report, reportFormat, reportFile); err != nil {
+			fmt.Fprintln(out, "Error writing report \n\t", err)
+			return 2
+		}
+	}
+	if failed != 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScriptCharCache(t *testing.T) {
+	props := XMLCharProperties{Read: mandatory}
+	dev := &XMLDevice{DeviceName: "LY01", ServiceList: []XMLService{
+		{ServiceName: "Light", ServiceID: "1c68b3fad44343659e1cb22f44eb0816", CharList: []XMLCharacteristic{
+			{CharName: "Light Control", CharID: "447c291d5318420b980a8f33e22c3744", Properties: props}}},
+		{ServiceName: "Battery", ServiceID: "180f", CharList: []XMLCharacteristic{
+			{CharName: "Battery Level", CharID: "2a19", Properties: props},
+			{CharName: "Light Control", CharID: "447c291d5318420b980a8f33e22c3744", Properties: props}}},
+	}}
+	emu, err := emuNewEmulator(dev, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := emuNewLocalTransport(23)
+	if err := transport.Serve(emu); err != nil {
+		t.Fatal(err)
+	}
+	lp, _ := transport.Connect()
+	p := &disTestPeripheral{Peripheral: lp}
+	sr := &ScriptRunner{p: p}
+
+	for _, test := range []struct {
+		svcID  string
+		charID string
+		found  string
+	}{
+		{"", "2a19", "180f"},
+		{"180f", "2a19", "180f"},
+		{"0000180f-0000-1000-8000-00805f9b34fb", "2A19", "180f"},
+		{"", "447c291d5318420b980a8f33e22c3744", "1c68b3fad44343659e1cb22f44eb0816"},
+		{"180f", "447c291d5318420b980a8f33e22c3744", "180f"},
+		{"180f", "2a1a", ""},
+		{"", "2a1a", ""},
+	} {
+		c, err := sr.char(test.svcID, test.charID)
+		if len(test.found) == 0 {
+			if err == nil {
+				t.Errorf("found %s/%s", test.svcID, test.charID)
+			}
+			continue
+		}
+		if err != nil || xmlNormalizeUUID(c.Service().UUID().String()) != test.found {
+			t.Errorf("%s/%s: found %v, %v, expected the characteristic of %s", test.svcID, test.charID, c, err,
+				test.found)
+		}
+	}
+	// The characteristics of each service are discovered once for the connection
+	if p.discoveries != len(dev.ServiceList) {
+		t.Errorf("discovered characteristics %d times, expected %d", p.discoveries, len(dev.ServiceList))
+	}
+}
+
+func TestScriptRunFileOutput(t *testing.T) {
+	// A script that cannot be run reports why on the output given, leaving stdout to the report
+	var out bytes.Buffer
+	stdout := os.Stdout
+	status := scriptRunFile(&out, "missing.yaml", "", "LY01", "", "junit", "")
+	if status != 2 || !strings.Contains(out.String(), "Error reading script") {
+		t.Errorf("returned %d with output %q", status, out.String())
+	}
+	if os.Stdout != stdout {
+		t.Error("stdout was replaced")
+	}
+
+	sr := &ScriptRunner{report: reportNew("test"), out: &out}
+	out.Reset()
+	sr.record(&ScriptStep{Action: "wait"}, reportFail, time.Now(), "step failed")
+	if !strings.Contains(out.String(), "wait") || !strings.Contains(out.String(), "step failed") {
+		t.Errorf("recorded the step as %q", out.String())
+	}
+}
+
+func TestReportOutput(t *testing.T) {
+	for _, test := range []struct {
+		format   string
+		fileName string
+		out      *os.File
+	}{
+		{"", "", os.Stdout},
+		{"junit", "report.xml", os.Stdout},
+		{"junit", "", os.Stderr},
+	} {
+		if out := reportOutput(test.format, test.fileName); out != test.out {
+			t.Errorf("report %q to %q: output to %v, expected %v", test.format, test.fileName, out, test.out.Name())
+		}
+	}
+}
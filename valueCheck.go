@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"unicode/utf8"
+)
+
+// XMLValueConstraint represents the expected value of a characteristic from the xml file.
+// Every constraint that is set must hold for the value to match.
+type XMLValueConstraint struct {
+	Hex       string `xml:"hex,attr,omitempty" json:"hex,omitempty" yaml:"hex,omitempty"`
+	String    string `xml:"string,attr,omitempty" json:"string,omitempty" yaml:"string,omitempty"`
+	Regex     string `xml:"regex,attr,omitempty" json:"regex,omitempty" yaml:"regex,omitempty"`
+	Min       string `xml:"min,attr,omitempty" json:"min,omitempty" yaml:"min,omitempty"`
+	Max       string `xml:"max,attr,omitempty" json:"max,omitempty" yaml:"max,omitempty"`
+	Signed    bool   `xml:"signed,attr,omitempty" json:"signed,omitempty" yaml:"signed,omitempty"`
+	MinLength int    `xml:"minLength,attr,omitempty" json:"minLength,omitempty" yaml:"minLength,omitempty"`
+	MaxLength int    `xml:"maxLength,attr,omitempty" json:"maxLength,omitempty" yaml:"maxLength,omitempty"`
+}
+
+// valueNumber interprets a little endian value of up to 8 bytes as a number
+func valueNumber(b []byte, signed bool) (float64, error) {
+	if len(b) == 0 || len(b) > 8 {
+		return 0, fmt.Errorf("%d byte value is not a number", len(b))
+	}
+
+	var u uint64
+	for idx := len(b) - 1; idx >= 0; idx-- {
+		u = (u << 8) | uint64(b[idx])
+	}
+	if !signed {
+		return float64(u), nil
+	}
+
+	shift := uint(64 - 8*len(b))
+	return float64(int64(u<<shift) >> shift), nil
+}
+
+// valueCheck checks a characteristic value against its expected value
+func valueCheck(v *XMLValueConstraint, b []byte) error {
+	if len(v.Hex) != 0 {
+		expected, err := hex.DecodeString(v.Hex)
+		if err != nil {
+			return fmt.Errorf("invalid hex constraint %q", v.Hex)
+		}
+		if !bytes.Equal(expected, b) {
+			return fmt.Errorf("expected %x but found %x", expected, b)
+		}
+	}
+
+	if len(v.String) != 0 || len(v.Regex) != 0 {
+		if !utf8.Valid(b) {
+			return fmt.Errorf("expected a UTF-8 string but found %x", b)
+		}
+	}
+	if len(v.String) != 0 && v.String != string(b) {
+		return fmt.Errorf("expected %q but found %q", v.String, string(b))
+	}
+	if len(v.Regex) != 0 {
+		re, err := regexp.Compile(v.Regex)
+		if err != nil {
+			return fmt.Errorf("invalid regex constraint %q", v.Regex)
+		}
+		if !re.Match(b) {
+			return fmt.Errorf("expected a match of %q but found %q", v.Regex, string(b))
+		}
+	}
+
+	if len(v.Min) != 0 || len(v.Max) != 0 {
+		n, err := valueNumber(b, v.Signed)
+		if err != nil {
+			return err
+		}
+		if len(v.Min) != 0 {
+			min, err := strconv.ParseFloat(v.Min, 64)
+			if err != nil {
+				return fmt.Errorf("invalid min constraint %q", v.Min)
+			}
+			if n < min {
+				return fmt.Errorf("expected at least %s but found %v", v.Min, n)
+			}
+		}
+		if len(v.Max) != 0 {
+			max, err := strconv.ParseFloat(v.Max, 64)
+			if err != nil {
+				return fmt.Errorf("invalid max constraint %q", v.Max)
+			}
+			if n > max {
+				return fmt.Errorf("expected at most %s but found %v", v.Max, n)
+			}
+		}
+	}
+
+	if v.MinLength != 0 && len(b) < v.MinLength {
+		return fmt.Errorf("expected at least %d bytes but found %d", v.MinLength, len(b))
+	}
+	if v.MaxLength != 0 && len(b) > v.MaxLength {
+		return fmt.Errorf("expected at most %d bytes but found %d", v.MaxLength, len(b))
+	}
+	return nil
+}
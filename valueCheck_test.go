@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValueCheck(t *testing.T) {
+	for _, test := range []struct {
+		v     XMLValueConstraint
+		value []byte
+		err   string
+	}{
+		{XMLValueConstraint{Hex: "0102ff"}, []byte{0x01, 0x02, 0xff}, ""},
+		{XMLValueConstraint{Hex: "0102FF"}, []byte{0x01, 0x02, 0xff}, ""},
+		{XMLValueConstraint{Hex: "0102ff"}, []byte{0x01, 0x02}, "expected 0102ff but found 0102"},
+		{XMLValueConstraint{Hex: "01g2"}, []byte{0x01}, "invalid hex constraint"},
+
+		{XMLValueConstraint{String: "LY01"}, []byte("LY01"), ""},
+		{XMLValueConstraint{String: "LY01"}, []byte("LY02"), `expected "LY01" but found "LY02"`},
+		{XMLValueConstraint{String: "LY01"}, []byte{0xff, 0xfe}, "expected a UTF-8 string"},
+
+		{XMLValueConstraint{Regex: `^\d+\.\d+\.\d+$`}, []byte("1.2.0"), ""},
+		{XMLValueConstraint{Regex: `^\d+\.\d+\.\d+$`}, []byte("1.2"), "expected a match"},
+		{XMLValueConstraint{Regex: `^\d+$`}, []byte{0xc3, 0x28}, "expected a UTF-8 string"},
+		{XMLValueConstraint{Regex: `(`}, []byte("1"), "invalid regex constraint"},
+
+		{XMLValueConstraint{Min: "10", Max: "20"}, []byte{10}, ""},
+		{XMLValueConstraint{Min: "10", Max: "20"}, []byte{20}, ""},
+		{XMLValueConstraint{Min: "10", Max: "20"}, []byte{9}, "expected at least 10 but found 9"},
+		{XMLValueConstraint{Min: "10", Max: "20"}, []byte{21}, "expected at most 20 but found 21"},
+		{XMLValueConstraint{Max: "300"}, []byte{0x2c, 0x01}, ""},
+		{XMLValueConstraint{Max: "300"}, []byte{0x2d, 0x01}, "expected at most 300 but found 301"},
+		{XMLValueConstraint{Min: "0.5"}, []byte{0x00}, "expected at least 0.5 but found 0"},
+		{XMLValueConstraint{Min: "x"}, []byte{0x00}, "invalid min constraint"},
+		{XMLValueConstraint{Max: "x"}, []byte{0x00}, "invalid max constraint"},
+		{XMLValueConstraint{Min: "0"}, []byte{}, "0 byte value is not a number"},
+		{XMLValueConstraint{Min: "0"}, make([]byte, 9), "9 byte value is not a number"},
+
+		{XMLValueConstraint{Min: "0"}, []byte{0xff}, ""},
+		{XMLValueConstraint{Min: "0", Signed: true}, []byte{0xff}, "expected at least 0 but found -1"},
+		{XMLValueConstraint{Min: "-40", Max: "85", Signed: true}, []byte{0xd8}, ""},
+		{XMLValueConstraint{Min: "-40", Max: "85", Signed: true}, []byte{0xd7}, "expected at least -40 but found -41"},
+		{XMLValueConstraint{Min: "-40", Signed: true}, []byte{0xd8, 0xff}, ""},
+		{XMLValueConstraint{Max: "-1", Signed: true}, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, ""},
+
+		{XMLValueConstraint{MinLength: 2, MaxLength: 4}, []byte{1, 2}, ""},
+		{XMLValueConstraint{MinLength: 2, MaxLength: 4}, []byte{1, 2, 3, 4}, ""},
+		{XMLValueConstraint{MinLength: 2, MaxLength: 4}, []byte{1}, "expected at least 2 bytes but found 1"},
+		{XMLValueConstraint{MinLength: 2, MaxLength: 4}, []byte{1, 2, 3, 4, 5}, "expected at most 4 bytes but found 5"},
+
+		{XMLValueConstraint{String: "abc", MaxLength: 2}, []byte("abc"), "expected at most 2 bytes but found 3"},
+		{XMLValueConstraint{}, []byte{1, 2, 3}, ""},
+	} {
+		err := valueCheck(&test.v, test.value)
+		if len(test.err) == 0 && err != nil {
+			t.Errorf("%+v: checked %x as %v, expected a match", test.v, test.value, err)
+		} else if len(test.err) != 0 && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%+v: checked %x as %v, expected %q", test.v, test.value, err, test.err)
+		}
+	}
+}
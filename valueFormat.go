@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// XMLFormatBit represents a named bit of a bitfield value field
+type XMLFormatBit struct {
+	Index uint   `xml:"index,attr" json:"index" yaml:"index"`
+	Name  string `xml:"name,attr" json:"name" yaml:"name"`
+}
+
+// XMLFormatEnum represents a named value of an enum value field
+type XMLFormatEnum struct {
+	Value int64  `xml:"value,attr" json:"value" yaml:"value"`
+	Name  string `xml:"name,attr" json:"name" yaml:"name"`
+}
+
+// XMLFormatField represents a field of a characteristic value from the xml file.
+// Numeric fields are scaled as raw * multiplier * 10^exponent + offset.
+type XMLFormatField struct {
+	Name       string          `xml:"name,attr" json:"name" yaml:"name"`
+	Type       string          `xml:"type,attr" json:"type" yaml:"type"`
+	Size       int             `xml:"size,attr,omitempty" json:"size,omitempty" yaml:"size,omitempty"`
+	Unit       string          `xml:"unit,attr,omitempty" json:"unit,omitempty" yaml:"unit,omitempty"`
+	Exponent   int             `xml:"exponent,attr,omitempty" json:"exponent,omitempty" yaml:"exponent,omitempty"`
+	Multiplier float64         `xml:"multiplier,attr,omitempty" json:"multiplier,omitempty" yaml:"multiplier,omitempty"`
+	Offset     float64         `xml:"offset,attr,omitempty" json:"offset,omitempty" yaml:"offset,omitempty"`
+	Bits       []XMLFormatBit  `xml:"bit,omitempty" json:"bits,omitempty" yaml:"bits,omitempty"`
+	Enums      []XMLFormatEnum `xml:"enum,omitempty" json:"enums,omitempty" yaml:"enums,omitempty"`
+}
+
+// XMLFormat represents the layout of a characteristic value from the xml file
+type XMLFormat struct {
+	Endian string           `xml:"endian,attr,omitempty" json:"endian,omitempty" yaml:"endian,omitempty"`
+	Fields []XMLFormatField `xml:"field" json:"fields" yaml:"fields"`
+}
+
+// formatTypeSizes are the sizes in bytes of the fixed size field types
+var formatTypeSizes = map[string]int{
+	"uint8": 1, "uint16": 2, "uint24": 3, "uint32": 4, "uint64": 8,
+	"int8": 1, "int16": 2, "int24": 3, "int32": 4, "int64": 8,
+	"float": 4, "float32": 4, "float64": 8, "sfloat": 2, "medfloat": 4,
+}
+
+// formatFieldSize returns the size of a field, or 0 when it takes the rest of the value
+func formatFieldSize(f *XMLFormatField) int {
+	if f.Size != 0 {
+		return f.Size
+	}
+	if size, ok := formatTypeSizes[f.Type]; ok {
+		return size
+	}
+	if f.Type == "bitfield" || f.Type == "enum" {
+		return 1
+	}
+	return 0
+}
+
+// formatGetUint reads an unsigned integer of up to 8 bytes in the given byte order
+func formatGetUint(b []byte, bigEndian bool) uint64 {
+	var u uint64
+	for idx := range b {
+		if bigEndian {
+			u = (u << 8) | uint64(b[idx])
+		} else {
+			u = (u << 8) | uint64(b[len(b)-1-idx])
+		}
+	}
+	return u
+}
+
+// formatPutUint writes an unsigned integer into b in the given byte order
+func formatPutUint(b []byte, u uint64, bigEndian bool) {
+	for idx := range b {
+		if bigEndian {
+			b[len(b)-1-idx] = byte(u)
+		} else {
+			b[idx] = byte(u)
+		}
+		u >>= 8
+	}
+}
+
+// formatSignExtend interprets the low size bytes of u as a signed integer
+func formatSignExtend(u uint64, size int) int64 {
+	shift := uint(64 - 8*size)
+	return int64(u<<shift) >> shift
+}
+
+// formatScale applies the scaling of a field to a raw numeric value
+func formatScale(f *XMLFormatField, raw float64) float64 {
+	multiplier := f.Multiplier
+	if multiplier == 0 {
+		multiplier = 1
+	}
+	return raw*multiplier*math.Pow10(f.Exponent) + f.Offset
+}
+
+// formatUnscale reverses the scaling of a field to get the raw numeric value
+func formatUnscale(f *XMLFormatField, value float64) float64 {
+	multiplier := f.Multiplier
+	if multiplier == 0 {
+		multiplier = 1
+	}
+	return (value - f.Offset) / (multiplier * math.Pow10(f.Exponent))
+}
+
+// formatIEEE11073 decodes an IEEE-11073 SFLOAT (2 byte) or FLOAT (4 byte) value. With an
+// exponent of 0, the mantissas around the most negative one are special values: NaN, NRes
+// (not at this resolution) and the reserved one decode to NaN, and +INFINITY and -INFINITY
+// to infinities.
+func formatIEEE11073(u uint64, size int) float64 {
+	mantissaBits := uint(12)
+	if size == 4 {
+		mantissaBits = 24
+	}
+	expBits := uint(8*size) - mantissaBits
+
+	mantissa := u & (1<<mantissaBits - 1)
+	signedMantissa := int64(mantissa<<(64-mantissaBits)) >> (64 - mantissaBits)
+	exponent := int64(u>>mantissaBits<<(64-expBits)) >> (64 - expBits)
+	if exponent == 0 {
+		switch nres := int64(1) << (mantissaBits - 1); signedMantissa {
+		case nres - 1, -nres, -nres + 1:
+			return math.NaN()
+		case nres - 2:
+			return math.Inf(1)
+		case -nres + 2:
+			return math.Inf(-1)
+		}
+	}
+	// Dividing by a power of ten rounds correctly where multiplying by its inverse may not
+	if exponent < 0 {
+		return float64(signedMantissa) / math.Pow10(int(-exponent))
+	}
+	return float64(signedMantissa) * math.Pow10(int(exponent))
+}
+
+// formatToIEEE11073 encodes a value as an IEEE-11073 SFLOAT (2 byte) or FLOAT (4 byte)
+func formatToIEEE11073(value float64, size int) uint64 {
+	mantissaBits, minExp, maxExp := uint(12), -8, 7
+	if size == 4 {
+		mantissaBits, minExp, maxExp = 24, -128, 127
+	}
+	nres := int64(1) << (mantissaBits - 1)
+	switch {
+	case math.IsNaN(value):
+		return uint64(nres - 1)
+	case math.IsInf(value, 1):
+		return uint64(nres - 2)
+	case math.IsInf(value, -1):
+		return uint64(nres + 2)
+	}
+
+	exponent := minExp
+	for ; exponent < maxExp; exponent++ {
+		// With an exponent of 0, the mantissas of the special values are not used for numbers
+		m, min, max := math.Round(value/math.Pow10(exponent)), -nres, nres-1
+		if exponent == 0 {
+			min, max = -nres+3, nres-3
+		}
+		if m >= float64(min) && m <= float64(max) {
+			break
+		}
+	}
+	mantissa := int64(math.Round(value / math.Pow10(exponent)))
+	expMask := uint64(1)<<(uint(8*size)-mantissaBits) - 1
+	return (uint64(exponent)&expMask)<<mantissaBits | uint64(mantissa)&(1<<mantissaBits-1)
+}
+
+// formatNumber renders a scaled numeric value with the unit of its field
+func formatNumber(f *XMLFormatField, value float64) string {
+	s := strconv.FormatFloat(value, 'f', -1, 64)
+	if len(f.Unit) != 0 {
+		s += " " + f.Unit
+	}
+	return s
+}
+
+// formatEnumName looks up the name of a field value in its enums
+func formatEnumName(f *XMLFormatField, n int64) (string, bool) {
+	for _, e := range f.Enums {
+		if e.Value == n {
+			return e.Name, true
+		}
+	}
+	return "", false
+}
+
+// formatEnumValue looks up a field value by its name in the enums of the field
+func formatEnumValue(f *XMLFormatField, name string) (int64, bool) {
+	for _, e := range f.Enums {
+		if strings.EqualFold(e.Name, name) {
+			return e.Value, true
+		}
+	}
+	return 0, false
+}
+
+// formatDecodeField decodes a single field from its bytes
+func formatDecodeField(f *XMLFormatField, b []byte, bigEndian bool) (string, error) {
+	u := uint64(0)
+	if len(b) <= 8 {
+		u = formatGetUint(b, bigEndian)
+	}
+
+	switch f.Type {
+	case "uint8", "uint16", "uint24", "uint32", "uint64":
+		if name, ok := formatEnumName(f, int64(u)); ok {
+			return name, nil
+		}
+		return formatNumber(f, formatScale(f, float64(u))), nil
+	case "int8", "int16", "int24", "int32", "int64":
+		n := formatSignExtend(u, len(b))
+		if name, ok := formatEnumName(f, n); ok {
+			return name, nil
+		}
+		return formatNumber(f, formatScale(f, float64(n))), nil
+	case "float", "float32":
+		return formatNumber(f, formatScale(f, float64(math.Float32frombits(uint32(u))))), nil
+	case "float64":
+		return formatNumber(f, formatScale(f, math.Float64frombits(u))), nil
+	case "sfloat", "medfloat":
+		return formatNumber(f, formatScale(f, formatIEEE11073(u, len(b)))), nil
+	case "utf8":
+		return strconv.Quote(string(b)), nil
+	case "bytes":
+		return hex.EncodeToString(b), nil
+	case "enum":
+		if name, ok := formatEnumName(f, int64(u)); ok {
+			return name, nil
+		}
+		return fmt.Sprintf("unknown(%d)", u), nil
+	case "bitfield":
+		// Bits without a name are shown as hex, as is a bitfield with no bit elements
+		if len(f.Bits) == 0 {
+			return fmt.Sprintf("0x%0*x", 2*len(b), u), nil
+		}
+		var names []string
+		unnamed := u
+		for _, bit := range f.Bits {
+			if (u>>bit.Index)&1 != 0 {
+				names = append(names, bit.Name)
+			}
+			unnamed &^= 1 << bit.Index
+		}
+		if unnamed != 0 {
+			names = append(names, fmt.Sprintf("0x%0*x", 2*len(b), unnamed))
+		}
+		if len(names) == 0 {
+			return "none", nil
+		}
+		return strings.Join(names, "|"), nil
+	}
+	return "", fmt.Errorf("unknown field type %q", f.Type)
+}
+
+// formatDecode decodes a characteristic value into "name=value" strings, one per field
+func formatDecode(format *XMLFormat, b []byte) ([]string, error) {
+	var fields []string
+	bigEndian := format.Endian == "big"
+
+	for idx := range format.Fields {
+		f := &format.Fields[idx]
+		size := formatFieldSize(f)
+		if size == 0 {
+			size = len(b)
+		}
+		if len(b) < size {
+			return fields, fmt.Errorf("value too short for field %s", f.Name)
+		}
+		s, err := formatDecodeField(f, b[:size], bigEndian)
+		if err != nil {
+			return fields, err
+		}
+		fields = append(fields, f.Name+"="+s)
+		b = b[size:]
+	}
+	if len(b) != 0 {
+		return fields, fmt.Errorf("%d unexpected trailing bytes", len(b))
+	}
+	return fields, nil
+}
+
+// formatDecodeChar decodes the value of a characteristic with its format in the spec, or
+// with its registered or SIG decoder when the spec has no format for it. It returns no
+// fields when the characteristic has neither, or when a decoder fails, as its fields may
+// be bogus.
+func formatDecodeChar(spec *XMLDevice, charID string, b []byte) ([]string, error) {
+	if format := xmlFindCharFormat(spec, charID); format != nil {
+		return formatDecode(format, b)
+	}
+	if decoder := decoderFind(charID); decoder != nil {
+		fields, err := decoder.Decode(b)
+		if err != nil {
+			return nil, err
+		}
+		return fields, nil
+	}
+	return nil, nil
+}
+
+// formatDescribeChar renders the value of a characteristic as hex, followed by its fields
+// when it can be decoded with the spec or a decoder
+func formatDescribeChar(spec *XMLDevice, charID string, b []byte) string {
+	s := fmt.Sprintf("%x", b)
+	fields, err := formatDecodeChar(spec, charID, b)
+	if err != nil {
+		fields = append(fields, "("+err.Error()+")")
+	}
+	if len(fields) == 0 {
+		return s
+	}
+	return s + " [" + strings.Join(fields, ", ") + "]"
+}
+
+// formatEncodeField encodes the input of a single field
+func formatEncodeField(f *XMLFormatField, input string, bigEndian bool) ([]byte, error) {
+	size := formatFieldSize(f)
+
+	switch f.Type {
+	case "utf8":
+		if size != 0 && len(input) > size {
+			return nil, fmt.Errorf("%s is longer than %d bytes", f.Name, size)
+		}
+		b := make([]byte, size)
+		if size == 0 {
+			return []byte(input), nil
+		}
+		copy(b, input)
+		return b, nil
+	case "bytes":
+		return hex.DecodeString(input)
+	}
+
+	var u uint64
+	switch f.Type {
+	case "enum":
+		n, found := formatEnumValue(f, input)
+		if !found {
+			var err error
+			if n, err = strconv.ParseInt(input, 0, 64); err != nil {
+				return nil, fmt.Errorf("unknown %s value %q", f.Name, input)
+			}
+		}
+		u = uint64(n)
+	case "bitfield":
+		for _, name := range strings.Split(input, "|") {
+			name = strings.TrimSpace(name)
+			found := false
+			for _, bit := range f.Bits {
+				if strings.EqualFold(bit.Name, name) {
+					u, found = u|1<<bit.Index, true
+				}
+			}
+			if !found && len(name) != 0 && name != "none" {
+				n, err := strconv.ParseUint(name, 0, 64)
+				if err != nil {
+					return nil, fmt.Errorf("unknown %s bit %q", f.Name, name)
+				}
+				u |= n
+			}
+		}
+	default:
+		if n, found := formatEnumValue(f, input); found {
+			u = uint64(n)
+			break
+		}
+		value, err := strconv.ParseFloat(input, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value %q", f.Name, input)
+		}
+		raw := formatUnscale(f, value)
+		switch f.Type {
+		case "float", "float32":
+			u = uint64(math.Float32bits(float32(raw)))
+		case "float64":
+			u = math.Float64bits(raw)
+		case "sfloat", "medfloat":
+			u = formatToIEEE11073(raw, size)
+		case "uint8", "uint16", "uint24", "uint32", "uint64":
+			if raw < 0 || (size < 8 && math.Round(raw) >= float64(uint64(1)<<uint(8*size))) {
+				return nil, fmt.Errorf("%s value %v out of range", f.Name, value)
+			}
+			u = uint64(math.Round(raw))
+		case "int8", "int16", "int24", "int32", "int64":
+			limit := math.Pow(2, float64(8*size-1))
+			if math.Round(raw) < -limit || math.Round(raw) >= limit {
+				return nil, fmt.Errorf("%s value %v out of range", f.Name, value)
+			}
+			u = uint64(int64(math.Round(raw)))
+		default:
+			return nil, fmt.Errorf("unknown field type %q", f.Type)
+		}
+	}
+
+	b := make([]byte, size)
+	formatPutUint(b, u, bigEndian)
+	return b, nil
+}
+
+// formatEncode encodes user input into a characteristic value. The input holds the
+// field values separated by ';', either in order or as name=value pairs.
+func formatEncode(format *XMLFormat, input string) ([]byte, error) {
+	var value []byte
+	bigEndian := format.Endian == "big"
+
+	values := make(map[string]string)
+	for idx, item := range strings.Split(input, ";") {
+		item = strings.TrimSpace(item)
+		if pos := strings.Index(item, "="); pos >= 0 {
+			values[strings.TrimSpace(item[:pos])] = strings.TrimSpace(item[pos+1:])
+		} else if idx < len(format.Fields) {
+			values[format.Fields[idx].Name] = item
+		}
+	}
+
+	for idx := range format.Fields {
+		f := &format.Fields[idx]
+		input, ok := values[f.Name]
+		if !ok {
+			return nil, fmt.Errorf("missing value for field %s", f.Name)
+		}
+		b, err := formatEncodeField(f, input, bigEndian)
+		if err != nil {
+			return nil, err
+		}
+		value = append(value, b...)
+	}
+	return value, nil
+}
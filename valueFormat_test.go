@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestFormatBitfield(t *testing.T) {
+	named := &XMLFormatField{Name: "Flags", Type: "bitfield", Bits: []XMLFormatBit{{0, "On"}, {2, "Dimmed"}}}
+	unnamed := &XMLFormatField{Name: "Flags", Type: "bitfield", Size: 2}
+
+	for _, test := range []struct {
+		f     *XMLFormatField
+		value []byte
+		s     string
+	}{
+		{named, []byte{0x05}, "On|Dimmed"},
+		{named, []byte{0x00}, "none"},
+		{named, []byte{0x83}, "On|0x82"},
+		{unnamed, []byte{0x05, 0x01}, "0x0105"},
+		{unnamed, []byte{0x00, 0x00}, "0x0000"},
+	} {
+		s, err := formatDecodeField(test.f, test.value, false)
+		if err != nil || s != test.s {
+			t.Errorf("decoded %x as %q, %v, expected %q", test.value, s, err, test.s)
+			continue
+		}
+		b, err := formatEncodeField(test.f, s, false)
+		if err != nil || !bytes.Equal(b, test.value) {
+			t.Errorf("encoded %q as %x, %v, expected %x", s, b, err, test.value)
+		}
+	}
+}
+
+func TestFormatIEEE11073(t *testing.T) {
+	for _, test := range []struct {
+		u     uint64
+		size  int
+		value float64
+	}{
+		{0x07FF, 2, math.NaN()},
+		{0x0800, 2, math.NaN()},
+		{0x0801, 2, math.NaN()},
+		{0x07FE, 2, math.Inf(1)},
+		{0x0802, 2, math.Inf(-1)},
+		{0x17FF, 2, 20470},
+		{0xF7FF, 2, 204.7},
+		{0x1800, 2, -20480},
+		{0x0072, 2, 114},
+		{0xFFFF, 2, -0.1},
+		{0xE16C, 2, 3.64},
+		{0x007FFFFF, 4, math.NaN()},
+		{0x00800000, 4, math.NaN()},
+		{0x007FFFFE, 4, math.Inf(1)},
+		{0x00800002, 4, math.Inf(-1)},
+		{0x017FFFFF, 4, 83886070},
+		{0xFF00016C, 4, 36.4},
+		{0xFEFFFE0C, 4, -5},
+	} {
+		value := formatIEEE11073(test.u, test.size)
+		if math.IsNaN(test.value) && !math.IsNaN(value) ||
+			!math.IsNaN(test.value) && math.Abs(value-test.value) > 1e-9*math.Abs(test.value) {
+			t.Errorf("decoded %#x of %d bytes as %v, expected %v", test.u, test.size, value, test.value)
+			continue
+		}
+		// Values encode back to the same value, special ones to their canonical encoding
+		if back := formatIEEE11073(formatToIEEE11073(value, test.size), test.size); math.IsNaN(value) &&
+			!math.IsNaN(back) || !math.IsNaN(value) && math.Abs(back-value) > 1e-9*math.Abs(value) {
+			t.Errorf("encoded %v of %d bytes back as %v", value, test.size, back)
+		}
+	}
+}
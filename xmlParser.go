@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/xml"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -12,80 +13,146 @@ import (
 
 // XMLCharProperties represents the BLE characteristic properties from the xml file
 type XMLCharProperties struct {
-	Broadcast            string
-	Read                 string
-	WriteWithoutResponse string
-	Write                string
-	Notify               string
-	Indicate             string
-	SignedWrite          string
-	Extended             string
+	Broadcast            string `json:"broadcast" yaml:"broadcast"`
+	Read                 string `json:"read" yaml:"read"`
+	WriteWithoutResponse string `json:"writeWithoutResponse" yaml:"writeWithoutResponse"`
+	Write                string `json:"write" yaml:"write"`
+	Notify               string `json:"notify" yaml:"notify"`
+	Indicate             string `json:"indicate" yaml:"indicate"`
+	SignedWrite          string `json:"signedWrite" yaml:"signedWrite"`
+	Extended             string `json:"extended" yaml:"extended"`
 	bitMask              gatt.Property
 }
 
 // XMLCharacteristic represents the BLE characteristic information from the xml file
 type XMLCharacteristic struct {
-	CharName    string `xml:"name,attr"`
-	CharID      string `xml:"uuid,attr"`
-	Requirement string
-	Properties  XMLCharProperties
+	CharName    string              `xml:"name,attr" json:"name" yaml:"name"`
+	CharID      string              `xml:"uuid,attr" json:"uuid" yaml:"uuid"`
+	Requirement string              `json:"requirement" yaml:"requirement"`
+	Properties  XMLCharProperties   `json:"properties" yaml:"properties"`
+	Fields      []XMLField          `xml:"Field,omitempty" json:"fields,omitempty" yaml:"fields,omitempty"`
+	Value       *XMLValueConstraint `xml:"value,omitempty" json:"value,omitempty" yaml:"value,omitempty"`
+	Format      *XMLFormat          `xml:"format,omitempty" json:"format,omitempty" yaml:"format,omitempty"`
+}
+
+// XMLEnumeration represents a named value of a characteristic value field
+type XMLEnumeration struct {
+	Key   string `xml:"key,attr" json:"key" yaml:"key"`
+	Value string `xml:"value,attr" json:"value" yaml:"value"`
+}
+
+// XMLEnumerations represents the list of named values of a characteristic value field
+type XMLEnumerations struct {
+	Enumeration []XMLEnumeration `json:"enumeration" yaml:"enumeration"`
+}
+
+// XMLField represents a field of a characteristic value, as described by the SIG
+type XMLField struct {
+	Name            string           `xml:"name,attr" json:"name" yaml:"name"`
+	Requirement     string           `xml:",omitempty" json:"requirement,omitempty" yaml:"requirement,omitempty"`
+	Format          string           `xml:",omitempty" json:"format,omitempty" yaml:"format,omitempty"`
+	Unit            string           `xml:",omitempty" json:"unit,omitempty" yaml:"unit,omitempty"`
+	Minimum         string           `xml:",omitempty" json:"minimum,omitempty" yaml:"minimum,omitempty"`
+	Maximum         string           `xml:",omitempty" json:"maximum,omitempty" yaml:"maximum,omitempty"`
+	DecimalExponent string           `xml:",omitempty" json:"decimalExponent,omitempty" yaml:"decimalExponent,omitempty"`
+	Enumerations    *XMLEnumerations `xml:",omitempty" json:"enumerations,omitempty" yaml:"enumerations,omitempty"`
 }
 
 // XMLService represents the BLE service information from the xml file
 type XMLService struct {
-	ServiceName string              `xml:"name,attr"`
-	ServiceID   string              `xml:"uuid,attr"`
-	CharList    []XMLCharacteristic `xml:"characteristic"`
+	ServiceName string              `xml:"name,attr" json:"name" yaml:"name"`
+	ServiceID   string              `xml:"uuid,attr" json:"uuid" yaml:"uuid"`
+	CharList    []XMLCharacteristic `xml:"characteristic" json:"characteristics" yaml:"characteristics"`
 	numChars    int
 }
 
 // XMLDevice represents the BLE Device information from the xml file
 type XMLDevice struct {
-	XMLName     xml.Name     `xml:"device"`
-	DeviceName  string       `xml:"name,attr"`
-	ServiceList []XMLService `xml:"service"`
-	numServices int
+	XMLName       xml.Name          `xml:"device" json:"-" yaml:"-"`
+	DeviceName    string            `xml:"name,attr" json:"name" yaml:"name"`
+	Identity      *XMLIdentity      `xml:"identity,omitempty" json:"identity,omitempty" yaml:"identity,omitempty"`
+	Advertisement *XMLAdvertisement `xml:"advertisement,omitempty" json:"advertisement,omitempty" yaml:"advertisement,omitempty"`
+	ServiceList   []XMLService      `xml:"service" json:"services" yaml:"services"`
+	numServices   int
 }
 
 const mandatory = "Mandatory"
 const excluded = "Excluded"
 
+// sigBaseUUID is the tail of the Bluetooth Base UUID, used to shorten assigned numbers
+const sigBaseUUID = "00001000800000805f9b34fb"
+
+// xmlNormalizeUUID converts a UUID to the lower case, dashless form reported by gatt
+func xmlNormalizeUUID(uuid string) string {
+	uuid = strings.ToLower(strings.Replace(strings.TrimSpace(uuid), "-", "", -1))
+	uuid = strings.TrimPrefix(uuid, "0x")
+	if len(uuid) == 32 && strings.HasPrefix(uuid, "0000") && strings.HasSuffix(uuid, sigBaseUUID) {
+		uuid = uuid[4:8]
+	}
+	return uuid
+}
+
 // getProperties gets a bitmap of the characteristic properties
-func getProperties(char *XMLCharacteristic) {
-	fmt.Print("\t    ")
+func getProperties(w io.Writer, char *XMLCharacteristic) {
+	fmt.Fprint(w, "\t    ")
 	if strings.Compare(char.Properties.Broadcast, mandatory) == 0 {
-		fmt.Print("broadcast ")
+		fmt.Fprint(w, "broadcast ")
 		char.Properties.bitMask |= gatt.CharBroadcast
 	}
 	if strings.Compare(char.Properties.Read, mandatory) == 0 {
-		fmt.Print("read ")
+		fmt.Fprint(w, "read ")
 		char.Properties.bitMask |= gatt.CharRead
 	}
 	if strings.Compare(char.Properties.WriteWithoutResponse, mandatory) == 0 {
-		fmt.Print("writeWithoutResponse ")
+		fmt.Fprint(w, "writeWithoutResponse ")
 		char.Properties.bitMask |= gatt.CharWriteNR
 	}
 	if strings.Compare(char.Properties.Write, mandatory) == 0 {
-		fmt.Print("write ")
+		fmt.Fprint(w, "write ")
 		char.Properties.bitMask |= gatt.CharWrite
 	}
 	if strings.Compare(char.Properties.Notify, mandatory) == 0 {
-		fmt.Print("notify ")
+		fmt.Fprint(w, "notify ")
 		char.Properties.bitMask |= gatt.CharNotify
 	}
 	if strings.Compare(char.Properties.Indicate, mandatory) == 0 {
-		fmt.Print("indicate ")
+		fmt.Fprint(w, "indicate ")
 		char.Properties.bitMask |= gatt.CharIndicate
 	}
 	if strings.Compare(char.Properties.SignedWrite, mandatory) == 0 {
-		fmt.Print("signedWrite ")
+		fmt.Fprint(w, "signedWrite ")
 		char.Properties.bitMask |= gatt.CharSignedWrite
 	}
 	if strings.Compare(char.Properties.Extended, mandatory) == 0 {
-		fmt.Print("extended  ")
+		fmt.Fprint(w, "extended  ")
 		char.Properties.bitMask |= gatt.CharExtended
 	}
-	fmt.Println()
+	fmt.Fprintln(w)
+}
+
+// xmlGetBitMask gets a bitmap of the characteristic properties without displaying them
+func xmlGetBitMask(props *XMLCharProperties) gatt.Property {
+	var bitMask gatt.Property
+
+	flags := []struct {
+		value string
+		prop  gatt.Property
+	}{
+		{props.Broadcast, gatt.CharBroadcast},
+		{props.Read, gatt.CharRead},
+		{props.WriteWithoutResponse, gatt.CharWriteNR},
+		{props.Write, gatt.CharWrite},
+		{props.Notify, gatt.CharNotify},
+		{props.Indicate, gatt.CharIndicate},
+		{props.SignedWrite, gatt.CharSignedWrite},
+		{props.Extended, gatt.CharExtended},
+	}
+	for _, f := range flags {
+		if strings.Compare(f.value, mandatory) == 0 {
+			bitMask |= f.prop
+		}
+	}
+	return bitMask
 }
 
 // xmlSetProperties sets the xml characteristic properties based on the bitmap
@@ -171,6 +238,12 @@ func xmlFindService(device *XMLDevice, svcID string) (bool, *XMLService) {
 	return false, nil
 }
 
+// xmlIsMandatory tells whether a device must have the characteristic: a characteristic without
+// a requirement is mandatory, while optional and conditional (C1, C2...) ones may be absent
+func xmlIsMandatory(char *XMLCharacteristic) bool {
+	return len(char.Requirement) == 0 || strings.EqualFold(char.Requirement, mandatory)
+}
+
 // xmlFindChar searches for a characteristic, by UUID, in a given xml parsed service
 func xmlFindChar(svc *XMLService, charID string) (bool, *XMLCharacteristic) {
 	for _, c := range svc.CharList {
@@ -181,6 +254,23 @@ func xmlFindChar(svc *XMLService, charID string) (bool, *XMLCharacteristic) {
 	return false, nil
 }
 
+// xmlFindCharFormat searches all services of a device for the value format of a
+// characteristic, by UUID
+func xmlFindCharFormat(device *XMLDevice, charID string) *XMLFormat {
+	if device == nil {
+		return nil
+	}
+	charID = xmlNormalizeUUID(charID)
+	for _, s := range device.ServiceList {
+		for _, c := range s.CharList {
+			if xmlNormalizeUUID(c.CharID) == charID {
+				return c.Format
+			}
+		}
+	}
+	return nil
+}
+
 // xmlShowDeviceSummary displayes the summary of a device parsed from an xml file
 func xmlShowDeviceSummary(device *XMLDevice) {
 
@@ -218,35 +308,69 @@ func xmlOutDeviceInfo(dev *XMLDevice) {
 
 	fmt.Println("XML Output created in file", xmlFile)
 
-	f, err := os.Create(xmlFile)
-	if err != nil {
+	if err := xmlWriteDevice(dev, xmlFile); err != nil {
 		panic(err)
 	}
+
+	fmt.Println()
+}
+
+// xmlWriteDevice marshals a device into the specified xml file
+func xmlWriteDevice(dev *XMLDevice, fileName string) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
 	defer f.Close()
 
 	output, err := xml.MarshalIndent(dev, "  ", "    ")
 	if err != nil {
-		fmt.Printf("error: %v\n", err)
+		return err
 	}
 
 	f.Write([]byte(xml.Header))
 	f.Write(output)
 
-	fmt.Println()
+	return nil
+}
+
+// xmlLoadDevice parses an xml file into a device without displaying it
+func xmlLoadDevice(fileName string) (*XMLDevice, error) {
+	var device XMLDevice
+
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := xml.Unmarshal(b, &device); err != nil {
+		return nil, err
+	}
+
+	for svcIdx := range device.ServiceList {
+		svc := &device.ServiceList[svcIdx]
+		svc.numChars = len(svc.CharList)
+		for idx := range svc.CharList {
+			svc.CharList[idx].Properties.bitMask = xmlGetBitMask(&svc.CharList[idx].Properties)
+		}
+	}
+	device.numServices = len(device.ServiceList)
+
+	return &device, nil
 }
 
 // xmlGetServices parsed an xml file to create a representation of the device in memory
-func xmlGetServices(fileName string) *XMLDevice {
+func xmlGetServices(w io.Writer, fileName string) *XMLDevice {
 	var device XMLDevice
 
 	if len(fileName) == 0 {
-		fmt.Println(" Please specify a file to open")
+		fmt.Fprintln(w, " Please specify a file to open")
 		os.Exit(0)
 	}
 	xmlFile, err := os.Open(fileName)
 
 	if err != nil {
-		fmt.Println(err.Error())
+		fmt.Fprintln(w, err.Error())
 		os.Exit(1)
 	}
 	defer xmlFile.Close()
@@ -255,15 +379,15 @@ func xmlGetServices(fileName string) *XMLDevice {
 
 	xml.Unmarshal(b, &device)
 
-	fmt.Println("\nReading Device File for Device ", device.DeviceName)
+	fmt.Fprintln(w, "\nReading Device File for Device ", device.DeviceName)
 
 	for svcIdx, s := range device.ServiceList {
-		fmt.Println("Service: ", s.ServiceID, "(", s.ServiceName, ")")
+		fmt.Fprintln(w, "Service: ", s.ServiceID, "(", s.ServiceName, ")")
 		device.numServices++
 		for idx, c := range s.CharList {
-			fmt.Println("\tCharacteristic", c.CharID, "(", c.CharName, ")")
+			fmt.Fprintln(w, "\tCharacteristic", c.CharID, "(", c.CharName, ")")
 			device.ServiceList[svcIdx].numChars++
-			getProperties(&s.CharList[idx])
+			getProperties(w, &s.CharList[idx])
 		}
 	}
 	xmlShowDeviceSummary(&device)